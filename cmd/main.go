@@ -7,81 +7,314 @@ import (
 	"fmt"
 	"github.com/leandersteiner/interview-assignment/internal/calculator"
 	"github.com/leandersteiner/interview-assignment/internal/handlers"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdin, &slog.HandlerOptions{}))
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(os.Stdin, &slog.HandlerOptions{Level: level}))
 
-	persistFlag := flag.Bool("persist", false, "enable persistence")
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", "127.0.0.1:8080", "address of the public listener")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "", "address of the admin listener with pprof, expvar and runtime controls, e.g. 127.0.0.1:8081 (disabled if empty)")
+	flag.TextVar(level, "log-level", level, "initial log level (debug, info, warn or error); it can be changed on the admin listener")
+	flag.StringVar(&cfg.store, "store", "memory://", "store URL (memory://, file:///path/results.json, wal:///path/ or segment:///path/)")
+	modeFlag := flag.String("mode", string(calculator.ModeFloat), "default calculation mode (float or decimal)")
+	flag.IntVar(&cfg.maxBatchSize, "max-batch-size", calculator.DefaultMaxBatchSize, "maximum number of items per batch request")
+	syncFlag := flag.String("fsync", string(calculator.SyncAlways), "when to fsync the write-ahead log or segments (always, interval or never)")
+	flag.DurationVar(&cfg.wal.SyncInterval, "fsync-interval", calculator.DefaultSyncInterval, "how often the write-ahead log is fsynced with --fsync interval")
+	flag.IntVar(&cfg.wal.SnapshotEvery, "snapshot-every", calculator.DefaultSnapshotEvery, "write a snapshot after this many log records (0 only on shutdown)")
+	flag.Int64Var(&cfg.segment.SegmentSize, "segment-size", calculator.DefaultSegmentSize, "size in bytes at which a new segment is started")
+	flag.DurationVar(&cfg.segment.CompactInterval, "compact-interval", calculator.DefaultCompactInterval, "how often segments are checked for compaction")
+	flag.IntVar(&cfg.retention.MaxCount, "retention-max-count", 0, "maximum number of results to keep (0 keeps all)")
+	flag.DurationVar(&cfg.retention.MaxAge, "retention-max-age", 0, "maximum age of results to keep (0 keeps all)")
+	flag.DurationVar(&cfg.retentionInterval, "retention-interval", time.Minute, "how often the retention policy is enforced")
+	flag.StringVar(&cfg.keyFile, "encryption-key-file", "", "file with the keys that encrypt the persisted results (<id>:<base64 key> per line, first key encrypts)")
+	flag.StringVar(&cfg.keyEnv, "encryption-key-env", "", "environment variable with the keys that encrypt the persisted results, if no key file is given")
+	flag.DurationVar(&cfg.shutdownDelay, "shutdown-delay", 5*time.Second, "how long /readyz reports draining before the listeners stop accepting requests (a second signal ends it early)")
+	flag.DurationVar(&cfg.healthMaxSaveAge, "health-max-save-age", 0, "how old the last successful snapshot may be before /readyz fails (0 only fails after a failed snapshot)")
+	flag.Uint64Var(&cfg.healthMinFreeBytes, "health-min-free-bytes", calculator.DefaultMinFreeBytes, "free disk space in the store directory below which /readyz fails")
+	flag.BoolVar(&cfg.webhookAllowPrivate, "webhook-allow-private-networks", false, "deliver webhooks to loopback, private and link-local addresses")
+	flag.Func("session-allowed-origins", "comma-separated origins, e.g. https://example.com, whose pages may open WebSocket sessions besides the API's own", func(value string) error {
+		for origin := range strings.SplitSeq(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.sessionAllowedOrigins = append(cfg.sessionAllowedOrigins, origin)
+			}
+		}
+		return nil
+	})
+	flag.StringVar(&cfg.traceFile, "trace-file", "", "append sampled request spans to this file as OTLP/JSON lines (tracing is off if empty)")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "report how the storage file would be migrated and exit")
 	flag.Parse()
 
-	if err := run(logger, *persistFlag); err != nil {
+	keys, err := calculator.LoadKeyring(cfg.keyFile, cfg.keyEnv)
+	if err != nil {
 		logger.Error("startup", "error", err)
 		os.Exit(1)
 	}
-}
+	cfg.keys = keys
 
-func run(log *slog.Logger, shouldPersist bool) error {
-	var mux http.Handler
-
-	if shouldPersist {
-		log.Info("using JSON store")
-		store, err := calculator.NewJSONStore()
+	if *migrateDryRun {
+		report, err := calculator.MigrateStore(cfg.store, true, cfg.keys)
 		if err != nil {
-			return fmt.Errorf("failed to create JSON store: %w", err)
+			logger.Error("migration", "error", err)
+			os.Exit(1)
 		}
-		defer func(store *calculator.JSONStore) {
-			err := store.Save()
-			if err != nil {
-				log.Error("could not save store", "error", err)
-			}
-			log.Info("store saved")
-		}(store)
-		mux = handlers.NewMux(handlers.MuxConfig{
-			Logger: log,
-			Store:  store,
-		})
-	} else {
-		log.Info("using in-memory store")
-		store := calculator.NewResultStore()
-		mux = handlers.NewMux(handlers.MuxConfig{
-			Logger: log,
-			Store:  store,
-		})
+		fmt.Printf("%s: version %d, current version %d\n", report.Path, report.From, report.To)
+		for _, change := range report.Changes {
+			fmt.Println("  " + change)
+		}
+		return
+	}
+
+	mode, err := calculator.ParseMode(*modeFlag)
+	if err != nil {
+		logger.Error("startup", "error", err)
+		os.Exit(1)
+	}
+	cfg.mode = mode
+
+	cfg.wal.Sync, err = calculator.ParseSyncPolicy(*syncFlag)
+	if err != nil {
+		logger.Error("startup", "error", err)
+		os.Exit(1)
 	}
+	cfg.segment.Sync = cfg.wal.Sync
+	cfg.segment.SyncInterval = cfg.wal.SyncInterval
 
+	if cfg.retentionInterval <= 0 {
+		logger.Error("startup", "error", "retention interval must be positive")
+		os.Exit(1)
+	}
+
+	if err := run(logger, level, cfg); err != nil {
+		logger.Error("startup", "error", err)
+		os.Exit(1)
+	}
+}
+
+type config struct {
+	addr                  string
+	adminAddr             string
+	store                 string
+	mode                  calculator.Mode
+	maxBatchSize          int
+	wal                   calculator.WALOptions
+	segment               calculator.SegmentOptions
+	keyFile               string
+	keyEnv                string
+	keys                  *calculator.Keyring
+	retention             calculator.RetentionPolicy
+	retentionInterval     time.Duration
+	traceFile             string
+	shutdownDelay         time.Duration
+	healthMaxSaveAge      time.Duration
+	healthMinFreeBytes    uint64
+	webhookAllowPrivate   bool
+	sessionAllowedOrigins []string
+}
+
+// redacted returns the effective configuration for the admin listener. The
+// store URL may contain credentials, and of the keys only the ID of the
+// current one is shown.
+func (c config) redacted() map[string]any {
+	store := c.store
+	if u, err := url.Parse(c.store); err == nil {
+		store = u.Redacted()
+	}
+	encryption := map[string]any{
+		"enabled":  c.keys != nil,
+		"key_file": c.keyFile,
+		"key_env":  c.keyEnv,
+	}
+	if c.keys != nil {
+		encryption["current_key"] = c.keys.Current()
+	}
+
+	return map[string]any{
+		"addr":           c.addr,
+		"admin_addr":     c.adminAddr,
+		"store":          store,
+		"mode":           c.mode,
+		"max_batch_size": c.maxBatchSize,
+		"wal": map[string]any{
+			"fsync":          c.wal.Sync,
+			"fsync_interval": c.wal.SyncInterval.String(),
+			"snapshot_every": c.wal.SnapshotEvery,
+		},
+		"segment": map[string]any{
+			"segment_size":     c.segment.SegmentSize,
+			"compact_interval": c.segment.CompactInterval.String(),
+		},
+		"retention": map[string]any{
+			"max_count": c.retention.MaxCount,
+			"max_age":   c.retention.MaxAge.String(),
+			"interval":  c.retentionInterval.String(),
+		},
+		"encryption":     encryption,
+		"trace_file":     c.traceFile,
+		"shutdown_delay": c.shutdownDelay.String(),
+		"health": map[string]any{
+			"max_save_age":   c.healthMaxSaveAge.String(),
+			"min_free_bytes": c.healthMinFreeBytes,
+		},
+		"webhook_allow_private_networks": c.webhookAllowPrivate,
+		"session_allowed_origins":        c.sessionAllowedOrigins,
+	}
+}
+
+func run(log *slog.Logger, level *slog.LevelVar, cfg config) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	health := web.NewHealth()
+	serverError := make(chan error, 2)
+
+	// the public listener starts before the store is loaded, so that probes
+	// see that the service is starting instead of failing to connect
+	var handler atomic.Value
+	handler.Store(handlers.NewStartupMux(log, health))
 	server := &http.Server{
-		Addr:        "127.0.0.1:8080",
-		Handler:     http.TimeoutHandler(mux, 5*time.Second, "request timed out"),
+		Addr: cfg.addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.Load().(http.Handler).ServeHTTP(w, r)
+		}),
 		IdleTimeout: 30 * time.Second,
 	}
+	// a no-op once the listeners were shut down
+	defer server.Close()
+	serve(log, server, serverError)
+	servers := []*http.Server{server}
+
+	log.Info("opening store", "url", cfg.store)
+	store, err := calculator.OpenStore(cfg.store, calculator.StoreOptions{
+		Logger:  log,
+		WAL:     cfg.wal,
+		Segment: cfg.segment,
+		Keys:    cfg.keys,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+	defer func() {
+		if saver, ok := store.(interface{ Save() error }); ok {
+			if err := saver.Save(); err != nil {
+				log.Error("could not save store", "error", err)
+			} else {
+				log.Info("store saved")
+			}
+		}
+		if closer, ok := store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Error("could not close store", "error", err)
+			}
+		}
+	}()
 
-	serverError := make(chan error, 1)
+	var tracer *web.Tracer
+	if cfg.traceFile != "" {
+		exporter, err := web.NewFileExporter(cfg.traceFile, "calculator")
+		if err != nil {
+			return fmt.Errorf("failed to open trace file: %w", err)
+		}
+		// runs after the server has shut down, so no spans are exported anymore
+		defer func() {
+			if err := exporter.Close(); err != nil {
+				log.Error("could not write traces", "error", err)
+			}
+			if dropped := exporter.Dropped(); dropped > 0 {
+				log.Warn("spans dropped", "count", dropped)
+			}
+		}()
+		tracer = web.NewTracer(exporter)
+	}
 
-	go func() {
-		log.Info("starting server", "address", server.Addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			serverError <- fmt.Errorf("error starting server: %w", err)
+	hub := calculator.NewHub()
+	webhooks := calculator.NewWebhooks(hub, calculator.WebhookOptions{
+		AllowPrivateNetworks: cfg.webhookAllowPrivate,
+	}, log)
+	// runs before the store is closed, after the server has shut down
+	defer webhooks.Close()
+	// runs first on every return, so no request reaches the store, the
+	// webhooks or the tracer once they are closed, and streams and sessions
+	// are ended; a no-op after a graceful shutdown
+	defer func() {
+		hub.Close()
+		if err := shutdown(servers); err != nil {
+			log.Error("could not shut down the listeners gracefully", "error", err)
 		}
 	}()
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	mux := handlers.NewMux(handlers.MuxConfig{
+		Logger:                log,
+		Store:                 store,
+		Mode:                  cfg.mode,
+		MaxBatchSize:          cfg.maxBatchSize,
+		Hub:                   hub,
+		Webhooks:              webhooks,
+		Tracer:                tracer,
+		Health:                health,
+		SessionAllowedOrigins: cfg.sessionAllowedOrigins,
+	})
+	calculator.RegisterHealthChecks(health, store, calculator.HealthOptions{
+		MaxSaveAge:   cfg.healthMaxSaveAge,
+		MinFreeBytes: cfg.healthMinFreeBytes,
+	})
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go calculator.RunJanitor(janitorCtx, log, store, cfg.retention, cfg.retentionInterval)
+
+	handler.Store(web.TimeoutHandler(mux, 5*time.Second, "request timed out"))
+	// streams never go idle, so Shutdown would wait for them until it times
+	// out, and it does not track sessions after the WebSocket upgrade at all
+	server.RegisterOnShutdown(hub.Close)
+
+	if cfg.adminAddr != "" {
+		admin := &http.Server{
+			Addr: cfg.adminAddr,
+			Handler: handlers.NewAdminMux(handlers.AdminConfig{
+				Logger: log,
+				Level:  level,
+				Store:  store,
+				Config: cfg.redacted(),
+			}),
+			IdleTimeout: 30 * time.Second,
+		}
+		serve(log, admin, serverError)
+		servers = append(servers, admin)
+	}
+
+	health.SetState(web.HealthReady)
+	log.Info("ready")
 
 	select {
 	case err := <-serverError:
 		return err
 	case <-stop:
 		log.Info("graceful shutdown initiated")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
+		// load balancers stop sending requests once /readyz fails
+		health.SetState(web.HealthDraining)
+		if cfg.shutdownDelay > 0 {
+			log.Info("draining", "delay", cfg.shutdownDelay)
+			select {
+			case <-time.After(cfg.shutdownDelay):
+			case <-stop:
+				log.Info("draining interrupted")
+			}
+		}
+
+		if err := shutdown(servers); err != nil {
 			return fmt.Errorf("error gracefully shutting down server: %w", err)
 		}
 		log.Info("graceful shutdown complete")
@@ -89,3 +322,37 @@ func run(log *slog.Logger, shouldPersist bool) error {
 
 	return nil
 }
+
+// shutdown stops the listeners and waits up to 10 seconds for their requests.
+// The listeners drain concurrently, so a long profile on the admin listener
+// does not hold up public requests. Connections still open after that are
+// closed.
+func shutdown(servers []*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			if err := server.Shutdown(ctx); err != nil {
+				errs <- errors.Join(err, server.Close())
+				return
+			}
+			errs <- nil
+		}()
+	}
+	var err error
+	for range servers {
+		err = errors.Join(err, <-errs)
+	}
+	return err
+}
+
+func serve(log *slog.Logger, server *http.Server, serverError chan<- error) {
+	go func() {
+		log.Info("starting server", "address", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverError <- fmt.Errorf("error starting server: %w", err)
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownBackend = errors.New("unknown store backend")
+
+// StoreOptions are passed to every backend. Backends ignore the options that
+// do not apply to them.
+type StoreOptions struct {
+	Logger  *slog.Logger
+	WAL     WALOptions
+	Segment SegmentOptions
+	// Keys encrypts the persisted results. Nil stores them in plaintext.
+	Keys *Keyring
+}
+
+// Backend builds a store from a URL whose scheme it was registered for.
+type Backend func(u *url.URL, opts StoreOptions) (Store, error)
+
+var backends = struct {
+	mu sync.RWMutex
+	m  map[string]Backend
+}{
+	m: map[string]Backend{
+		"memory":  openMemoryStore,
+		"file":    openFileStore,
+		"wal":     openWALStore,
+		"segment": openSegmentStore,
+	},
+}
+
+// RegisterBackend makes a backend available for URLs with the given scheme.
+func RegisterBackend(scheme string, backend Backend) error {
+	backends.mu.Lock()
+	defer backends.mu.Unlock()
+
+	if _, exists := backends.m[scheme]; exists {
+		return fmt.Errorf("store backend %q is already registered", scheme)
+	}
+	backends.m[scheme] = backend
+	return nil
+}
+
+// OpenStore builds the store described by rawURL, e.g. "memory://",
+// "file:///var/lib/calc/results.json", "wal:///var/lib/calc/" or
+// "segment:///var/lib/calc/".
+func OpenStore(rawURL string, opts StoreOptions) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL: %w", err)
+	}
+
+	backends.mu.RLock()
+	backend, ok := backends.m[u.Scheme]
+	backends.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q (expected one of %s)", ErrUnknownBackend, u.Scheme, strings.Join(schemes(), ", "))
+	}
+
+	return backend(u, opts)
+}
+
+func schemes() []string {
+	backends.mu.RLock()
+	defer backends.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(backends.m))
+}
+
+func openMemoryStore(_ *url.URL, _ StoreOptions) (Store, error) {
+	return NewResultStore(), nil
+}
+
+// openFileStore keeps the results in a single JSON file that is only written
+// by Save.
+func openFileStore(u *url.URL, opts StoreOptions) (Store, error) {
+	path, err := urlPath(u)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONStore(opts.Logger, path, WALOptions{}, opts.Keys)
+}
+
+// openWALStore keeps a snapshot and a write-ahead log in the directory.
+func openWALStore(u *url.URL, opts StoreOptions) (Store, error) {
+	dir, err := urlPath(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	opts.WAL.Path = filepath.Join(dir, "results.wal")
+	return NewJSONStore(opts.Logger, filepath.Join(dir, "results.json"), opts.WAL, opts.Keys)
+}
+
+// openSegmentStore keeps the results in segment files in the directory.
+func openSegmentStore(u *url.URL, opts StoreOptions) (Store, error) {
+	if opts.Keys != nil {
+		return nil, fmt.Errorf("store URL %q: segment stores do not support encryption", u.Redacted())
+	}
+	dir, err := urlPath(u)
+	if err != nil {
+		return nil, err
+	}
+	return NewSegmentStore(opts.Logger, dir, opts.Segment)
+}
+
+// MigrateStore migrates the storage file of a file:// or wal:// store, see
+// MigrateFile.
+func MigrateStore(rawURL string, dryRun bool, keys *Keyring) (MigrationReport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("invalid store URL: %w", err)
+	}
+
+	path, err := urlPath(u)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	switch u.Scheme {
+	case "file":
+	case "wal":
+		path = filepath.Join(path, "results.json")
+	default:
+		return MigrationReport{}, fmt.Errorf("store URL %q: %s stores have no storage file to migrate", u.Redacted(), u.Scheme)
+	}
+	return MigrateFile(path, dryRun, keys)
+}
+
+// urlPath returns the local path of a URL. Relative paths can be given
+// without slashes, e.g. "file:results.json".
+func urlPath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("store URL %q: remote hosts are not supported", u.Redacted())
+	}
+
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return "", fmt.Errorf("store URL %q: missing path", u.Redacted())
+	}
+	return filepath.FromSlash(path), nil
+}
@@ -0,0 +1,67 @@
+package calculator
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStore(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name      string
+		url       string
+		wantFiles []string
+		wantErr   bool
+	}{
+		{name: "memory", url: "memory://"},
+		{name: "file", url: "file://" + filepath.ToSlash(filepath.Join(dir, "file", "results.json")), wantFiles: []string{"file/results.json"}},
+		{name: "wal", url: "wal://" + filepath.ToSlash(filepath.Join(dir, "wal")) + "/", wantFiles: []string{"wal/results.json", "wal/results.wal"}},
+		{name: "segment", url: "segment://" + filepath.ToSlash(filepath.Join(dir, "segment")) + "/", wantFiles: []string{"segment/0000000000000001.seg"}},
+		{name: "unknown scheme", url: "redis://localhost:6379", wantErr: true},
+		{name: "remote host", url: "file://example.com/results.json", wantErr: true},
+		{name: "missing path", url: "wal://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.MkdirAll(filepath.Join(dir, "file"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := OpenStore(tt.url, StoreOptions{Logger: slog.New(slog.DiscardHandler)})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenStore(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			mustStore(t, store, Result{ID: "a"})
+			if saver, ok := store.(interface{ Save() error }); ok {
+				if err := saver.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if closer, ok := store.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, file := range tt.wantFiles {
+				if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+					t.Errorf("%s was not written: %v", file, err)
+				}
+			}
+		})
+	}
+
+	if _, err := OpenStore("redis://", StoreOptions{}); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("OpenStore(redis://) error = %v, want ErrUnknownBackend", err)
+	}
+}
@@ -0,0 +1,190 @@
+package calculator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Mode string
+
+const (
+	// ModeFloat computes with float64 and rounds the result to the service precision.
+	ModeFloat Mode = "float"
+	// ModeDecimal computes with exact rational arithmetic and only rounds the
+	// final result, so decimal inputs like 0.1 are never approximated.
+	ModeDecimal Mode = "decimal"
+)
+
+var ErrUnknownMode = errors.New("unknown calculation mode")
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(s)) {
+	case ModeFloat:
+		return ModeFloat, nil
+	case ModeDecimal:
+		return ModeDecimal, nil
+	}
+	return "", fmt.Errorf("%w %q (expected %q or %q)", ErrUnknownMode, s, ModeFloat, ModeDecimal)
+}
+
+// maxExponent bounds the exponent of decimal literals so that a request like
+// 1e999999999 cannot make math/big allocate unbounded memory.
+const maxExponent = 1000
+
+var numberPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE]([+-]?\d+))?$`)
+
+// Number is a decimal literal. It is decoded from either a JSON number or a
+// JSON string and keeps the digits exactly as they were sent, so that no
+// precision is lost before the calculation mode is known.
+type Number string
+
+func (n *Number) UnmarshalJSON(data []byte) error {
+	var num json.Number
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		num = json.Number(strings.TrimSpace(s))
+	} else if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+
+	if err := validateNumber(string(num)); err != nil {
+		return err
+	}
+	*n = Number(num)
+	return nil
+}
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	if n == "" {
+		return []byte("0"), nil
+	}
+	if json.Valid([]byte(n)) {
+		return []byte(n), nil
+	}
+	// literals like ".5" or "+1" are accepted on input but are not valid JSON
+	r, ok := n.Rat()
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", string(n))
+	}
+	return []byte(formatDecimal(r, 0)), nil
+}
+
+func (n Number) String() string {
+	return string(n)
+}
+
+func (n Number) Float64() float64 {
+	f, _ := strconv.ParseFloat(string(n), 64)
+	return f
+}
+
+// Rat returns n as an exact rational. Like Float64, an empty Number is zero.
+func (n Number) Rat() (*big.Rat, bool) {
+	if n == "" {
+		return new(big.Rat), true
+	}
+	return new(big.Rat).SetString(string(n))
+}
+
+func floatNumber(f float64) Number {
+	// encoding/json picks the shortest representation that round-trips
+	data, _ := json.Marshal(f)
+	return Number(data)
+}
+
+func validateNumber(s string) error {
+	m := numberPattern.FindStringSubmatch(s)
+	if m == nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	if m[3] != "" {
+		exp, err := strconv.Atoi(m[3])
+		if err != nil || exp > maxExponent || exp < -maxExponent {
+			return fmt.Errorf("exponent of %q is out of range", s)
+		}
+	}
+	return nil
+}
+
+// decimalPlaces returns the number of fractional digits needed to write r
+// exactly, and false if r has no finite decimal expansion.
+func decimalPlaces(r *big.Rat) (int, bool) {
+	d := new(big.Int).Set(r.Denom())
+	two, five := big.NewInt(2), big.NewInt(5)
+	mod := new(big.Int)
+
+	var twos, fives int
+	for {
+		if q, m := new(big.Int).QuoRem(d, two, mod); m.Sign() == 0 {
+			d, twos = q, twos+1
+			continue
+		}
+		break
+	}
+	for {
+		if q, m := new(big.Int).QuoRem(d, five, mod); m.Sign() == 0 {
+			d, fives = q, fives+1
+			continue
+		}
+		break
+	}
+
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return 0, false
+	}
+	return max(twos, fives), true
+}
+
+// formatDecimal renders r with at least minPlaces fractional digits, using
+// more where they are needed to show r exactly.
+func formatDecimal(r *big.Rat, minPlaces int) string {
+	places, ok := decimalPlaces(r)
+	if !ok || places < minPlaces {
+		places = minPlaces
+	}
+	return r.FloatString(places)
+}
+
+// maxRawPlaces is the number of fractional digits kept for unrounded decimal
+// results that have no short exact representation, like 1/3.
+const maxRawPlaces = 40
+
+func rawDecimal(r *big.Rat) Number {
+	if places, ok := decimalPlaces(r); ok && places <= maxRawPlaces {
+		return Number(r.FloatString(places))
+	}
+	return Number(r.FloatString(maxRawPlaces))
+}
+
+// formatNumber renders n with the given number of fractional digits. In
+// ModeDecimal digits beyond the precision are kept, so the exact value is
+// shown.
+func formatNumber(mode Mode, n Number, precision int) string {
+	if mode == ModeDecimal {
+		if r, ok := n.Rat(); ok {
+			return formatDecimal(r, precision)
+		}
+	}
+	return strconv.FormatFloat(n.Float64(), 'f', precision, 64)
+}
+
+// roundNumber rounds n to the given number of fractional digits, with halves
+// rounded away from zero in both modes.
+func roundNumber(mode Mode, n Number, precision int) string {
+	if mode == ModeDecimal {
+		if r, ok := n.Rat(); ok {
+			return r.FloatString(precision)
+		}
+	}
+	scale := math.Pow10(precision)
+	return strconv.FormatFloat(math.Round(n.Float64()*scale)/scale, 'f', precision, 64)
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package calculator
+
+import "errors"
+
+// freeBytes is not implemented on this platform, so the disk space check is
+// not registered.
+func freeBytes(string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
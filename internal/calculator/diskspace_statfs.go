@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package calculator
+
+import "syscall"
+
+// freeBytes returns the space in dir available to unprivileged users.
+func freeBytes(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
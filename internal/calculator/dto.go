@@ -1,42 +1,252 @@
 package calculator
 
-type AdditionRequest struct {
-	SummandOne float64 `json:"summand_one"`
-	SummandTwo float64 `json:"summand_two"`
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OperationRequest holds the request body of a registered operation. The
+// operands are either given by their parameter names, e.g.
+// {"summand_one": 1, "summand_two": 2}, or positionally as
+// {"operands": [1, 2]}.
+type OperationRequest map[string]json.RawMessage
+
+// OperationResponse holds the result ID and the result under the
+// operation's result name, e.g. {"id": "...", "sum": 3}.
+type OperationResponse map[string]any
+
+type OperationInfo struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Symbol      string   `json:"symbol"`
+	Infix       bool     `json:"infix"`
+	Description string   `json:"description"`
+	Params      []string `json:"params"`
+	Variadic    bool     `json:"variadic"`
+	MinArity    int      `json:"min_arity,omitempty"`
+	Result      string   `json:"result"`
+	Decimal     bool     `json:"decimal"`
+}
+
+func (req OperationRequest) operands(op *Operation) ([]Number, error) {
+	if raw, ok := req["operands"]; ok {
+		var operands []Number
+		if err := json.Unmarshal(raw, &operands); err != nil {
+			return nil, fmt.Errorf("invalid operands: %w", err)
+		}
+		if err := op.checkArity(len(operands)); err != nil {
+			return nil, err
+		}
+		return operands, nil
+	}
+
+	if op.Variadic {
+		return nil, fmt.Errorf("missing operands for %s", op.Name)
+	}
+
+	operands := make([]Number, len(op.Params))
+	for i, param := range op.Params {
+		raw, ok := req[param]
+		if !ok && op.ZeroDefault {
+			operands[i] = "0"
+			continue
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing operand %q", param)
+		}
+		if err := json.Unmarshal(raw, &operands[i]); err != nil {
+			return nil, fmt.Errorf("invalid operand %q: %w", param, err)
+		}
+	}
+	return operands, nil
+}
+
+type OperationsResponse struct {
+	Operations []OperationInfo `json:"operations"`
 }
 
-type AdditionResponse struct {
-	Sum float64 `json:"sum"`
+type BatchRequest struct {
+	Items []BatchItemRequest `json:"items"`
+	// Atomic stores the results only if every item succeeded.
+	Atomic bool `json:"atomic"`
 }
 
-type SubtractionRequest struct {
-	Minuend    float64 `json:"minuend"`
-	Subtrahend float64 `json:"subtrahend"`
+type BatchItemRequest struct {
+	Operation string   `json:"op"`
+	Operands  []Number `json:"operands"`
 }
 
-type SubtractionResponse struct {
-	Difference float64 `json:"difference"`
+type BatchResponse struct {
+	Results   []BatchItemResponse `json:"results"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Stored    int                 `json:"stored"`
 }
 
-type MultiplicationRequest struct {
-	FactorOne float64 `json:"factor_one"`
-	FactorTwo float64 `json:"factor_two"`
+type BatchItemResponse struct {
+	Index      int     `json:"index"`
+	ID         string  `json:"id,omitempty"`
+	Value      *Number `json:"value,omitempty"`
+	Expression string  `json:"expression,omitempty"`
+	Error      string  `json:"error,omitempty"`
 }
 
-type MultiplicationResponse struct {
-	Product float64 `json:"product"`
+type EvaluationRequest struct {
+	Expression string `json:"expression"`
 }
 
-type DivisionRequest struct {
-	Dividend float64 `json:"dividend"`
-	Divisor  float64 `json:"divisor"`
+type EvaluationResponse struct {
+	ID         string `json:"id"`
+	Expression string `json:"expression"`
+	Result     Number `json:"result"`
 }
 
-type DivisionResponse struct {
-	Quotient float64 `json:"quotient"`
+type ResultResponse struct {
+	ID         string    `json:"id"`
+	Operator   string    `json:"operator"`
+	Operands   []Number  `json:"operands"`
+	Value      Number    `json:"value"`
+	Raw        Number    `json:"raw"`
+	Expression string    `json:"expression"`
+	Precision  int       `json:"precision"`
+	Mode       Mode      `json:"mode"`
+	Created    time.Time `json:"created"`
+}
+
+func newResultResponse(r Result) ResultResponse {
+	operands := r.Operands
+	if operands == nil {
+		operands = []Number{}
+	}
+	raw := r.Raw
+	if raw == "" {
+		raw = r.Number()
+	}
+
+	return ResultResponse{
+		ID:         r.ID,
+		Operator:   r.Operator,
+		Operands:   operands,
+		Value:      r.Number(),
+		Raw:        raw,
+		Expression: r.Expression,
+		Precision:  r.Precision,
+		Mode:       r.Mode,
+		Created:    r.Created,
+	}
+}
+
+type ClearResponse struct {
+	Deleted int `json:"deleted"`
 }
 
 type RecentResponse struct {
 	Results  []string `json:"calculations"`
 	Metadata Metadata `json:"pagination"`
 }
+
+// StructuredRecentResponse is returned by /recent?view=structured.
+type StructuredRecentResponse struct {
+	Results  []ResultResponse `json:"calculations"`
+	Metadata Metadata         `json:"pagination"`
+}
+
+// SessionRequest is a message of a client on a session WebSocket. The ID is
+// chosen by the client and returned with every message that answers it.
+type SessionRequest struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Op and Operands are used by calculate requests.
+	Op       string   `json:"op,omitempty"`
+	Operands []Number `json:"operands,omitempty"`
+	// Expression is used by evaluate requests.
+	Expression string `json:"expression,omitempty"`
+	Mode       Mode   `json:"mode,omitempty"`
+	// After resumes a subscription with the results stored after this ID.
+	After string `json:"after,omitempty"`
+	// Subscription is the ID of the subscribe request to end.
+	Subscription string `json:"subscription,omitempty"`
+}
+
+// SessionResponse is a message of the server on a session WebSocket.
+type SessionResponse struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Result *ResultResponse `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Status int             `json:"status,omitempty"`
+}
+
+type WebhookFilter struct {
+	// Operators are operation names or symbols, or "expression".
+	Operators []string `json:"operators,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+}
+
+type WebhookRequest struct {
+	URL    string        `json:"url"`
+	Secret string        `json:"secret"`
+	Filter WebhookFilter `json:"filter"`
+}
+
+// WebhookResponse describes a webhook. The secret is never returned.
+type WebhookResponse struct {
+	ID      string        `json:"id"`
+	URL     string        `json:"url"`
+	Filter  WebhookFilter `json:"filter"`
+	Created time.Time     `json:"created"`
+}
+
+func newWebhookResponse(hook Webhook) WebhookResponse {
+	return WebhookResponse{
+		ID:  hook.ID,
+		URL: hook.URL,
+		Filter: WebhookFilter{
+			Operators: hook.Filter.Operators,
+			Min:       hook.Filter.Min,
+			Max:       hook.Filter.Max,
+		},
+		Created: hook.Created,
+	}
+}
+
+type WebhooksResponse struct {
+	Webhooks []WebhookResponse `json:"webhooks"`
+}
+
+type DeliveryResponse struct {
+	ID             string         `json:"id"`
+	WebhookID      string         `json:"webhook_id"`
+	ResultID       string         `json:"result_id"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	LastError      string         `json:"last_error,omitempty"`
+	LastStatusCode int            `json:"last_status_code,omitempty"`
+	NextAttempt    *time.Time     `json:"next_attempt,omitempty"`
+	Created        time.Time      `json:"created"`
+	Updated        time.Time      `json:"updated"`
+}
+
+func newDeliveryResponse(d Delivery) DeliveryResponse {
+	resp := DeliveryResponse{
+		ID:             d.ID,
+		WebhookID:      d.WebhookID,
+		ResultID:       d.Result.ID,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastError:      d.LastError,
+		LastStatusCode: d.LastStatusCode,
+		Created:        d.Created,
+		Updated:        d.Updated,
+	}
+	if !d.NextAttempt.IsZero() {
+		resp.NextAttempt = &d.NextAttempt
+	}
+	return resp
+}
+
+type DeliveriesResponse struct {
+	Deliveries []DeliveryResponse `json:"deliveries"`
+}
@@ -0,0 +1,163 @@
+package calculator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrKeyMissing = errors.New("encryption key missing")
+	ErrInvalidKey = errors.New("invalid encryption key")
+	// ErrUnknownKey is returned for data encrypted with a key that is not in
+	// the keyring.
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrDecrypt    = errors.New("failed to decrypt, wrong key or corrupted data")
+)
+
+// Keyring holds the key new data is encrypted with and older keys that are
+// still needed to decrypt data written before a rotation.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring parses keys of the form "<id>:<base64 key>", separated by
+// commas or newlines. The first key encrypts, the others only decrypt. Keys
+// must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	for entry := range strings.FieldsFuncSeq(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%w: expected <id>:<base64 key>", ErrInvalidKey)
+		}
+		if _, exists := k.keys[id]; exists {
+			return nil, fmt.Errorf("%w: duplicate key ID %q", ErrInvalidKey, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrInvalidKey, id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrInvalidKey, id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrInvalidKey, id, err)
+		}
+
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+
+	if k.current == "" {
+		return nil, ErrKeyMissing
+	}
+	return k, nil
+}
+
+// LoadKeyring reads the keys from a file or, if file is empty, from the
+// environment variable env. Without either, encryption is disabled and
+// LoadKeyring returns nil.
+func LoadKeyring(file, env string) (*Keyring, error) {
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return ParseKeyring(string(data))
+	case env != "":
+		value, ok := os.LookupEnv(env)
+		if !ok || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("%w: environment variable %s is not set", ErrKeyMissing, env)
+		}
+		return ParseKeyring(value)
+	}
+	return nil, nil
+}
+
+// Current returns the ID of the key new data is encrypted with.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// sealed is encrypted data with the ID of its key, which is also
+// authenticated as additional data.
+type sealed struct {
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// seal encrypts data with the current key. A nil keyring returns the data
+// as it is.
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed{
+		KeyID:      k.current,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, data, []byte(k.current)),
+	})
+}
+
+// open decrypts data written by seal and returns unencrypted data as it is,
+// so plaintext stores are encrypted on their next write. It also returns the
+// ID of the key the data was encrypted with.
+func (k *Keyring) open(data []byte) ([]byte, string, error) {
+	if !isSealed(data) {
+		return data, "", nil
+	}
+
+	var s sealed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	if k == nil {
+		return nil, s.KeyID, fmt.Errorf("%w: data is encrypted with key %q", ErrKeyMissing, s.KeyID)
+	}
+	aead, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, s.KeyID, fmt.Errorf("%w %q", ErrUnknownKey, s.KeyID)
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, s.KeyID, ErrDecrypt
+	}
+
+	plaintext, err := aead.Open(nil, s.Nonce, s.Ciphertext, []byte(s.KeyID))
+	if err != nil {
+		return nil, s.KeyID, ErrDecrypt
+	}
+	return plaintext, s.KeyID, nil
+}
+
+// isSealed reports whether data was written by seal, which always starts
+// with the key ID.
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(`{"key_id":`))
+}
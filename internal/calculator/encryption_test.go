@@ -0,0 +1,164 @@
+package calculator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        string
+		wantCurrent string
+		wantErr     error
+	}{
+		{name: "single key", keys: "k1:" + testKey(1), wantCurrent: "k1"},
+		{name: "rotated keys", keys: "k2:" + testKey(2) + "\nk1:" + testKey(1) + "\n", wantCurrent: "k2"},
+		{name: "comma separated", keys: "k2:" + testKey(2) + ", k1:" + testKey(1), wantCurrent: "k2"},
+		{name: "AES-128", keys: "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), wantCurrent: "k1"},
+		{name: "empty", keys: " \n", wantErr: ErrKeyMissing},
+		{name: "missing ID", keys: testKey(1), wantErr: ErrInvalidKey},
+		{name: "invalid base64", keys: "k1:not base64", wantErr: ErrInvalidKey},
+		{name: "wrong length", keys: "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 20)), wantErr: ErrInvalidKey},
+		{name: "duplicate ID", keys: "k1:" + testKey(1) + ",k1:" + testKey(2), wantErr: ErrInvalidKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ParseKeyring(tt.keys)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseKeyring() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && keys.Current() != tt.wantCurrent {
+				t.Errorf("Current() = %q, want %q", keys.Current(), tt.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	t.Setenv("TEST_CALC_KEYS", "k1:"+testKey(1))
+	if keys, err := LoadKeyring("", "TEST_CALC_KEYS"); err != nil || keys.Current() != "k1" {
+		t.Errorf("LoadKeyring(env) = %v, %v", keys, err)
+	}
+	if _, err := LoadKeyring("", "TEST_CALC_KEYS_UNSET"); !errors.Is(err, ErrKeyMissing) {
+		t.Errorf("LoadKeyring(unset env) error = %v, want ErrKeyMissing", err)
+	}
+	if _, err := LoadKeyring(t.TempDir()+"/missing", ""); err == nil {
+		t.Error("LoadKeyring(missing file) succeeded")
+	}
+	if keys, err := LoadKeyring("", ""); keys != nil || err != nil {
+		t.Errorf("LoadKeyring() without a source = %v, %v, want no keyring", keys, err)
+	}
+}
+
+func openEncryptedStore(t *testing.T, keys string) (*JSONStore, error) {
+	t.Helper()
+	var keyring *Keyring
+	if keys != "" {
+		var err error
+		if keyring, err = ParseKeyring(keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, WALOptions{Path: testWALPath}, keyring)
+}
+
+func TestJSONStore_Encryption(t *testing.T) {
+	t.Chdir(t.TempDir())
+	k1 := "k1:" + testKey(1)
+	k2 := "k2:" + testKey(2)
+
+	store, err := openEncryptedStore(t, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "secret-a", Expression: "1234.56 + 1 = 1235.56"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, testWALPath, "k1")
+
+	// the log alone is recovered with the key
+	store, err = openEncryptedStore(t, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "secret-b"})
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "secret-c"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, testSnapshotPath, "k1")
+	assertEncrypted(t, testWALPath, "k1")
+
+	for _, tt := range []struct {
+		name    string
+		keys    string
+		wantErr error
+	}{
+		{name: "missing key", wantErr: ErrKeyMissing},
+		{name: "wrong key", keys: "k1:" + testKey(9), wantErr: ErrDecrypt},
+		{name: "unknown key", keys: k2, wantErr: ErrUnknownKey},
+	} {
+		if _, err := openEncryptedStore(t, tt.keys); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: NewJSONStore() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// rotate: k2 encrypts, k1 still decrypts what was written before
+	store, err = openEncryptedStore(t, k2+"\n"+k1)
+	if err != nil {
+		t.Fatalf("NewJSONStore() after rotation error = %v", err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEncrypted(t, testSnapshotPath, "k2")
+
+	store, err = openEncryptedStore(t, k2)
+	if err != nil {
+		t.Fatalf("NewJSONStore() without the old key error = %v", err)
+	}
+	defer store.Close()
+	if got := storedIDs(t, store); got != "secret-asecret-bsecret-c" {
+		t.Errorf("recovered %q", got)
+	}
+}
+
+func assertEncrypted(t *testing.T, path, keyID string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != filePerm {
+		t.Errorf("%s has mode %v, want %v", path, perm, os.FileMode(filePerm))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("%s contains plaintext results", path)
+	}
+	if len(data) > 0 && !strings.Contains(string(data), `"key_id":"`+keyID+`"`) {
+		t.Errorf("%s is not encrypted with key %q", path, keyID)
+	}
+}
@@ -0,0 +1,444 @@
+package calculator
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokOperator
+	tokIdent
+	tokComma
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) describe() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// tokenize splits the input into tokens. Positions are 1-based character
+// offsets into the original input.
+func tokenize(input string) ([]token, error) {
+	runes := []rune(input)
+	var tokens []token
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i + 1})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i + 1})
+			i++
+		case strings.ContainsRune("+-*/%^", r):
+			tokens = append(tokens, token{tokOperator, string(r), i + 1})
+			i++
+		case unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[start:i]), start + 1})
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			text := string(runes[start:i])
+			if err := validateNumber(text); err != nil {
+				return nil, &ParseError{Pos: start + 1, Msg: err.Error()}
+			}
+			tokens = append(tokens, token{tokNumber, text, start + 1})
+		default:
+			return nil, &ParseError{Pos: i + 1, Msg: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+
+	return append(tokens, token{tokEOF, "", len(runes) + 1}), nil
+}
+
+// Operator precedence levels, from loosest to tightest binding.
+const (
+	precAdditive = iota + 1
+	precMultiplicative
+	precUnary
+	precPower
+	precAtom
+)
+
+// infixPrecedence lists the infix operators the parser understands. The
+// operations behind them are looked up in the registry by symbol.
+var infixPrecedence = map[string]int{
+	"+": precAdditive,
+	"-": precAdditive,
+	"*": precMultiplicative,
+	"/": precMultiplicative,
+	"%": precMultiplicative,
+	"^": precPower,
+}
+
+type node interface {
+	eval() (float64, error)
+	evalDecimal() (*big.Rat, error)
+	precedence() int
+	String() string
+}
+
+type numberNode struct {
+	literal string
+	value   float64
+}
+
+func (n numberNode) eval() (float64, error) {
+	return n.value, nil
+}
+
+func (n numberNode) evalDecimal() (*big.Rat, error) {
+	r, _ := Number(n.literal).Rat()
+	return r, nil
+}
+
+func (n numberNode) precedence() int {
+	return precAtom
+}
+
+func (n numberNode) String() string {
+	return n.literal
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n unaryNode) eval() (float64, error) {
+	v, err := n.operand.eval()
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "-" {
+		return -v, nil
+	}
+	return v, nil
+}
+
+func (n unaryNode) evalDecimal() (*big.Rat, error) {
+	v, err := n.operand.evalDecimal()
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "-" {
+		return v.Neg(v), nil
+	}
+	return v, nil
+}
+
+func (n unaryNode) precedence() int {
+	return precUnary
+}
+
+func (n unaryNode) String() string {
+	// unary plus is a no-op and is dropped from the normalized form
+	if n.op == "+" {
+		return n.operand.String()
+	}
+	return n.op + wrap(n.operand, n.operand.precedence() < precUnary)
+}
+
+// opNode applies a registered operation, either written as an infix
+// operator or as a function call.
+type opNode struct {
+	op   *Operation
+	args []node
+}
+
+func (n opNode) eval() (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval()
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return n.op.evalFloat(args)
+}
+
+func (n opNode) evalDecimal() (*big.Rat, error) {
+	args := make([]*big.Rat, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.evalDecimal()
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return n.op.evalDecimal(args)
+}
+
+func (n opNode) precedence() int {
+	if p, ok := infixPrecedence[n.op.Symbol]; ok && n.op.Infix {
+		return p
+	}
+	return precAtom
+}
+
+func (n opNode) String() string {
+	p := n.precedence()
+	if p == precAtom {
+		args := make([]string, len(n.args))
+		for i, arg := range n.args {
+			args[i] = arg.String()
+		}
+		return n.op.format(args)
+	}
+
+	// operands of the same precedence keep their parentheses on the right
+	// for left-associative operators and on the left for ^
+	left, right := n.args[0], n.args[1]
+	if p == precPower {
+		return n.op.format([]string{wrap(left, left.precedence() <= p), wrap(right, right.precedence() < p)})
+	}
+	return n.op.format([]string{wrap(left, left.precedence() < p), wrap(right, right.precedence() <= p)})
+}
+
+func wrap(n node, parens bool) string {
+	if parens {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+const (
+	// MaxExpressionLength is the longest expression in bytes that is parsed.
+	MaxExpressionLength = 4096
+	// MaxExpressionDepth limits how deeply parentheses, calls, signs and
+	// powers may nest, so that parsing and evaluating cannot exhaust the
+	// stack.
+	MaxExpressionDepth = 256
+)
+
+type parser struct {
+	tokens     []token
+	pos        int
+	depth      int
+	operations *Registry
+}
+
+// parseExpression parses an arithmetic expression consisting of numbers, the
+// infix operators + - * / % ^, unary minus, parentheses and calls of the
+// other registered operations by symbol, such as max(1, 2).
+func parseExpression(input string, operations *Registry) (node, error) {
+	if len(input) > MaxExpressionLength {
+		return nil, &ParseError{Pos: MaxExpressionLength + 1, Msg: fmt.Sprintf("expression is longer than %d bytes", MaxExpressionLength)}
+	}
+
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, operations: operations}
+	if p.peek().kind == tokEOF {
+		return nil, &ParseError{Pos: p.peek().pos, Msg: "empty expression"}
+	}
+
+	n, err := p.parseBinary(precAdditive)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &ParseError{Pos: t.pos, Msg: "unexpected " + t.describe()}
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// parseBinary parses a chain of left-associative operators of the given
+// precedence level.
+func (p *parser) parseBinary(prec int) (node, error) {
+	operand := func() (node, error) {
+		if prec == precMultiplicative {
+			return p.parseUnary()
+		}
+		return p.parseBinary(prec + 1)
+	}
+
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokOperator && infixPrecedence[t.text] == prec; t = p.peek() {
+		p.next()
+		op, err := p.infix(t)
+		if err != nil {
+			return nil, err
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = opNode{op: op, args: []node{left, right}}
+	}
+	return left, nil
+}
+
+// parseUnary is entered on every level of nesting, so it enforces
+// MaxExpressionDepth.
+func (p *parser) parseUnary() (node, error) {
+	p.depth++
+	defer func() {
+		p.depth--
+	}()
+	if p.depth > MaxExpressionDepth {
+		return nil, &ParseError{Pos: p.peek().pos, Msg: fmt.Sprintf("expression is nested deeper than %d levels", MaxExpressionDepth)}
+	}
+
+	if t := p.peek(); t.kind == tokOperator && (t.text == "-" || t.text == "+") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: t.text, operand: operand}, nil
+	}
+	return p.parsePower()
+}
+
+// parsePower parses the right-associative ^ operator, which binds tighter
+// than unary minus, so -2^2 is -(2^2).
+func (p *parser) parsePower() (node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokOperator && t.text == "^" {
+		p.next()
+		op, err := p.infix(t)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return opNode{op: op, args: []node{base, exponent}}, nil
+	}
+	return base, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		v, _ := strconv.ParseFloat(t.text, 64)
+		return numberNode{literal: t.text, value: v}, nil
+	case tokIdent:
+		return p.parseCall(t)
+	case tokLParen:
+		n, err := p.parseBinary(precAdditive)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, &ParseError{Pos: closing.pos, Msg: fmt.Sprintf("expected \")\" to close \"(\" at position %d, found %s", t.pos, closing.describe())}
+		}
+		return n, nil
+	default:
+		return nil, &ParseError{Pos: t.pos, Msg: "expected number or \"(\", found " + t.describe()}
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	op, err := p.operations.Lookup(name.text)
+	if err != nil || op.Infix {
+		return nil, &ParseError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", name.text)}
+	}
+
+	if t := p.next(); t.kind != tokLParen {
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("expected \"(\" after %q, found %s", name.text, t.describe())}
+	}
+
+	var args []node
+	for {
+		arg, err := p.parseBinary(precAdditive)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		t := p.next()
+		if t.kind == tokRParen {
+			break
+		}
+		if t.kind != tokComma {
+			return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("expected \",\" or \")\" in call of %q, found %s", name.text, t.describe())}
+		}
+	}
+
+	if err := op.checkArity(len(args)); err != nil {
+		return nil, &ParseError{Pos: name.pos, Msg: err.Error()}
+	}
+	return opNode{op: op, args: args}, nil
+}
+
+func (p *parser) infix(t token) (*Operation, error) {
+	op, err := p.operations.Lookup(t.text)
+	if err != nil || !op.Infix {
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("unknown operator %q", t.text)}
+	}
+	return op, nil
+}
@@ -2,102 +2,261 @@ package calculator
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
 	"net/http"
+	"strconv"
 )
 
 type getter interface {
-	Get(p Pagination) PaginatedResult[[]Result]
+	Get(ctx context.Context, q Query) (PaginatedResult[[]Result], error)
+	// Find returns ErrNotFound if there is no result with the ID.
+	Find(ctx context.Context, id string) (Result, error)
 }
 
 type Handler struct {
-	service *Service
-	getter  getter
+	service      *Service
+	getter       getter
+	deleter      deleter
+	mode         Mode
+	maxBatchSize int
 }
 
-func NewHandler(service *Service, getter getter) *Handler {
+func NewHandler(service *Service, getter getter, deleter deleter, mode Mode, maxBatchSize int) *Handler {
 	return &Handler{
 		service,
 		getter,
+		deleter,
+		mode,
+		maxBatchSize,
 	}
 }
 
-func (h *Handler) Addition(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	req := &AdditionRequest{}
-	if err := web.Decode(r, req); err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
-	}
+// Operation returns the handler for a registered operation. Operands are
+// validated against the operation's parameters and arity.
+func (h *Handler) Operation(op *Operation) web.Handler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		ctx, span := web.StartSpan(ctx, "Handler.Operation", slog.String("operation", op.Name))
+		defer span.End()
 
-	result, err := h.service.Add(req.SummandOne, req.SummandTwo)
-	if err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+		req := OperationRequest{}
+		if err := web.Decode(r, &req); err != nil {
+			return err
+		}
+
+		operands, err := req.operands(op)
+		if err != nil {
+			return web.NewError(http.StatusBadRequest, err.Error())
+		}
+
+		mode, err := h.parseMode(r)
+		if err != nil {
+			return err
+		}
+
+		result, err := h.service.Calculate(ctx, mode, op.Name, operands...)
+		if err != nil {
+			return serviceError(err)
+		}
+
+		resp := OperationResponse{
+			"id":      result.ID,
+			op.Result: result.Number(),
+		}
+		return web.Respond(ctx, w, resp, http.StatusOK)
 	}
+}
+
+func (h *Handler) Operations(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.Operations")
+	defer span.End()
+
+	ops := h.service.Operations().Operations()
 
-	resp := &AdditionResponse{
-		Sum: result.Value,
+	resp := OperationsResponse{
+		Operations: make([]OperationInfo, len(ops)),
 	}
+	for i, op := range ops {
+		params := op.Params
+		if op.Variadic {
+			params = []string{"operands"}
+		}
+		resp.Operations[i] = OperationInfo{
+			Name:        op.Name,
+			Path:        "/" + op.Name,
+			Symbol:      op.Symbol,
+			Infix:       op.Infix,
+			Description: op.Description,
+			Params:      params,
+			Variadic:    op.Variadic,
+			MinArity:    op.MinArity,
+			Result:      op.Result,
+			Decimal:     op.Decimal != nil,
+		}
+	}
+
 	return web.Respond(ctx, w, resp, http.StatusOK)
 }
 
-func (h *Handler) Subtraction(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	req := &SubtractionRequest{}
+func (h *Handler) Batch(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.Batch")
+	defer span.End()
+
+	req := &BatchRequest{}
 	if err := web.Decode(r, req); err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
-	result, err := h.service.Sub(req.Minuend, req.Subtrahend)
-	if err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+	if len(req.Items) == 0 {
+		return web.NewError(http.StatusBadRequest, "batch must contain at least one item")
+	}
+	if len(req.Items) > h.maxBatchSize {
+		return web.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("batch of %d items exceeds the maximum of %d", len(req.Items), h.maxBatchSize))
 	}
 
-	resp := &SubtractionResponse{
-		Difference: result.Value,
+	mode, err := h.parseMode(r)
+	if err != nil {
+		return err
 	}
-	return web.Respond(ctx, w, resp, http.StatusOK)
-}
 
-func (h *Handler) Multiplication(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	req := &MultiplicationRequest{}
-	if err := web.Decode(r, req); err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+	items := make([]BatchItem, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = BatchItem{Operation: item.Operation, Operands: item.Operands}
 	}
 
-	result, err := h.service.Mul(req.FactorOne, req.FactorTwo)
+	results, stored, err := h.service.CalculateBatch(ctx, mode, items, req.Atomic)
 	if err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+		return serviceError(err)
 	}
 
-	resp := &MultiplicationResponse{
-		Product: result.Value,
+	resp := BatchResponse{
+		Results: make([]BatchItemResponse, len(results)),
+		Stored:  stored,
+	}
+	for i, result := range results {
+		item := BatchItemResponse{Index: i}
+		if result.Err != nil {
+			item.Error = result.Err.Error()
+			resp.Failed++
+		} else {
+			value := result.Result.Number()
+			item.ID = result.Result.ID
+			item.Value = &value
+			item.Expression = result.Result.Expression
+			resp.Succeeded++
+		}
+		resp.Results[i] = item
 	}
+
 	return web.Respond(ctx, w, resp, http.StatusOK)
 }
 
-func (h *Handler) Division(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	req := &DivisionRequest{}
+func (h *Handler) Evaluate(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.Evaluate")
+	defer span.End()
+
+	req := &EvaluationRequest{}
 	if err := web.Decode(r, req); err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
-	result, err := h.service.Div(req.Dividend, req.Divisor)
+	mode, err := h.parseMode(r)
 	if err != nil {
-		return web.NewError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
-	resp := &DivisionResponse{
-		Quotient: result.Value,
+	result, err := h.service.Evaluate(ctx, mode, req.Expression)
+	if err != nil {
+		return serviceError(err)
+	}
+
+	resp := &EvaluationResponse{
+		ID:         result.ID,
+		Expression: result.Expression,
+		Result:     result.Number(),
 	}
 	return web.Respond(ctx, w, resp, http.StatusOK)
 }
 
+const (
+	ViewExpressions = "expressions"
+	ViewStructured  = "structured"
+)
+
+// MaxRenderPrecision is the largest precision results can be re-rendered at.
+const MaxRenderPrecision = 20
+
+// GetRecent returns the most recent results, optionally filtered by
+// operator, creation time, value and expression text and sorted by time or
+// value. Pages are selected with page and page_size, or with limit and the
+// after and before cursors of a previous response, which stay stable while
+// new results are stored. By default only the expressions are returned;
+// view=structured returns the full records. With precision=N the results
+// are re-rendered at that precision.
 func (h *Handler) GetRecent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	pagination := parsePagination(r)
+	ctx, span := web.StartSpan(ctx, "Handler.GetRecent")
+	defer span.End()
 
-	results := h.getter.Get(pagination)
+	q, err := parseQuery(r, h.service.Operations())
+	if err != nil {
+		return web.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	query := r.URL.Query()
+	view := query.Get("view")
+	if view != "" && view != ViewExpressions && view != ViewStructured {
+		return web.NewError(http.StatusBadRequest, fmt.Sprintf("unknown view %q (expected %q or %q)", view, ViewExpressions, ViewStructured))
+	}
+
+	precision := -1
+	if query.Has("precision") {
+		p, err := strconv.Atoi(query.Get("precision"))
+		if err != nil || p < 0 || p > MaxRenderPrecision {
+			return web.NewError(http.StatusBadRequest, fmt.Sprintf("precision must be an integer between 0 and %d", MaxRenderPrecision))
+		}
+		precision = p
+	}
+
+	results, err := h.getter.Get(ctx, q)
+	if errors.Is(err, ErrSnapshotExpired) || errors.Is(err, ErrInvalidSnapshot) {
+		return web.NewError(http.StatusGone, err.Error()+", start again without snapshot")
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	if links := cursorLinks(r, results.Metadata); links != "" {
+		w.Header().Set("Link", links)
+	}
+
+	if view == ViewStructured {
+		records := make([]ResultResponse, len(results.Result))
+		for i, result := range results.Result {
+			records[i] = newResultResponse(result)
+			if precision >= 0 {
+				if expr, ok := h.render(result, precision); ok {
+					records[i].Expression = expr
+					records[i].Value = Number(roundNumber(result.Mode, records[i].Raw, precision))
+					records[i].Precision = precision
+				}
+			}
+		}
+
+		return web.Respond(ctx, w, StructuredRecentResponse{
+			Results:  records,
+			Metadata: results.Metadata,
+		}, http.StatusOK)
+	}
 
 	expressions := make([]string, len(results.Result))
 	for i, result := range results.Result {
 		expressions[i] = result.Expression
+		if precision >= 0 {
+			if expr, ok := h.render(result, precision); ok {
+				expressions[i] = expr
+			}
+		}
 	}
 
 	resp := RecentResponse{
@@ -107,3 +266,102 @@ func (h *Handler) GetRecent(ctx context.Context, w http.ResponseWriter, r *http.
 
 	return web.Respond(ctx, w, resp, http.StatusOK)
 }
+
+// render re-renders a result at the given precision. It reports false for
+// results that lack the structure to do so, e.g. those of an operation that
+// is no longer registered.
+func (h *Handler) render(result Result, precision int) (string, bool) {
+	expr, err := result.Render(h.service.Operations(), precision)
+	if err != nil {
+		return "", false
+	}
+	return expr, true
+}
+
+func (h *Handler) GetResult(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.GetResult")
+	defer span.End()
+
+	id := r.PathValue("id")
+
+	result, err := h.getter.Find(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return web.NewError(http.StatusNotFound, fmt.Sprintf("result %q not found", id))
+	}
+	if err != nil {
+		return storageError(err)
+	}
+
+	return web.Respond(ctx, w, newResultResponse(result), http.StatusOK)
+}
+
+func (h *Handler) DeleteResult(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.DeleteResult")
+	defer span.End()
+
+	id := r.PathValue("id")
+
+	err := h.deleter.Delete(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return web.NewError(http.StatusNotFound, fmt.Sprintf("result %q not found", id))
+	}
+	if err != nil {
+		return storageError(err)
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ClearRecent deletes the whole history. As a guard against accidental
+// requests it requires confirm=true.
+func (h *Handler) ClearRecent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := web.StartSpan(ctx, "Handler.ClearRecent")
+	defer span.End()
+
+	if r.URL.Query().Get("confirm") != "true" {
+		return web.NewError(http.StatusBadRequest, "clearing the history requires confirm=true")
+	}
+
+	deleted, err := h.deleter.Clear(ctx)
+	if err != nil {
+		return storageError(err)
+	}
+
+	resp := ClearResponse{
+		Deleted: deleted,
+	}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// parseMode returns the calculation mode requested with the mode query
+// parameter, falling back to the server default.
+func (h *Handler) parseMode(r *http.Request) (Mode, error) {
+	value := r.URL.Query().Get("mode")
+	if value == "" {
+		return h.mode, nil
+	}
+
+	mode, err := ParseMode(value)
+	if err != nil {
+		return "", web.NewError(http.StatusBadRequest, err.Error())
+	}
+	return mode, nil
+}
+
+// serviceError maps errors of the service to responses. Storage failures are
+// server errors, everything else was caused by the request.
+func serviceError(err error) error {
+	if errors.Is(err, ErrStorage) {
+		return storageError(err)
+	}
+	return web.NewError(http.StatusBadRequest, err.Error())
+}
+
+// storageError maps store errors to 503 if retrying later can help and to 500
+// otherwise. The details are only logged.
+func storageError(err error) error {
+	if errors.Is(err, ErrStoreUnavailable) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return web.WrapError(http.StatusServiceUnavailable, "storage is temporarily unavailable", err)
+	}
+	return web.WrapError(http.StatusInternalServerError, "storage failure", err)
+}
@@ -0,0 +1,99 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"os"
+	"time"
+)
+
+// DefaultMinFreeBytes is the free disk space below which the store is not
+// ready.
+const DefaultMinFreeBytes = 64 << 20
+
+type HealthOptions struct {
+	// Timeout of every check; 0 means web.DefaultCheckTimeout.
+	Timeout time.Duration
+	// MaxSaveAge is how old the last successful snapshot may be. 0 only
+	// fails if the last snapshot failed, which suits stores that are only
+	// saved on shutdown.
+	MaxSaveAge time.Duration
+	// MinFreeBytes defaults to DefaultMinFreeBytes.
+	MinFreeBytes uint64
+}
+
+// RegisterHealthChecks registers the checks that apply to the store: whether
+// its directory is writable and has free space, and whether its snapshots are
+// written. In-memory stores have nothing to check.
+func RegisterHealthChecks(health *web.Health, store Store, opts HealthOptions) {
+	if opts.MinFreeBytes == 0 {
+		opts.MinFreeBytes = DefaultMinFreeBytes
+	}
+
+	if d, ok := store.(interface{ DataDir() string }); ok {
+		dir := d.DataDir()
+		health.Register("store.writable", opts.Timeout, func(context.Context) error {
+			return checkWritable(dir)
+		})
+		if _, err := freeBytes(dir); !errors.Is(err, errors.ErrUnsupported) {
+			health.Register("store.disk_space", opts.Timeout, func(context.Context) error {
+				return checkDiskSpace(dir, opts.MinFreeBytes)
+			})
+		}
+	}
+
+	if s, ok := store.(interface{ SaveStats() SaveStats }); ok {
+		opened := time.Now()
+		health.Register("store.last_save", opts.Timeout, func(context.Context) error {
+			return checkLastSave(s.SaveStats(), opened, opts.MaxSaveAge)
+		})
+	}
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return fmt.Errorf("store directory is not writable: %w", err)
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	err = errors.Join(err, f.Close(), os.Remove(name))
+	if err != nil {
+		return fmt.Errorf("store directory is not writable: %w", err)
+	}
+	return nil
+}
+
+func checkDiskSpace(dir string, required uint64) error {
+	free, err := freeBytes(dir)
+	if err != nil {
+		return err
+	}
+	if free < required {
+		return fmt.Errorf("%d bytes free, need at least %d", free, required)
+	}
+	return nil
+}
+
+// checkLastSave fails if the last snapshot failed or, with a maximum age, if
+// there has been no successful one for longer. Before the first snapshot the
+// age counts from opened.
+func checkLastSave(stats SaveStats, opened time.Time, maxAge time.Duration) error {
+	if stats.LastError != nil {
+		return fmt.Errorf("last save failed: %w", stats.LastError)
+	}
+	if maxAge <= 0 {
+		return nil
+	}
+	last := stats.LastSave
+	if last.IsZero() {
+		last = opened
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("last successful save was %s ago, more than %s", age.Round(time.Second), maxAge)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterHealthChecks(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	store, err := NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, WALOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	health := web.NewHealth()
+	RegisterHealthChecks(health, store, HealthOptions{})
+	for _, result := range health.Run(context.Background()) {
+		if result.Status != "ok" {
+			t.Errorf("check %s = %+v, want ok", result.Name, result)
+		}
+	}
+
+	// a directory in place of the storage file makes saving fail
+	if err := os.Mkdir(testSnapshotPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err == nil {
+		t.Fatal("Save() succeeded")
+	}
+
+	failed := map[string]string{}
+	for _, result := range health.Run(context.Background()) {
+		if result.Status != "ok" {
+			failed[result.Name] = result.Error
+		}
+	}
+	if !strings.HasPrefix(failed["store.last_save"], "last save failed") || len(failed) != 1 {
+		t.Errorf("failed checks = %v, want only store.last_save", failed)
+	}
+
+	memory := web.NewHealth()
+	RegisterHealthChecks(memory, NewResultStore(), HealthOptions{})
+	if results := memory.Run(context.Background()); len(results) != 0 {
+		t.Errorf("in-memory store registered checks %+v", results)
+	}
+}
+
+func TestCheckLastSave(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		stats   SaveStats
+		opened  time.Time
+		maxAge  time.Duration
+		wantErr bool
+	}{
+		{name: "never saved", opened: now},
+		{name: "never saved for too long", opened: now.Add(-time.Hour), maxAge: time.Minute, wantErr: true},
+		{name: "recent save", stats: SaveStats{LastSave: now.Add(-time.Second)}, opened: now.Add(-time.Hour), maxAge: time.Minute},
+		{name: "old save", stats: SaveStats{LastSave: now.Add(-time.Hour)}, opened: now.Add(-time.Hour), maxAge: time.Minute, wantErr: true},
+		{name: "old save without maximum age", stats: SaveStats{LastSave: now.Add(-time.Hour)}, opened: now.Add(-time.Hour)},
+		{name: "failed save", stats: SaveStats{LastSave: now, LastError: errors.New("disk full")}, opened: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLastSave(tt.stats, tt.opened, tt.maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLastSave() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeBytes(dir); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free disk space is not supported on this platform")
+	}
+
+	if err := checkDiskSpace(dir, 1); err != nil {
+		t.Errorf("checkDiskSpace(1 byte) error = %v", err)
+	}
+	if err := checkDiskSpace(dir, 1<<62); err == nil {
+		t.Error("checkDiskSpace(4 EiB) succeeded")
+	}
+	if err := checkWritable(dir + "/missing"); err == nil {
+		t.Error("checkWritable() of a missing directory succeeded")
+	}
+}
@@ -0,0 +1,189 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSlowConsumer ends subscriptions that did not keep up with the
+	// published results.
+	ErrSlowConsumer = errors.New("subscriber too slow")
+	ErrHubClosed    = errors.New("hub closed")
+)
+
+// Hub passes newly stored results to subscribers. Publishing never blocks:
+// a subscriber whose buffer is full is dropped instead of holding up the
+// store.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	done   chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: map[*Subscription]struct{}{},
+		done: make(chan struct{}),
+	}
+}
+
+type Subscription struct {
+	hub *Hub
+	c   chan Result
+	// err is set before c is closed.
+	err error
+}
+
+// Subscribe returns a subscription that buffers up to buffer results.
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &Subscription{hub: h, c: make(chan Result, buffer)}
+	if h.closed {
+		sub.err = ErrHubClosed
+		close(sub.c)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// Results is closed when the subscription ends, see Err.
+func (s *Subscription) Results() <-chan Result {
+	return s.c
+}
+
+// Err returns why the subscription ended: ErrSlowConsumer, ErrHubClosed or
+// nil after Close.
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.end(s, nil)
+}
+
+// end removes the subscription. The caller must hold the lock.
+func (h *Hub) end(sub *Subscription, err error) {
+	if _, ok := h.subs[sub]; !ok {
+		return
+	}
+	delete(h.subs, sub)
+	sub.err = err
+	close(sub.c)
+}
+
+func (h *Hub) Publish(results ...Result) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		h.send(sub, results)
+	}
+}
+
+// send drops the subscriber if its buffer cannot take all results. The
+// caller must hold the lock.
+func (h *Hub) send(sub *Subscription, results []Result) {
+	for _, r := range results {
+		select {
+		case sub.c <- r:
+		default:
+			h.end(sub, ErrSlowConsumer)
+			return
+		}
+	}
+}
+
+// Close ends all subscriptions with ErrHubClosed, e.g. on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	for sub := range h.subs {
+		h.end(sub, ErrHubClosed)
+	}
+}
+
+// Done is closed when the hub is closed.
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// publishingStore publishes results to a hub once they are stored.
+type publishingStore struct {
+	store Store
+	hub   *Hub
+}
+
+// NewPublishingStore returns a store that publishes every stored result to
+// hub.
+func NewPublishingStore(store Store, hub *Hub) Store {
+	return publishingStore{store, hub}
+}
+
+func (s publishingStore) Store(ctx context.Context, result Result) error {
+	if err := s.store.Store(ctx, result); err != nil {
+		return err
+	}
+	s.hub.Publish(result)
+	return nil
+}
+
+func (s publishingStore) StoreMany(ctx context.Context, results []Result) error {
+	if bs, ok := s.store.(batchStorer); ok {
+		if err := bs.StoreMany(ctx, results); err != nil {
+			return err
+		}
+		s.hub.Publish(results...)
+		return nil
+	}
+
+	for _, r := range results {
+		if err := s.Store(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s publishingStore) Get(ctx context.Context, q Query) (PaginatedResult[[]Result], error) {
+	return s.store.Get(ctx, q)
+}
+
+func (s publishingStore) Find(ctx context.Context, id string) (Result, error) {
+	return s.store.Find(ctx, id)
+}
+
+func (s publishingStore) readAfter(ctx context.Context, after string, limit int) ([]Result, error) {
+	if r, ok := s.store.(afterReader); ok {
+		return r.readAfter(ctx, after, limit)
+	}
+	return nil, errors.ErrUnsupported
+}
+
+func (s publishingStore) Delete(ctx context.Context, id string) error {
+	return s.store.Delete(ctx, id)
+}
+
+func (s publishingStore) Clear(ctx context.Context) (int, error) {
+	return s.store.Clear(ctx)
+}
+
+func (s publishingStore) Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	return s.store.Evict(ctx, policy, now)
+}
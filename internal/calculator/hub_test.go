@@ -0,0 +1,169 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	fast := hub.Subscribe(3)
+	slow := hub.Subscribe(1)
+	closed := hub.Subscribe(1)
+	closed.Close()
+
+	hub.Publish(Result{ID: "a"}, Result{ID: "b"})
+
+	for _, want := range []string{"a", "b"} {
+		if got := <-fast.Results(); got.ID != want {
+			t.Errorf("fast subscriber got %q, want %q", got.ID, want)
+		}
+	}
+
+	// the slow subscriber took "a" and was dropped for "b"
+	if got := <-slow.Results(); got.ID != "a" {
+		t.Errorf("slow subscriber got %q, want %q", got.ID, "a")
+	}
+	if _, ok := <-slow.Results(); ok {
+		t.Error("slow subscriber was not dropped")
+	}
+	if err := slow.Err(); !errors.Is(err, ErrSlowConsumer) {
+		t.Errorf("slow subscriber Err() = %v, want ErrSlowConsumer", err)
+	}
+
+	if _, ok := <-closed.Results(); ok || closed.Err() != nil {
+		t.Errorf("closed subscriber got a result or error %v", closed.Err())
+	}
+
+	select {
+	case <-hub.Done():
+		t.Error("Done() closed before Close()")
+	default:
+	}
+	hub.Close()
+	hub.Close()
+	<-hub.Done()
+	if _, ok := <-fast.Results(); ok || !errors.Is(fast.Err(), ErrHubClosed) {
+		t.Errorf("after Close() Err() = %v, want ErrHubClosed", fast.Err())
+	}
+	if late := hub.Subscribe(1); !errors.Is(late.Err(), ErrHubClosed) {
+		t.Errorf("Subscribe() after Close() Err() = %v, want ErrHubClosed", late.Err())
+	}
+}
+
+func TestPublishingStore(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe(10)
+	store := NewPublishingStore(NewResultStore(), hub)
+
+	mustStore(t, store, Result{ID: "a"})
+	if err := store.(batchStorer).StoreMany(t.Context(), []Result{{ID: "b"}, {ID: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := store.Store(ctx, Result{ID: "d"}); err == nil {
+		t.Fatal("Store() with a canceled context succeeded")
+	}
+
+	hub.Close()
+	var ids string
+	for r := range sub.Results() {
+		ids += r.ID
+	}
+	if ids != "abc" {
+		t.Errorf("published %q, want only the stored results %q", ids, "abc")
+	}
+}
+
+func TestReplayPage(t *testing.T) {
+	segments := openSegmentTestStore(t, t.TempDir(), SegmentOptions{SegmentSize: 4096})
+	defer segments.Close()
+
+	stores := []struct {
+		name  string
+		store Store
+	}{
+		{"memory", NewResultStore()},
+		{"segments", segments},
+		{"publishing", NewPublishingStore(NewResultStore(), NewHub())},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []string
+			for i := range 3 * replayPageSize {
+				id := fmt.Sprintf("%05d", i)
+				mustStore(t, tt.store, Result{ID: id, Expression: "1 + 2 = 3"})
+				want = append(want, id)
+			}
+			for i := 1; i < len(want); i += 7 {
+				if err := tt.store.Delete(t.Context(), want[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want = slices.DeleteFunc(want, func(id string) bool {
+				i, _ := strconv.Atoi(id)
+				return i%7 == 1
+			})
+
+			var got []string
+			cursor := want[0]
+			for {
+				page, err := replayPage(t.Context(), tt.store, cursor)
+				if err != nil {
+					t.Fatalf("replayPage(%s) error = %v", cursor, err)
+				}
+				if len(page) > replayPageSize {
+					t.Fatalf("replayPage(%s) returned %d results", cursor, len(page))
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, r := range page {
+					got = append(got, r.ID)
+				}
+				cursor = page[len(page)-1].ID
+			}
+			if !slices.Equal(got, want[1:]) {
+				t.Fatalf("replayed %d results, want %d in the order they were stored", len(got), len(want)-1)
+			}
+
+			// the result to resume after was deleted
+			page, err := replayPage(t.Context(), tt.store, want[0][:4]+"1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 || page[0].ID != want[1] {
+				t.Fatalf("replayPage() after a deleted result starts with %v, want %s", page[:min(len(page), 1)], want[1])
+			}
+		})
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for i := range streamBuffer + 10 {
+		w.add(strconv.Itoa(i))
+	}
+	if got := len(w.ids); got != streamBuffer {
+		t.Fatalf("window holds %d IDs, want %d", got, streamBuffer)
+	}
+	if w.seen("0") {
+		t.Error("the oldest replayed ID is still in the window")
+	}
+	if !w.seen("10") || w.seen("10") {
+		t.Error("a replayed ID was not seen exactly once")
+	}
+
+	for i := range streamBuffer {
+		w.seen("live" + strconv.Itoa(i))
+	}
+	if w.ids != nil || w.seen(strconv.Itoa(streamBuffer)) {
+		t.Error("the window was not dropped after a full buffer of live results")
+	}
+}
@@ -0,0 +1,88 @@
+package calculator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ids generates UUIDv7 identifiers (RFC 9562). The 12 bits after the
+// millisecond timestamp are used as a counter, so IDs generated by this
+// process sort in generation order even within the same millisecond.
+var ids idGenerator
+
+type idGenerator struct {
+	mu     sync.Mutex
+	lastMs int64
+	seq    uint16
+}
+
+func newID() string {
+	return ids.next(time.Now())
+}
+
+func (g *idGenerator) next(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := t.UnixMilli()
+	if ms > g.lastMs {
+		g.lastMs = ms
+		// start low in the counter space to leave room for increments
+		g.seq = randomSeq() & 0x7ff
+	} else {
+		g.seq++
+		if g.seq > 0xfff {
+			g.lastMs++
+			g.seq = randomSeq() & 0x7ff
+		}
+	}
+
+	return formatUUIDv7(g.lastMs, g.seq)
+}
+
+// idAt returns an ID for a result created at t. It is used for results that
+// were stored before IDs existed and is not monotonic.
+func idAt(t time.Time) string {
+	return formatUUIDv7(t.UnixMilli(), randomSeq()&0xfff)
+}
+
+func randomSeq() uint16 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func formatUUIDv7(ms int64, seq uint16) string {
+	var u [16]byte
+
+	// 48 bit big-endian millisecond timestamp
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	u[2] = byte(ms >> 24)
+	u[3] = byte(ms >> 16)
+	u[4] = byte(ms >> 8)
+	u[5] = byte(ms)
+
+	// version 7 and the 12 bit counter
+	u[6] = 0x70 | byte(seq>>8)&0x0f
+	u[7] = byte(seq)
+
+	// variant 10 and 62 random bits
+	_, _ = rand.Read(u[8:])
+	u[8] = u[8]&0x3f | 0x80
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
@@ -0,0 +1,74 @@
+package calculator
+
+import (
+	"errors"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+)
+
+// Metrics counts calculations and their domain errors. A nil *Metrics counts
+// nothing.
+type Metrics struct {
+	calculations *web.Counter
+	errors       *web.Counter
+}
+
+// domainErrors are counted by calculator_errors_total with their label.
+var domainErrors = []struct {
+	err   error
+	label string
+}{
+	{ErrDivByZero, "division_by_zero"},
+	{ErrOverflow, "overflow"},
+	{ErrNaN, "nan"},
+}
+
+// NewMetrics registers the series of the calculator in reg, including the
+// size of the store and, for stores that write snapshots, their saves.
+func NewMetrics(reg *web.Registry, store Store) *Metrics {
+	m := &Metrics{
+		calculations: reg.Counter("calculator_calculations_total", "Calculations by operation and mode, including failed ones.", "operation", "mode"),
+		errors:       reg.Counter("calculator_errors_total", "Calculations that failed with a domain error.", "operation", "error"),
+	}
+
+	if sizer, ok := store.(interface{ Len() int }); ok {
+		reg.GaugeFunc("calculator_store_results", "Number of stored results.", func() float64 {
+			return float64(sizer.Len())
+		})
+	}
+	if saver, ok := store.(interface{ SaveStats() SaveStats }); ok {
+		reg.CounterFunc("calculator_store_saves_total", "Snapshots written to disk.", func() float64 {
+			return float64(saver.SaveStats().Saves)
+		})
+		reg.CounterFunc("calculator_store_save_failures_total", "Snapshots that could not be written.", func() float64 {
+			return float64(saver.SaveStats().Failures)
+		})
+		reg.GaugeFunc("calculator_store_last_save_duration_seconds", "Time it took to write the last snapshot.", func() float64 {
+			return saver.SaveStats().LastDuration.Seconds()
+		})
+		reg.GaugeFunc("calculator_store_last_save_timestamp_seconds", "Unix time of the last snapshot, 0 if none was written yet.", func() float64 {
+			last := saver.SaveStats().LastSave
+			if last.IsZero() {
+				return 0
+			}
+			return float64(last.UnixNano()) / 1e9
+		})
+	}
+
+	return m
+}
+
+func (m *Metrics) calculated(operation string, mode Mode, err error) {
+	if m == nil {
+		return
+	}
+	if mode == "" {
+		mode = ModeFloat
+	}
+	m.calculations.Inc(operation, string(mode))
+	for _, d := range domainErrors {
+		if errors.Is(err, d.err) {
+			m.errors.Inc(operation, d.label)
+			return
+		}
+	}
+}
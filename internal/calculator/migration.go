@@ -0,0 +1,168 @@
+package calculator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// FormatVersion is the version of the storage file written by this build.
+// Every change to the persisted form of Result needs a new version and a
+// migration from the previous one.
+const FormatVersion = 1
+
+var (
+	// ErrFormatTooNew is returned for storage files written by a newer
+	// version, which this build could only load by dropping data.
+	ErrFormatTooNew     = errors.New("storage file was written by a newer version")
+	ErrInvalidStoreFile = errors.New("invalid storage file")
+)
+
+// storageFile is the envelope of the persisted results. Results are ordered
+// newest first.
+type storageFile struct {
+	Version int      `json:"version"`
+	Results []Result `json:"results"`
+}
+
+// migration upgrades the content of a storage file by one version and
+// describes what it changed.
+type migration func(data []byte) ([]byte, []string, error)
+
+// migrations[v] upgrades a file of version v to version v+1.
+var migrations = [FormatVersion]migration{
+	migrateV0,
+}
+
+type MigrationReport struct {
+	Path string
+	From int
+	To   int
+	// Changes describes the changes of every applied migration.
+	Changes []string
+	// Backup is the copy of the original file, empty for dry runs and files
+	// that were already up to date.
+	Backup string
+	// KeyID is the key the file is encrypted with, empty for plaintext files.
+	KeyID string
+}
+
+func (r MigrationReport) Migrated() bool {
+	return r.From != r.To
+}
+
+// MigrateFile upgrades the storage file at path to FormatVersion. The
+// original file is kept next to it as "<path>.v<version>.bak" before the
+// upgraded file replaces it. A dry run only reports the changes. Encrypted
+// files need the keyring and stay encrypted.
+func MigrateFile(path string, dryRun bool, keys *Keyring) (MigrationReport, error) {
+	_, report, err := migrateFile(path, dryRun, keys)
+	return report, err
+}
+
+// migrateFile is MigrateFile returning the upgraded, decrypted content as
+// well.
+func migrateFile(path string, dryRun bool, keys *Keyring) ([]byte, MigrationReport, error) {
+	report := MigrationReport{Path: path, To: FormatVersion}
+
+	original, err := os.ReadFile(path)
+	if err != nil {
+		return nil, report, err
+	}
+	data, keyID, err := keys.open(original)
+	if err != nil {
+		return nil, report, err
+	}
+	report.KeyID = keyID
+
+	report.From, err = formatVersion(data)
+	if err != nil {
+		return nil, report, err
+	}
+	if report.From > FormatVersion {
+		return nil, report, fmt.Errorf("%w: version %d, this build supports up to %d", ErrFormatTooNew, report.From, FormatVersion)
+	}
+
+	migrated := data
+	for v := report.From; v < FormatVersion; v++ {
+		var changes []string
+		migrated, changes, err = migrations[v](migrated)
+		if err != nil {
+			return nil, report, fmt.Errorf("failed to migrate from version %d: %w", v, err)
+		}
+		for _, change := range changes {
+			report.Changes = append(report.Changes, fmt.Sprintf("v%d to v%d: %s", v, v+1, change))
+		}
+	}
+
+	if dryRun || !report.Migrated() {
+		return migrated, report, nil
+	}
+
+	report.Backup = fmt.Sprintf("%s.v%d.bak", path, report.From)
+	if err := writeFileAtomic(report.Backup, original, filePerm); err != nil {
+		return nil, report, fmt.Errorf("failed to write backup: %w", err)
+	}
+	encrypted, err := keys.seal(migrated)
+	if err != nil {
+		return nil, report, fmt.Errorf("failed to encrypt migrated file: %w", err)
+	}
+	if err := writeFileAtomic(path, encrypted, filePerm); err != nil {
+		return nil, report, fmt.Errorf("failed to write migrated file: %w", err)
+	}
+	return migrated, report, nil
+}
+
+// formatVersion returns the version of a storage file. Files without an
+// envelope are a bare array of results and have version 0.
+func formatVersion(data []byte) (int, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return 0, nil
+	}
+
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrInvalidStoreFile, err)
+	}
+	if header.Version == nil || *header.Version < 1 {
+		return 0, fmt.Errorf("%w: missing version", ErrInvalidStoreFile)
+	}
+	return *header.Version, nil
+}
+
+// migrateV0 wraps the bare array in an envelope, assigns IDs to results
+// stored before results had IDs and restores the structure of results stored
+// before they kept their operator, operands and precision.
+func migrateV0(data []byte) ([]byte, []string, error) {
+	var results []Result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidStoreFile, err)
+	}
+
+	ids, upgraded := 0, 0
+	for i := range results {
+		if results[i].ID == "" {
+			results[i].ID = idAt(results[i].Created)
+			ids++
+		}
+		legacy := results[i].Operator == ""
+		upgradeLegacy(&results[i])
+		if legacy && results[i].Operator != "" {
+			upgraded++
+		}
+	}
+
+	migrated, err := json.Marshal(storageFile{Version: 1, Results: results})
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, []string{
+		fmt.Sprintf("wrapped %d results in a versioned envelope", len(results)),
+		fmt.Sprintf("assigned IDs to %d results", ids),
+		fmt.Sprintf("restored operator, operands and precision of %d results", upgraded),
+	}, nil
+}
@@ -0,0 +1,84 @@
+package calculator
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestMigrateFile(t *testing.T) {
+	legacy := `[{"Value":3,"Expression":"1.0000 + 2.0000 = 3.0000","Created":"2025-01-01T10:00:00Z"}]`
+	current := `{"version":1,"results":[{"ID":"a","Operator":"addition","Mode":"float"}]}`
+
+	tests := []struct {
+		name       string
+		content    string
+		dryRun     bool
+		wantFrom   int
+		wantBackup bool
+		wantErr    error
+	}{
+		{name: "legacy", content: legacy, wantFrom: 0, wantBackup: true},
+		{name: "legacy dry run", content: legacy, dryRun: true, wantFrom: 0},
+		{name: "current", content: current, wantFrom: 1},
+		{name: "newer", content: `{"version":2,"results":[]}`, wantFrom: 2, wantErr: ErrFormatTooNew},
+		{name: "missing version", content: `{"results":[]}`, wantErr: ErrInvalidStoreFile},
+		{name: "garbage", content: `{`, wantErr: ErrInvalidStoreFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile(testSnapshotPath, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := MigrateFile(testSnapshotPath, tt.dryRun, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MigrateFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				// the store refuses the file as well and leaves it alone
+				if _, err := NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, WALOptions{}, nil); !errors.Is(err, tt.wantErr) {
+					t.Errorf("NewJSONStore() error = %v, want %v", err, tt.wantErr)
+				}
+				if data, _ := os.ReadFile(testSnapshotPath); string(data) != tt.content {
+					t.Errorf("refused file was changed to %s", data)
+				}
+				return
+			}
+			if report.From != tt.wantFrom || report.To != FormatVersion {
+				t.Errorf("MigrateFile() migrated from %d to %d, want %d to %d", report.From, report.To, tt.wantFrom, FormatVersion)
+			}
+			if report.Migrated() != (len(report.Changes) > 0) {
+				t.Errorf("MigrateFile() reported changes %q", report.Changes)
+			}
+
+			data, err := os.ReadFile(testSnapshotPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.dryRun && string(data) != tt.content {
+				t.Errorf("dry run changed the file to %s", data)
+			}
+			if version, err := formatVersion(data); !tt.dryRun && (err != nil || version != FormatVersion) {
+				t.Errorf("migrated file has version %d, %v", version, err)
+			}
+
+			if !tt.wantBackup {
+				if report.Backup != "" {
+					t.Errorf("MigrateFile() wrote backup %q", report.Backup)
+				}
+				return
+			}
+			backup, err := os.ReadFile(report.Backup)
+			if err != nil {
+				t.Fatalf("backup was not written: %v", err)
+			}
+			if string(backup) != tt.content {
+				t.Errorf("backup = %s, want the original file", backup)
+			}
+		})
+	}
+}
@@ -1,13 +1,104 @@
 package calculator
 
-import "time"
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OperatorExpression is the Operator of results of evaluated expressions.
+const OperatorExpression = "expression"
 
 type Result struct {
-	Value      float64
+	// ID is a UUIDv7, so IDs sort by creation time.
+	ID string
+	// Operator is the name of the operation, or OperatorExpression.
+	Operator  string
+	Operands  []Number
+	Precision int
+	Value     float64
+	// Raw is the unrounded result. Decimal results without a short exact
+	// representation are cut off after maxRawPlaces digits.
+	Raw Number
+	// Source is the normalized expression of OperatorExpression results.
+	Source string
+	// Decimal holds the exact digits of the result when it was computed in
+	// ModeDecimal and is empty otherwise.
+	Decimal    string
 	Expression string
+	Mode       Mode
 	Created    time.Time
 }
 
+// Number returns the result value, using the exact digits where available.
+func (r Result) Number() Number {
+	if r.Decimal != "" {
+		return Number(r.Decimal)
+	}
+	return floatNumber(r.Value)
+}
+
 func (r Result) String() string {
 	return r.Expression
 }
+
+// Render renders the result again at the given precision from its
+// structured fields.
+func (r Result) Render(operations *Registry, precision int) (string, error) {
+	raw := r.Raw
+	if raw == "" {
+		raw = r.Number()
+	}
+	value := roundNumber(r.Mode, raw, precision)
+
+	if r.Operator == OperatorExpression {
+		return r.Source + " = " + value, nil
+	}
+
+	op, err := operations.Lookup(r.Operator)
+	if err != nil {
+		return "", err
+	}
+
+	operands := make([]string, len(r.Operands))
+	for i, operand := range r.Operands {
+		operands[i] = formatNumber(r.Mode, operand, precision)
+	}
+	return op.format(operands) + " = " + value, nil
+}
+
+// legacyExpression matches the expressions of results stored before results
+// kept their structure, e.g. "1.0000 + 2.0000 = 3.0000".
+var legacyExpression = regexp.MustCompile(`^(\S+) ([-+*/]) (\S+) = (\S+)$`)
+
+var legacyOperators = map[string]string{
+	"+": "addition",
+	"-": "subtraction",
+	"*": "multiplication",
+	"/": "division",
+}
+
+// upgradeLegacy restores the structure of a result stored before results
+// kept their operator, operands and precision by parsing its expression.
+// Results whose expression cannot be parsed are left as they are.
+func upgradeLegacy(r *Result) {
+	if r.Mode == "" {
+		r.Mode = ModeFloat
+	}
+	if r.Operator != "" {
+		return
+	}
+
+	m := legacyExpression.FindStringSubmatch(r.Expression)
+	if m == nil {
+		return
+	}
+
+	r.Operator = legacyOperators[m[2]]
+	r.Operands = []Number{Number(m[1]), Number(m[3])}
+	if _, fraction, found := strings.Cut(m[4], "."); found {
+		r.Precision = len(fraction)
+	}
+	// the unrounded value was never stored
+	r.Raw = floatNumber(r.Value)
+}
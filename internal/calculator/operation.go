@@ -0,0 +1,171 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownOperation = errors.New("unknown operation")
+	ErrArity            = errors.New("wrong number of operands")
+	ErrDecimalMode      = errors.New("operation is not supported in decimal mode")
+)
+
+// Operation describes a calculation. Routes, request validation, history
+// formatting and the operation listing are all derived from it.
+type Operation struct {
+	// Name is the route and lookup name, e.g. "addition".
+	Name string
+	// Symbol is used to render the operation in expressions. Infix
+	// operations are written as "a + b", all others as "root(27, 3)".
+	Symbol      string
+	Infix       bool
+	Description string
+	// Params names the operands in request bodies. Variadic operations take
+	// all of their operands from a single "operands" array instead.
+	Params   []string
+	Variadic bool
+	// ZeroDefault treats missing named operands as 0, as the first four
+	// operations always did. All others require every operand.
+	ZeroDefault bool
+	// MinArity is the minimum number of operands of a variadic operation.
+	MinArity int
+	// Result names the result field in responses, e.g. "sum".
+	Result string
+
+	// Check validates the operands before Eval is called and returns a
+	// domain error like ErrDivByZero. It may be nil.
+	Check func(args []float64) error
+	Eval  func(args []float64) float64
+	// Decimal computes the exact result in ModeDecimal. Operations whose
+	// result is generally irrational leave it nil.
+	Decimal func(args []*big.Rat) (*big.Rat, error)
+}
+
+func (o *Operation) checkArity(n int) error {
+	if o.Variadic {
+		if n < o.MinArity {
+			return fmt.Errorf("%w: %s expects at least %d, got %d", ErrArity, o.Name, o.MinArity, n)
+		}
+		return nil
+	}
+	if n != len(o.Params) {
+		return fmt.Errorf("%w: %s expects %d, got %d", ErrArity, o.Name, len(o.Params), n)
+	}
+	return nil
+}
+
+func (o *Operation) evalFloat(args []float64) (float64, error) {
+	if err := o.checkArity(len(args)); err != nil {
+		return 0, err
+	}
+	if o.Check != nil {
+		if err := o.Check(args); err != nil {
+			return 0, err
+		}
+	}
+
+	result := o.Eval(args)
+	if err := validateFloat(result); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+func (o *Operation) evalDecimal(args []*big.Rat) (*big.Rat, error) {
+	if err := o.checkArity(len(args)); err != nil {
+		return nil, err
+	}
+	if o.Decimal == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecimalMode, o.Name)
+	}
+
+	result, err := o.Decimal(args)
+	if err != nil {
+		return nil, err
+	}
+	// chained operations could otherwise build numbers of any size
+	if max(result.Num().BitLen(), result.Denom().BitLen()) > maxDecimalBits {
+		return nil, ErrOverflow
+	}
+	return result, nil
+}
+
+// format renders the operation applied to already formatted operands.
+func (o *Operation) format(args []string) string {
+	if o.Infix && len(args) == 2 {
+		return args[0] + " " + o.Symbol + " " + args[1]
+	}
+	return o.Symbol + "(" + strings.Join(args, ", ") + ")"
+}
+
+type Registry struct {
+	mu    sync.RWMutex
+	ops   map[string]*Operation
+	order []*Operation
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		ops: map[string]*Operation{},
+	}
+}
+
+// Register adds an operation. Its name and symbol must not collide with an
+// operation that is already registered.
+func (r *Registry) Register(op Operation) error {
+	if op.Name == "" || op.Symbol == "" || op.Result == "" || op.Eval == nil {
+		return fmt.Errorf("operation %q: name, symbol, result and eval are required", op.Name)
+	}
+	if op.Variadic == (len(op.Params) > 0) {
+		return fmt.Errorf("operation %q: exactly one of params and variadic must be set", op.Name)
+	}
+	if op.Infix && len(op.Params) != 2 {
+		return fmt.Errorf("operation %q: infix operations must take two operands", op.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range []string{op.Name, op.Symbol} {
+		if _, exists := r.ops[key]; exists {
+			return fmt.Errorf("operation %q: %q is already registered", op.Name, key)
+		}
+	}
+
+	r.ops[op.Name] = &op
+	r.ops[op.Symbol] = &op
+	r.order = append(r.order, &op)
+	return nil
+}
+
+func (r *Registry) MustRegister(op Operation) {
+	if err := r.Register(op); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup finds an operation by name or symbol.
+func (r *Registry) Lookup(nameOrSymbol string) (*Operation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	op, ok := r.ops[nameOrSymbol]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownOperation, nameOrSymbol)
+	}
+	return op, nil
+}
+
+// Operations returns all operations in registration order.
+func (r *Registry) Operations() []*Operation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ops := make([]*Operation, len(r.order))
+	copy(ops, r.order)
+	return ops
+}
@@ -0,0 +1,287 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// maxDecimalBits bounds the numerator and denominator of every result in
+// ModeDecimal, and of powers before they are computed.
+const maxDecimalBits = 1 << 20
+
+// DefaultOperations returns a registry with all built-in operations.
+func DefaultOperations() *Registry {
+	r := NewRegistry()
+
+	r.MustRegister(Operation{
+		Name:        "addition",
+		Symbol:      "+",
+		Infix:       true,
+		Description: "Adds two numbers",
+		Params:      []string{"summand_one", "summand_two"},
+		ZeroDefault: true,
+		Result:      "sum",
+		Eval: func(args []float64) float64 {
+			return args[0] + args[1]
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Add(args[0], args[1]), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "subtraction",
+		Symbol:      "-",
+		Infix:       true,
+		Description: "Subtracts the subtrahend from the minuend",
+		Params:      []string{"minuend", "subtrahend"},
+		ZeroDefault: true,
+		Result:      "difference",
+		Eval: func(args []float64) float64 {
+			return args[0] - args[1]
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Sub(args[0], args[1]), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "multiplication",
+		Symbol:      "*",
+		Infix:       true,
+		Description: "Multiplies two numbers",
+		Params:      []string{"factor_one", "factor_two"},
+		ZeroDefault: true,
+		Result:      "product",
+		Eval: func(args []float64) float64 {
+			return args[0] * args[1]
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Mul(args[0], args[1]), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "division",
+		Symbol:      "/",
+		Infix:       true,
+		Description: "Divides the dividend by the divisor",
+		Params:      []string{"dividend", "divisor"},
+		ZeroDefault: true,
+		Result:      "quotient",
+		Check: func(args []float64) error {
+			if args[1] == 0 {
+				return ErrDivByZero
+			}
+			return nil
+		},
+		Eval: func(args []float64) float64 {
+			return args[0] / args[1]
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			if args[1].Sign() == 0 {
+				return nil, ErrDivByZero
+			}
+			return new(big.Rat).Quo(args[0], args[1]), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "power",
+		Symbol:      "^",
+		Infix:       true,
+		Description: "Raises the base to the exponent",
+		Params:      []string{"base", "exponent"},
+		Result:      "power",
+		Check: func(args []float64) error {
+			if args[0] == 0 && args[1] < 0 {
+				return ErrDivByZero
+			}
+			if args[0] < 0 && !isInteger(args[1]) {
+				return ErrComplexPower
+			}
+			return nil
+		},
+		Eval: func(args []float64) float64 {
+			return math.Pow(args[0], args[1])
+		},
+		Decimal: powDecimal,
+	})
+
+	r.MustRegister(Operation{
+		Name:        "modulo",
+		Symbol:      "%",
+		Infix:       true,
+		Description: "Remainder of the truncated division of the dividend by the divisor",
+		Params:      []string{"dividend", "divisor"},
+		Result:      "remainder",
+		Check: func(args []float64) error {
+			if args[1] == 0 {
+				return ErrModuloByZero
+			}
+			return nil
+		},
+		Eval: func(args []float64) float64 {
+			return math.Mod(args[0], args[1])
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			if args[1].Sign() == 0 {
+				return nil, ErrModuloByZero
+			}
+			quo := new(big.Rat).Quo(args[0], args[1])
+			trunc := new(big.Int).Quo(quo.Num(), quo.Denom())
+			rem := new(big.Rat).Mul(args[1], new(big.Rat).SetInt(trunc))
+			return rem.Sub(args[0], rem), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "root",
+		Symbol:      "root",
+		Description: "Takes the nth root of the radicand",
+		Params:      []string{"radicand", "degree"},
+		Result:      "root",
+		Check: func(args []float64) error {
+			if args[1] == 0 {
+				return ErrRootDegree
+			}
+			if args[0] < 0 && !(isInteger(args[1]) && math.Mod(args[1], 2) != 0) {
+				return ErrNegativeRadicand
+			}
+			return nil
+		},
+		Eval: func(args []float64) float64 {
+			x, n := args[0], args[1]
+			switch {
+			case n == 2:
+				return math.Sqrt(x)
+			case n == 3:
+				return math.Cbrt(x)
+			case x < 0:
+				return -math.Pow(-x, 1/n)
+			}
+			return math.Pow(x, 1/n)
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "logarithm",
+		Symbol:      "log",
+		Description: "Logarithm of the value to the given base",
+		Params:      []string{"value", "base"},
+		Result:      "logarithm",
+		Check: func(args []float64) error {
+			if args[0] <= 0 {
+				return ErrLogDomain
+			}
+			if args[1] <= 0 || args[1] == 1 {
+				return ErrLogBase
+			}
+			return nil
+		},
+		Eval: func(args []float64) float64 {
+			switch args[1] {
+			case 2:
+				return math.Log2(args[0])
+			case 10:
+				return math.Log10(args[0])
+			}
+			return math.Log(args[0]) / math.Log(args[1])
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "minimum",
+		Symbol:      "min",
+		Description: "Smallest of the operands",
+		Variadic:    true,
+		MinArity:    1,
+		Result:      "minimum",
+		Eval: func(args []float64) float64 {
+			result := args[0]
+			for _, arg := range args[1:] {
+				result = math.Min(result, arg)
+			}
+			return result
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			result := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(result) < 0 {
+					result = arg
+				}
+			}
+			return new(big.Rat).Set(result), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "maximum",
+		Symbol:      "max",
+		Description: "Largest of the operands",
+		Variadic:    true,
+		MinArity:    1,
+		Result:      "maximum",
+		Eval: func(args []float64) float64 {
+			result := args[0]
+			for _, arg := range args[1:] {
+				result = math.Max(result, arg)
+			}
+			return result
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			result := args[0]
+			for _, arg := range args[1:] {
+				if arg.Cmp(result) > 0 {
+					result = arg
+				}
+			}
+			return new(big.Rat).Set(result), nil
+		},
+	})
+
+	r.MustRegister(Operation{
+		Name:        "absolute",
+		Symbol:      "abs",
+		Description: "Absolute value",
+		Params:      []string{"value"},
+		Result:      "absolute",
+		Eval: func(args []float64) float64 {
+			return math.Abs(args[0])
+		},
+		Decimal: func(args []*big.Rat) (*big.Rat, error) {
+			return new(big.Rat).Abs(args[0]), nil
+		},
+	})
+
+	return r
+}
+
+func isInteger(f float64) bool {
+	return !math.IsInf(f, 0) && f == math.Trunc(f)
+}
+
+// powDecimal computes exact powers with integer exponents.
+func powDecimal(args []*big.Rat) (*big.Rat, error) {
+	base, exp := args[0], args[1]
+	if !exp.IsInt() {
+		return nil, fmt.Errorf("%w: power with a non-integer exponent", ErrDecimalMode)
+	}
+	if base.Sign() == 0 && exp.Sign() < 0 {
+		return nil, ErrDivByZero
+	}
+
+	e := new(big.Int).Abs(exp.Num())
+	size := max(base.Num().BitLen(), base.Denom().BitLen())
+	if e.Cmp(big.NewInt(maxDecimalBits)) > 0 || int64(size)*e.Int64() > maxDecimalBits {
+		return nil, ErrOverflow
+	}
+
+	num := new(big.Int).Exp(base.Num(), e, nil)
+	den := new(big.Int).Exp(base.Denom(), e, nil)
+	if exp.Sign() < 0 {
+		num, den = den, num
+	}
+	return new(big.Rat).SetFrac(num, den), nil
+}
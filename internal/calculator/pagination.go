@@ -1,8 +1,15 @@
 package calculator
 
 import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/leandersteiner/interview-assignment/internal/web"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 const DefaultPageSize = 5
@@ -21,6 +28,13 @@ type Metadata struct {
 	LastPage     int
 	FirstPage    int
 	NextPage     int
+	// NextCursor and PrevCursor are set in cursor mode and are passed as
+	// after and before to get the adjacent pages.
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	// Snapshot identifies the state the page was read from. Passing it as
+	// snapshot reads the other pages from the same state.
+	Snapshot string `json:"snapshot,omitempty"`
 }
 
 type Pagination struct {
@@ -49,7 +63,7 @@ func (p *Pagination) Limit() int {
 }
 
 func (p *Pagination) toMetadata(total int) Metadata {
-	lastPage := total / p.PageSize
+	lastPage := (total + p.PageSize - 1) / p.PageSize
 	nextPage := p.Page + 1
 	if lastPage == 0 {
 		lastPage = 1
@@ -76,3 +90,76 @@ func parsePagination(r *http.Request) Pagination {
 		PageSize: web.GetIntParam(query, "page_size", DefaultPageSize),
 	}
 }
+
+// cursorLinks returns an RFC 8288 Link header value with the next and prev
+// links of a cursor page, relative to the request URL.
+func cursorLinks(r *http.Request, m Metadata) string {
+	var links []string
+	for _, l := range []struct{ rel, param, cursor string }{
+		{"next", "after", m.NextCursor},
+		{"prev", "before", m.PrevCursor},
+	} {
+		if l.cursor == "" {
+			continue
+		}
+		query := r.URL.Query()
+		query.Del("after")
+		query.Del("before")
+		query.Del("page")
+		query.Del("page_size")
+		query.Set(l.param, l.cursor)
+		query.Set("limit", strconv.Itoa(m.PageSize))
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), l.rel))
+	}
+	return strings.Join(links, ", ")
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a sorted result list. Positions are given by
+// the result ID, which sorts by creation time, and for value sorts by the
+// value, so they stay stable while new results are stored.
+type Cursor struct {
+	Sort  Sort    `json:"s"`
+	ID    string  `json:"id"`
+	Value float64 `json:"v,omitempty"`
+}
+
+func cursorOf(r Result, sort Sort) Cursor {
+	return Cursor{Sort: sort, ID: r.ID, Value: r.Value}
+}
+
+// Encode returns the opaque string form of the cursor.
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := &Cursor{}
+	if err := json.Unmarshal(data, c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// compare orders r relative to the cursor position in the cursor's sort
+// order. Ties on the sort key are broken by ID so that every result has a
+// unique position.
+func (c Cursor) compare(r Result) int {
+	switch c.Sort {
+	case SortOldest:
+		return strings.Compare(r.ID, c.ID)
+	case SortValueAsc:
+		return cmp.Or(cmp.Compare(r.Value, c.Value), strings.Compare(r.ID, c.ID))
+	case SortValueDesc:
+		return cmp.Or(cmp.Compare(c.Value, r.Value), strings.Compare(c.ID, r.ID))
+	default:
+		return strings.Compare(c.ID, r.ID)
+	}
+}
@@ -0,0 +1,28 @@
+package calculator
+
+import "testing"
+
+func TestPagination_toMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		page     int
+		total    int
+		lastPage int
+		nextPage int
+	}{
+		{"empty", 1, 0, 1, 1},
+		{"less than a page", 1, 3, 1, 1},
+		{"exact multiple", 1, 10, 2, 2},
+		{"remainder", 2, 11, 3, 3},
+		{"last page", 3, 11, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Pagination{Page: tt.page, PageSize: 5}
+			m := p.toMetadata(tt.total)
+			if m.LastPage != tt.lastPage || m.NextPage != tt.nextPage {
+				t.Errorf("toMetadata(%d) last page = %d, next page = %d, want %d, %d", tt.total, m.LastPage, m.NextPage, tt.lastPage, tt.nextPage)
+			}
+		})
+	}
+}
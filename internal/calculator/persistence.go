@@ -1,56 +1,338 @@
 package calculator
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const SaveFilePath = "./results.json"
+// filePerm keeps persisted results readable by their owner only.
+const filePerm = 0600
 
+// JSONStore keeps the results in memory and persists them as a JSON snapshot,
+// optionally with a write-ahead log of all changes since that snapshot. With a
+// keyring both are encrypted.
 type JSONStore struct {
 	*ResultStore
+	path   string
+	wal    *wal
+	keys   *Keyring
+	logger *slog.Logger
+	// writeMu serializes changes.
+	writeMu sync.Mutex
+	// snapMu serializes snapshots, so an older one never replaces a newer
+	// one. It is taken before writeMu.
+	snapMu sync.Mutex
+	// compacting is set while a snapshot triggered by the size of the log is
+	// written in the background.
+	compacting atomic.Bool
+	compactWG  sync.WaitGroup
+
+	statsMu sync.Mutex
+	stats   SaveStats
+}
+
+// SaveStats describe the snapshots a JSONStore has written since it was
+// opened.
+type SaveStats struct {
+	Saves    int
+	Failures int
+	// LastSave is when the last successful snapshot was written and
+	// LastDuration how long that took.
+	LastSave     time.Time
+	LastDuration time.Duration
+	LastError    error
 }
 
-func NewJSONStore() (*JSONStore, error) {
+// NewJSONStore loads the snapshot at path and replays the write-ahead log on
+// top of it. A torn record at the end of the log, left behind by a crash, is
+// cut off. A corrupted record followed by intact ones fails with
+// ErrCorruptLog.
+func NewJSONStore(logger *slog.Logger, path string, opts WALOptions, keys *Keyring) (*JSONStore, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+
 	store := &JSONStore{
 		ResultStore: NewResultStore(),
+		path:        path,
+		keys:        keys,
+		logger:      logger,
 	}
 
 	if err := store.Load(); err != nil {
 		return nil, fmt.Errorf("failed to load storage: %w", err)
 	}
 
+	if opts.Path != "" {
+		wal, err := openWAL(opts, keys, store.replay)
+		if err != nil {
+			return nil, err
+		}
+		store.wal = wal
+	}
+
 	return store, nil
 }
 
+// Load reads the storage file, migrating files written by older versions
+// first. Files written by newer versions are refused with ErrFormatTooNew.
+// Files encrypted with an older key are encrypted with the current key on the
+// next save.
 func (s *JSONStore) Load() error {
-	data, err := os.ReadFile(SaveFilePath)
+	data, report, err := migrateFile(s.path, false, s.keys)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil // file doesn't exist, start with empty storage
 		}
-		return fmt.Errorf("failed to read storage file: %w", err)
+		return err
+	}
+	if report.Migrated() {
+		s.logger.Info("migrated storage file", "path", s.path, "from", report.From, "to", report.To, "backup", report.Backup, "changes", report.Changes)
+	}
+	if s.keys != nil && report.KeyID != s.keys.Current() {
+		s.logger.Info("storage file will be encrypted with the current key on the next save", "path", s.path, "key", report.KeyID, "current", s.keys.Current())
+	}
+
+	var file storageFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidStoreFile, err)
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return json.Unmarshal(data, &s.results)
+	// the file is ordered newest first, and files written before results
+	// were kept ordered by ID may be slightly out of order
+	slices.Reverse(file.Results)
+	slices.SortStableFunc(file.Results, func(a, b Result) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	s.results = file.Results
+	s.reindex()
+	return nil
 }
 
+// Save writes a snapshot and truncates the write-ahead log.
 func (s *JSONStore) Save() error {
+	return s.snapshot()
+}
+
+// Close waits for a running compaction and syncs and closes the write-ahead
+// log. It does not write a snapshot.
+func (s *JSONStore) Close() error {
+	s.compactWG.Wait()
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
+}
+
+// DataDir returns the directory of the storage file.
+func (s *JSONStore) DataDir() string {
+	return filepath.Dir(s.path)
+}
+
+// SaveStats returns the statistics of the snapshots written so far.
+func (s *JSONStore) SaveStats() SaveStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// snapshot writes all results atomically and drops the records they contain
+// from the log.
+func (s *JSONStore) snapshot() error {
+	start := time.Now()
+	err := s.writeSnapshot()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.stats.LastError = err
+	if err != nil {
+		s.stats.Failures++
+		return err
+	}
+	s.stats.Saves++
+	s.stats.LastSave = start
+	s.stats.LastDuration = time.Since(start)
+	return nil
+}
+
+// writeSnapshot only holds writeMu to copy the results, so changes go on while
+// the snapshot is written. Their records stay in the log.
+func (s *JSONStore) writeSnapshot() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.writeMu.Lock()
+	var mark walMark
+	if s.wal != nil {
+		mark = s.wal.mark()
+	}
 	s.mu.RLock()
-	data, err := json.Marshal(s.results)
+	results := s.newestFirst()
 	s.mu.RUnlock()
+	s.writeMu.Unlock()
 
+	data, err := json.Marshal(storageFile{Version: FormatVersion, Results: results})
 	if err != nil {
 		return fmt.Errorf("failed to marshal storage: %w", err)
 	}
+	if data, err = s.keys.seal(data); err != nil {
+		return fmt.Errorf("failed to encrypt storage: %w", err)
+	}
 
-	if err := os.WriteFile(SaveFilePath, data, 0644); err != nil {
+	if err := writeFileAtomic(s.path, data, filePerm); err != nil {
 		return fmt.Errorf("failed to write storage file: %w", err)
 	}
 
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.dropBefore(mark)
+}
+
+func (s *JSONStore) Store(ctx context.Context, result Result) error {
+	return s.StoreMany(ctx, []Result{result})
+}
+
+// StoreMany logs the results as a single record, so a batch is either
+// recovered completely or not at all.
+func (s *JSONStore) StoreMany(ctx context.Context, results []Result) error {
+	if len(results) == 0 {
+		return ctx.Err()
+	}
+	return s.mutate(ctx, walRecord{Op: walStore, Results: results}, nil, func() {
+		s.add(results)
+	})
+}
+
+func (s *JSONStore) Delete(ctx context.Context, id string) error {
+	exists := func() error {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if _, ok := s.byID[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	}
+	return s.mutate(ctx, walRecord{Op: walDelete, IDs: []string{id}}, exists, func() {
+		s.remove([]string{id})
+	})
+}
+
+func (s *JSONStore) Clear(ctx context.Context) (int, error) {
+	var n int
+	err := s.mutate(ctx, walRecord{Op: walClear}, nil, func() {
+		n = s.clear()
+	})
+	return n, err
+}
+
+// Evict logs the evicted results by ID rather than the policy, so replaying
+// the log does not depend on the time of the replay.
+func (s *JSONStore) Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	s.mu.RLock()
+	ids := s.evictable(policy, now)
+	s.mu.RUnlock()
+
+	if len(ids) == 0 {
+		return 0, ctx.Err()
+	}
+
+	var n int
+	err := s.mutate(ctx, walRecord{Op: walDelete, IDs: ids}, nil, func() {
+		n = s.remove(ids)
+	})
+	return n, err
+}
+
+// mutate appends the record to the log and then applies the change in memory
+// with the write lock held. A non-nil check runs first under the write lock
+// and refuses the change if it fails. If the record cannot be written, the
+// change is not applied.
+func (s *JSONStore) mutate(ctx context.Context, record walRecord, check func() error, apply func()) error {
+	ctx, span := web.StartSpan(ctx, "JSONStore.mutate", slog.String("wal.op", string(record.Op)))
+	defer span.End()
+
+	lock(span, &s.writeMu)
+	defer s.writeMu.Unlock()
+
+	// the lock may have taken a while to get
+	if err := ctx.Err(); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+
+	var compact bool
+	if s.wal != nil {
+		_, walSpan := web.StartSpan(ctx, "wal.append")
+		var err error
+		compact, err = s.wal.append(record)
+		walSpan.RecordError(err)
+		walSpan.End()
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		}
+	}
+
+	_, applySpan := web.StartSpan(ctx, "JSONStore.apply")
+	lock(applySpan, &s.mu)
+	apply()
+	s.mu.Unlock()
+	applySpan.End()
+
+	if compact && s.compacting.CompareAndSwap(false, true) {
+		s.compactWG.Add(1)
+		go s.compact()
+	}
 	return nil
 }
+
+// compact writes a snapshot in the background. The records are durable in
+// the log, so a failed compaction only delays truncating it.
+func (s *JSONStore) compact() {
+	defer s.compactWG.Done()
+	defer s.compacting.Store(false)
+
+	if err := s.snapshot(); err != nil {
+		s.logger.Error("snapshot", "error", err)
+	}
+}
+
+// replay applies a record read from the log on startup.
+func (s *JSONStore) replay(record walRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch record.Op {
+	case walStore:
+		var missing []Result
+		for _, r := range record.Results {
+			if _, ok := s.byID[r.ID]; !ok {
+				missing = append(missing, r)
+			}
+		}
+		s.add(missing)
+	case walDelete:
+		s.remove(record.IDs)
+	case walClear:
+		s.clear()
+	}
+}
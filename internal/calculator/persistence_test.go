@@ -0,0 +1,381 @@
+package calculator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests change into a temporary directory and use relative paths.
+const (
+	testSnapshotPath = "results.json"
+	testWALPath      = "results.wal"
+)
+
+func TestJSONStore_LoadLegacy(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	legacy := `[
+		{"Value":-0.5,"Expression":"1.00 / -2.00 = -0.50","Created":"2025-01-02T10:00:00Z"},
+		{"Value":3,"Expression":"1.0000 + 2.0000 = 3.0000","Created":"2025-01-01T10:00:00Z"}
+	]`
+	if err := os.WriteFile(testSnapshotPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, WALOptions{}, nil)
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	defer store.Close()
+
+	got := mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: MaxPageSize}})
+	if got.TotalRecords != 2 {
+		t.Fatalf("loaded %d results, want 2", got.TotalRecords)
+	}
+
+	division := got.Result[0]
+	if division.ID == "" {
+		t.Errorf("legacy result was not assigned an ID")
+	}
+	if division.Operator != "division" || division.Precision != 2 || division.Mode != ModeFloat {
+		t.Errorf("legacy result got operator %q, precision %d, mode %q", division.Operator, division.Precision, division.Mode)
+	}
+	if len(division.Operands) != 2 || division.Operands[0] != "1.00" || division.Operands[1] != "-2.00" {
+		t.Errorf("legacy result got operands %v", division.Operands)
+	}
+
+	if _, err := store.Find(t.Context(), division.ID); err != nil {
+		t.Errorf("Find(%q) found nothing", division.ID)
+	}
+
+	rendered, err := got.Result[1].Render(DefaultOperations(), 1)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if rendered != "1.0 + 2.0 = 3.0" {
+		t.Errorf("Render() got %q", rendered)
+	}
+}
+
+func openTestStore(t *testing.T, opts WALOptions) *JSONStore {
+	t.Helper()
+	opts.Path = testWALPath
+	store, err := NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, opts, nil)
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	return store
+}
+
+func storedIDs(t *testing.T, store *JSONStore) string {
+	t.Helper()
+	var ids string
+	for _, r := range mustGet(t, store, Query{Sort: SortOldest, Pagination: Pagination{PageSize: MaxPageSize}}).Result {
+		ids += r.ID
+	}
+	return ids
+}
+
+func TestJSONStore_RecoverWithoutSave(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	store := openTestStore(t, WALOptions{})
+	mustStore(t, store, Result{ID: "a"})
+	if err := store.StoreMany(t.Context(), []Result{{ID: "b"}, {ID: "c"}, {ID: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(t.Context(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Evict(t.Context(), RetentionPolicy{MaxCount: 2}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash: the log is never compacted into a snapshot
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, WALOptions{})
+	defer store.Close()
+	if got := storedIDs(t, store); got != "cd" {
+		t.Errorf("recovered %q, want %q", got, "cd")
+	}
+
+	if _, err := store.Clear(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "e"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, WALOptions{})
+	defer store.Close()
+	if got := storedIDs(t, store); got != "e" {
+		t.Errorf("recovered %q after clear, want %q", got, "e")
+	}
+}
+
+func TestJSONStore_TornWrite(t *testing.T) {
+	record := func(id string) []byte {
+		line, err := encodeWALRecord(walRecord{Op: walStore, Results: []Result{{ID: id}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	intact := append(record("a"), record("b")...)
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{
+			name: "partial record",
+			tail: record("c")[:20],
+		},
+		{
+			name: "record without newline",
+			tail: bytes.TrimSuffix(record("c"), []byte("\n")),
+		},
+		{
+			name: "checksum mismatch",
+			tail: bytes.Replace(record("c"), []byte(`"c"`), []byte(`"x"`), 1),
+		},
+		{
+			name: "garbage",
+			tail: []byte("\x00\x00\x00\x00\n"),
+		},
+		{
+			name: "corrupted record after a torn write",
+			tail: []byte("deadbeef {}\ndeadbeef {}\n"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile(testWALPath, append(bytes.Clone(intact), tt.tail...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			store := openTestStore(t, WALOptions{})
+			if got := storedIDs(t, store); got != "ab" {
+				t.Errorf("recovered %q, want %q", got, "ab")
+			}
+
+			// the torn tail is cut off, so new records are readable again
+			mustStore(t, store, Result{ID: "d"})
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store = openTestStore(t, WALOptions{})
+			defer store.Close()
+			if got := storedIDs(t, store); got != "abd" {
+				t.Errorf("recovered %q after append, want %q", got, "abd")
+			}
+		})
+	}
+}
+
+// failingFile writes only the first half of every write and fails, or fails
+// to sync.
+type failingFile struct {
+	walFile
+	failSync bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.failSync {
+		return f.walFile.Write(p)
+	}
+	n, _ := f.walFile.Write(p[:len(p)/2])
+	return n, errors.New("disk full")
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("I/O error")
+	}
+	return f.walFile.Sync()
+}
+
+func TestJSONStore_CorruptedLog(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	var log []byte
+	for _, id := range []string{"a", "b", "c"} {
+		line, err := encodeWALRecord(walRecord{Op: walStore, Results: []Result{{ID: id}}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log = append(log, line...)
+	}
+	// a flipped bit in the record of b
+	i := bytes.Index(log, []byte(`"b"`))
+	log[i+1] ^= 1
+	if err := os.WriteFile(testWALPath, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewJSONStore(slog.New(slog.DiscardHandler), testSnapshotPath, WALOptions{Path: testWALPath}, nil)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("NewJSONStore() error = %v, want ErrCorruptLog", err)
+	}
+	if data, err := os.ReadFile(testWALPath); err != nil || !bytes.Equal(data, log) {
+		t.Errorf("the corrupted log was changed: %v", err)
+	}
+}
+
+func TestJSONStore_FailedAppend(t *testing.T) {
+	tests := []struct {
+		name     string
+		failSync bool
+	}{
+		{name: "write", failSync: false},
+		{name: "sync", failSync: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			store := openTestStore(t, WALOptions{Sync: SyncAlways})
+			mustStore(t, store, Result{ID: "a"})
+
+			file := store.wal.file
+			store.wal.file = &failingFile{walFile: file, failSync: tt.failSync}
+			if err := store.Store(t.Context(), Result{ID: "b"}); !errors.Is(err, ErrStoreUnavailable) {
+				t.Fatalf("Store() error = %v, want ErrStoreUnavailable", err)
+			}
+			store.wal.file = file
+			if store.wal.records != 1 {
+				t.Errorf("log counts %d records, want 1", store.wal.records)
+			}
+
+			// the next record must not be appended to the refused one
+			mustStore(t, store, Result{ID: "c"})
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store = openTestStore(t, WALOptions{})
+			defer store.Close()
+			if got := storedIDs(t, store); got != "ac" {
+				t.Errorf("recovered %q, want %q", got, "ac")
+			}
+		})
+	}
+}
+
+func TestJSONStore_ConcurrentDelete(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	store := openTestStore(t, WALOptions{})
+	defer store.Close()
+	mustStore(t, store, Result{ID: "a"})
+
+	var deleted atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Delete(t.Context(), "a")
+			switch {
+			case err == nil:
+				deleted.Add(1)
+			case !errors.Is(err, ErrNotFound):
+				t.Errorf("Delete() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := deleted.Load(); got != 1 {
+		t.Errorf("%d deletes succeeded, want 1", got)
+	}
+	if store.wal.records != 2 {
+		t.Errorf("log holds %d records, want the store and one delete", store.wal.records)
+	}
+}
+
+func TestJSONStore_Snapshot(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	store := openTestStore(t, WALOptions{SnapshotEvery: 3})
+	mustStore(t, store, Result{ID: "a"})
+	mustStore(t, store, Result{ID: "b"})
+	mustStore(t, store, Result{ID: "c"})
+	// the log is compacted in the background
+	store.compactWG.Wait()
+
+	if info, err := os.Stat(testWALPath); err != nil || info.Size() != 0 {
+		t.Fatalf("log was not truncated after the snapshot: %v, %v", info, err)
+	}
+
+	mustStore(t, store, Result{ID: "d"})
+	wal, err := os.ReadFile(testWALPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash between writing the snapshot and truncating the log
+	if err := os.WriteFile(testWALPath, wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, WALOptions{})
+	defer store.Close()
+	if got := storedIDs(t, store); got != "abcd" {
+		t.Errorf("recovered %q, want %q", got, "abcd")
+	}
+
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory contains %d files, want the snapshot and the log", len(entries))
+	}
+}
+
+func TestJSONStore_CompactConcurrently(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	store := openTestStore(t, WALOptions{SnapshotEvery: 10})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				mustStore(t, store, Result{ID: fmt.Sprintf("%d-%03d", w, i)})
+			}
+		}()
+	}
+	wg.Wait()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// results stored while a snapshot was written are kept in the log
+	store = openTestStore(t, WALOptions{})
+	defer store.Close()
+	if got := store.Len(); got != 400 {
+		t.Errorf("recovered %d results, want 400", got)
+	}
+}
@@ -0,0 +1,423 @@
+package calculator
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Sort string
+
+const (
+	SortNewest    Sort = "newest"
+	SortOldest    Sort = "oldest"
+	SortValueAsc  Sort = "value_asc"
+	SortValueDesc Sort = "value_desc"
+)
+
+type Filter struct {
+	// Operators matches results of any of the given operation names.
+	Operators []string
+	// From and To bound the creation time; From is inclusive, To exclusive.
+	From time.Time
+	To   time.Time
+	// Min and Max bound the value inclusively.
+	Min *float64
+	Max *float64
+	// Search matches results whose expression contains it, ignoring case.
+	Search string
+}
+
+func (f Filter) Match(r Result) bool {
+	if len(f.Operators) > 0 && !slices.Contains(f.Operators, r.Operator) {
+		return false
+	}
+	if !f.From.IsZero() && r.Created.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !r.Created.Before(f.To) {
+		return false
+	}
+	if f.Min != nil && r.Value < *f.Min {
+		return false
+	}
+	if f.Max != nil && r.Value > *f.Max {
+		return false
+	}
+	if f.Search != "" && !strings.Contains(strings.ToLower(r.Expression), strings.ToLower(f.Search)) {
+		return false
+	}
+	return true
+}
+
+func (f Filter) isZero() bool {
+	return len(f.Operators) == 0 && f.From.IsZero() && f.To.IsZero() && f.Min == nil && f.Max == nil && f.Search == ""
+}
+
+type Query struct {
+	Pagination Pagination
+	Filter     Filter
+	Sort       Sort
+
+	// Limit switches from page-based to cursor pagination. The page then
+	// holds up to Limit results after After or before Before; without a
+	// cursor it is the first page.
+	Limit  int
+	After  *Cursor
+	Before *Cursor
+
+	// Snapshot reads the state of an earlier query instead of the current
+	// one.
+	Snapshot *Snapshot
+}
+
+// run filters, sorts and pages results, which are ordered oldest first as
+// they were stored and, if byID is set, by ID as well. The returned page never
+// shares memory with results.
+func (q Query) run(results []Result, byID bool) PaginatedResult[[]Result] {
+	switch {
+	case q.Limit > 0 && byID && (q.Sort == "" || q.Sort == SortNewest || q.Sort == SortOldest):
+		return q.seekPage(results)
+	case q.Limit > 0:
+		return q.cursorPage(q.apply(results))
+	case q.Sort == "" || q.Sort == SortNewest || q.Sort == SortOldest:
+		return q.timePage(results)
+	default:
+		return q.page(q.apply(results))
+	}
+}
+
+// apply filters and sorts results. It returns a new slice and leaves results
+// untouched.
+func (q Query) apply(results []Result) []Result {
+	matched := make([]Result, 0, len(results))
+	for i := len(results) - 1; i >= 0; i-- {
+		if q.Filter.Match(results[i]) {
+			matched = append(matched, results[i])
+		}
+	}
+
+	switch q.Sort {
+	case SortOldest:
+		slices.Reverse(matched)
+	case SortValueAsc:
+		slices.SortStableFunc(matched, func(a, b Result) int {
+			return cmp.Compare(a.Value, b.Value)
+		})
+	case SortValueDesc:
+		slices.SortStableFunc(matched, func(a, b Result) int {
+			return cmp.Compare(b.Value, a.Value)
+		})
+	}
+	return matched
+}
+
+// page returns the page of results selected by the pagination.
+func (q Query) page(results []Result) PaginatedResult[[]Result] {
+	p := q.Pagination
+	p.Validate()
+
+	start := min(p.Offset(), len(results))
+	end := min(start+p.Limit(), len(results))
+
+	return PaginatedResult[[]Result]{
+		Result:   slices.Clone(results[start:end]),
+		Metadata: p.toMetadata(len(results)),
+	}
+}
+
+// timePage pages results that are ordered oldest first in creation order.
+// It walks the results from the requested end and only copies the page, so
+// reads do not allocate in proportion to the size of the history.
+func (q Query) timePage(results []Result) PaginatedResult[[]Result] {
+	p := q.Pagination
+	p.Validate()
+
+	at := func(i int) Result {
+		if q.Sort == SortOldest {
+			return results[i]
+		}
+		return results[len(results)-1-i]
+	}
+
+	offset, limit := p.Offset(), p.Limit()
+	page := make([]Result, 0, limit)
+
+	if q.Filter.isZero() {
+		for i := offset; i < min(offset+limit, len(results)); i++ {
+			page = append(page, at(i))
+		}
+		return PaginatedResult[[]Result]{
+			Result:   page,
+			Metadata: p.toMetadata(len(results)),
+		}
+	}
+
+	total := 0
+	for i := range results {
+		r := at(i)
+		if !q.Filter.Match(r) {
+			continue
+		}
+		if total >= offset && total < offset+limit {
+			page = append(page, r)
+		}
+		total++
+	}
+
+	return PaginatedResult[[]Result]{
+		Result:   page,
+		Metadata: p.toMetadata(total),
+	}
+}
+
+// cursorPage returns the page of results selected by the cursors. The
+// results are sorted by their cursor position first, since insertion order
+// and ID order can differ slightly for concurrently stored results.
+func (q Query) cursorPage(results []Result) PaginatedResult[[]Result] {
+	sort := q.Sort
+	if sort == "" {
+		sort = SortNewest
+	}
+	slices.SortStableFunc(results, func(a, b Result) int {
+		return cursorOf(b, sort).compare(a)
+	})
+
+	start, end := 0, len(results)
+	if q.After != nil {
+		start, _ = slices.BinarySearchFunc(results, *q.After, func(r Result, c Cursor) int {
+			// position of the first result strictly after the cursor
+			if c.compare(r) <= 0 {
+				return -1
+			}
+			return 1
+		})
+	}
+	if q.Before != nil {
+		end, _ = slices.BinarySearchFunc(results, *q.Before, func(r Result, c Cursor) int {
+			return c.compare(r)
+		})
+		end = max(end, start)
+	}
+
+	if q.Before != nil && q.After == nil {
+		start = max(start, end-q.Limit)
+	} else {
+		end = min(end, start+q.Limit)
+	}
+
+	page := PaginatedResult[[]Result]{
+		Result: slices.Clone(results[start:end]),
+		Metadata: Metadata{
+			PageSize:     q.Limit,
+			TotalRecords: len(results),
+		},
+	}
+	if start < end {
+		if end < len(results) {
+			page.NextCursor = cursorOf(results[end-1], sort).Encode()
+		}
+		if start > 0 {
+			page.PrevCursor = cursorOf(results[start], sort).Encode()
+		}
+	}
+	return page
+}
+
+// seekPage returns the page of results selected by the cursors from results
+// ordered by ID. It finds the cursors by binary search and only copies the
+// page; a filter is matched while walking the results instead of sorting a
+// filtered copy.
+func (q Query) seekPage(results []Result) PaginatedResult[[]Result] {
+	order := q.Sort
+	if order == "" {
+		order = SortNewest
+	}
+	n := len(results)
+	at := func(i int) Result {
+		if order == SortOldest {
+			return results[i]
+		}
+		return results[n-1-i]
+	}
+	// matches reports whether a result in [from, to) matches the filter
+	matches := func(from, to int) bool {
+		if q.Filter.isZero() {
+			return from < to
+		}
+		for i := from; i < to; i++ {
+			if q.Filter.Match(at(i)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	start, end := 0, n
+	if q.After != nil {
+		start = sort.Search(n, func(i int) bool { return q.After.compare(at(i)) > 0 })
+	}
+	if q.Before != nil {
+		end = max(sort.Search(n, func(i int) bool { return q.Before.compare(at(i)) >= 0 }), start)
+	}
+
+	// first and last are the positions of the page in results
+	first, last := -1, -1
+	page := make([]Result, 0, min(q.Limit, end-start))
+	if q.Before != nil && q.After == nil {
+		for i := end - 1; i >= start && len(page) < q.Limit; i-- {
+			if r := at(i); q.Filter.Match(r) {
+				page = append(page, r)
+				first = i
+				last = max(last, i)
+			}
+		}
+		slices.Reverse(page)
+	} else {
+		for i := start; i < end && len(page) < q.Limit; i++ {
+			if r := at(i); q.Filter.Match(r) {
+				page = append(page, r)
+				last = i
+				if first < 0 {
+					first = i
+				}
+			}
+		}
+	}
+
+	total := n
+	if !q.Filter.isZero() {
+		total = 0
+		for _, r := range results {
+			if q.Filter.Match(r) {
+				total++
+			}
+		}
+	}
+
+	result := PaginatedResult[[]Result]{
+		Result: page,
+		Metadata: Metadata{
+			PageSize:     q.Limit,
+			TotalRecords: total,
+		},
+	}
+	if len(page) > 0 {
+		if matches(last+1, n) {
+			result.NextCursor = cursorOf(page[len(page)-1], order).Encode()
+		}
+		if matches(0, first) {
+			result.PrevCursor = cursorOf(page[0], order).Encode()
+		}
+	}
+	return result
+}
+
+// parseQuery reads the pagination, filter and sort query parameters.
+// Operators may be given by name or symbol and are resolved with the
+// registry.
+func parseQuery(r *http.Request, operations *Registry) (Query, error) {
+	query := r.URL.Query()
+	q := Query{
+		Pagination: parsePagination(r),
+		Sort:       SortNewest,
+	}
+
+	for _, value := range query["op"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == OperatorExpression {
+				q.Filter.Operators = append(q.Filter.Operators, name)
+				continue
+			}
+			op, err := operations.Lookup(name)
+			if err != nil {
+				return Query{}, err
+			}
+			q.Filter.Operators = append(q.Filter.Operators, op.Name)
+		}
+	}
+
+	var err error
+	if q.Filter.From, err = parseTime(query.Get("from")); err != nil {
+		return Query{}, fmt.Errorf("invalid from: %w", err)
+	}
+	if q.Filter.To, err = parseTime(query.Get("to")); err != nil {
+		return Query{}, fmt.Errorf("invalid to: %w", err)
+	}
+	if q.Filter.Min, err = parseFloatParam(query.Get("min")); err != nil {
+		return Query{}, fmt.Errorf("invalid min: %w", err)
+	}
+	if q.Filter.Max, err = parseFloatParam(query.Get("max")); err != nil {
+		return Query{}, fmt.Errorf("invalid max: %w", err)
+	}
+	q.Filter.Search = query.Get("q")
+
+	if s := query.Get("sort"); s != "" {
+		switch Sort(s) {
+		case SortNewest, SortOldest, SortValueAsc, SortValueDesc:
+			q.Sort = Sort(s)
+		default:
+			return Query{}, fmt.Errorf("unknown sort %q (expected %s, %s, %s or %s)", s, SortNewest, SortOldest, SortValueAsc, SortValueDesc)
+		}
+	}
+
+	if value := query.Get("snapshot"); value != "" {
+		if q.Snapshot, err = DecodeSnapshot(value); err != nil {
+			return Query{}, err
+		}
+	}
+
+	if !query.Has("limit") && !query.Has("after") && !query.Has("before") {
+		return q, nil
+	}
+
+	q.Limit = web.GetIntParam(query, "limit", DefaultPageSize)
+	q.Limit = max(MinPageSize, min(q.Limit, MaxPageSize))
+
+	for param, cursor := range map[string]**Cursor{"after": &q.After, "before": &q.Before} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		c, err := DecodeCursor(value)
+		if err != nil {
+			return Query{}, fmt.Errorf("%s: %w", param, err)
+		}
+		if c.Sort != q.Sort {
+			return Query{}, fmt.Errorf("%s: cursor was created for sort %q, not %q", param, c.Sort, q.Sort)
+		}
+		*cursor = c
+	}
+
+	return q, nil
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates, which mean the
+// start of that day in UTC.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+func parseFloatParam(value string) (*float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
@@ -0,0 +1,60 @@
+package calculator
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RetentionPolicy limits how many results are kept and for how long. Zero
+// values mean no limit.
+type RetentionPolicy struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxCount > 0 || p.MaxAge > 0
+}
+
+func (p RetentionPolicy) expired(r Result, now time.Time) bool {
+	return p.MaxAge > 0 && r.Created.Before(now.Add(-p.MaxAge))
+}
+
+type evicter interface {
+	Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error)
+}
+
+// RunJanitor enforces the retention policy on the store right away and then
+// every interval until the context is canceled.
+func RunJanitor(ctx context.Context, logger *slog.Logger, store evicter, policy RetentionPolicy, interval time.Duration) {
+	if !policy.Enabled() {
+		return
+	}
+
+	evict := func(now time.Time) {
+		evicted, err := store.Evict(ctx, policy, now)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("retention", "error", err)
+			}
+			return
+		}
+		if evicted > 0 {
+			logger.Info("retention", "evicted", evicted, "max_count", policy.MaxCount, "max_age", policy.MaxAge)
+		}
+	}
+	evict(time.Now())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			evict(now)
+		}
+	}
+}
@@ -3,22 +3,99 @@ package calculator
 import (
 	"github.com/leandersteiner/interview-assignment/internal/web"
 	"log/slog"
+	"time"
 )
 
 type Config struct {
 	Logger *slog.Logger
 	Store  Store
+	Mode   Mode
+	// Operations defaults to DefaultOperations.
+	Operations *Registry
+	// MaxBatchSize limits the number of items per batch request and
+	// defaults to DefaultMaxBatchSize.
+	MaxBatchSize int
+	// Hub receives every stored result. It defaults to a new hub; pass one
+	// to close the streams on shutdown.
+	Hub *Hub
+	// StreamHeartbeat defaults to DefaultStreamHeartbeat.
+	StreamHeartbeat time.Duration
+	// SessionPingInterval defaults to DefaultSessionPingInterval.
+	SessionPingInterval time.Duration
+	// SessionAllowedOrigins are the origins, e.g. https://example.com, whose
+	// pages may open sessions besides those served by the API itself.
+	SessionAllowedOrigins []string
+	// Webhooks delivers the results of the hub. It defaults to webhooks with
+	// the default options; pass them to close them on shutdown.
+	Webhooks *Webhooks
+	// Metrics receives the series of the calculator. Without it nothing is
+	// counted.
+	Metrics *web.Registry
 }
 
+const DefaultMaxBatchSize = 1000
+
 func V1Routes(app *web.App, cfg Config) {
 	const version = "api/v1/calculator"
 
-	service := NewService(4, cfg.Store)
-	handler := NewHandler(service, cfg.Store)
+	operations := cfg.Operations
+	if operations == nil {
+		operations = DefaultOperations()
+	}
+
+	hub := cfg.Hub
+	if hub == nil {
+		hub = NewHub()
+	}
+	store := NewPublishingStore(cfg.Store, hub)
+	webhooks := cfg.Webhooks
+	if webhooks == nil {
+		webhooks = NewWebhooks(hub, WebhookOptions{}, cfg.Logger)
+	}
+	heartbeat := cfg.StreamHeartbeat
+	if heartbeat <= 0 {
+		heartbeat = DefaultStreamHeartbeat
+	}
+	pingInterval := cfg.SessionPingInterval
+	if pingInterval <= 0 {
+		pingInterval = DefaultSessionPingInterval
+	}
+
+	var metrics *Metrics
+	if cfg.Metrics != nil {
+		metrics = NewMetrics(cfg.Metrics, cfg.Store)
+	}
+	service := NewServiceWithOperations(4, store, operations, metrics)
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeFloat
+	}
+	maxBatchSize := cfg.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+	handler := NewHandler(service, store, store, mode, maxBatchSize)
+	stream := NewStreamHandler(store, hub, heartbeat, cfg.Logger)
+	sessions := NewSessionHandler(service, store, hub, mode, pingInterval, cfg.SessionAllowedOrigins, cfg.Logger)
+	hooks := NewWebhookHandler(webhooks, operations)
 
-	app.Post(version, "/addition", handler.Addition)
-	app.Post(version, "/subtraction", handler.Subtraction)
-	app.Post(version, "/multiplication", handler.Multiplication)
-	app.Post(version, "/division", handler.Division)
+	for _, op := range operations.Operations() {
+		app.Post(version, "/"+op.Name, handler.Operation(op))
+	}
+	app.Get(version, "/operations", handler.Operations)
+	app.Post(version, "/batch", handler.Batch)
+	app.Post(version, "/evaluate", handler.Evaluate)
 	app.Get(version, "/recent", handler.GetRecent)
+	app.Delete(version, "/recent", handler.ClearRecent)
+	app.Stream(version, "/recent/stream", stream.Recent)
+	app.Stream(version, "/session", sessions.Session)
+	app.Get(version, "/results/{id}", handler.GetResult)
+	app.Delete(version, "/results/{id}", handler.DeleteResult)
+	app.Post(version, "/webhooks", hooks.Create)
+	app.Get(version, "/webhooks", hooks.List)
+	app.Get(version, "/webhooks/dead-letters", hooks.DeadLetters)
+	app.Get(version, "/webhooks/{id}", hooks.Get)
+	app.Delete(version, "/webhooks/{id}", hooks.Delete)
+	app.Get(version, "/webhooks/{id}/deliveries", hooks.Deliveries)
+	app.Post(version, "/webhooks/{id}/deliveries/{delivery}/redeliver", hooks.Redeliver)
 }
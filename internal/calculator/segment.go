@@ -0,0 +1,1303 @@
+package calculator
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize     = 16 << 20
+	DefaultCompactInterval = time.Minute
+	DefaultCompactRatio    = 0.5
+
+	// indexInterval is the number of results between two entries of the
+	// sparse index.
+	indexInterval = 64
+	// maxRecordSize bounds the size of a single record, so a corrupted length
+	// cannot make the reader allocate huge buffers.
+	maxRecordSize = 16 << 20
+
+	segmentExt = ".seg"
+)
+
+type SegmentOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// SegmentSize is the size at which the active segment is sealed and a new
+	// one is started.
+	SegmentSize int64
+	// CompactInterval is how often sealed segments are checked for dead
+	// records.
+	CompactInterval time.Duration
+	// CompactRatio is the share of dead records at which a sealed segment is
+	// rewritten.
+	CompactRatio float64
+}
+
+// Record types. Every record is stored as
+//
+//	length uint32 | crc32c uint32 | type byte | payload
+//
+// where length is the size of the payload and the checksum covers the type
+// and the payload.
+const (
+	recordResult byte = iota + 1
+	// recordDelete holds the IDs of deleted results.
+	recordDelete
+	// recordClear starts a segment that replaces all older segments.
+	recordClear
+)
+
+const recordHeaderSize = 9
+
+// SegmentStore keeps the results in append-only segment files in a
+// directory. Only an index of the live results is held in memory: their
+// locations by ID and a sparse index per segment with an entry every
+// indexInterval results, which is enough to page newest or oldest first
+// without reading more than the requested blocks.
+//
+// Deletions are appended as tombstones. Sealed segments with many dead
+// records are rewritten in the background.
+type SegmentStore struct {
+	dir    string
+	opts   SegmentOptions
+	logger *slog.Logger
+
+	// compactMu serializes compactions, which mostly run without mu.
+	compactMu sync.Mutex
+
+	mu       sync.RWMutex
+	segments []*segment
+	byID     map[string]location
+	// dead maps deleted or replaced results that are still on disk to the IDs
+	// of their segments. Tombstones are kept until their results are gone.
+	dead  map[string][]uint64
+	dirty bool
+	// compactions counts rewritten segments, so segments holding only
+	// tombstones are rewritten only after older segments changed.
+	compactions uint64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+type segment struct {
+	id     uint64
+	file   *os.File
+	size   int64
+	blocks []block
+	// results and live count result records in the segment.
+	results int
+	live    int
+	// compacted is the compaction count of the store when the segment was
+	// last rewritten.
+	compacted uint64
+}
+
+// block is an entry of the sparse index: the position of a result record
+// and the results from there up to the next block.
+type block struct {
+	offset  int64
+	results int
+	live    int
+	// oldest is the earliest creation time in the block in Unix nanoseconds.
+	oldest int64
+}
+
+type location struct {
+	segment uint64
+	block   int
+	offset  int64
+}
+
+// NewSegmentStore opens the segments in dir and rebuilds the index from them.
+// A torn record at the end of the newest segment is cut off; corruption in
+// older segments is an error.
+func NewSegmentStore(logger *slog.Logger, dir string, opts SegmentOptions) (*SegmentStore, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = DefaultCompactInterval
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = DefaultCompactRatio
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	s := &SegmentStore{
+		dir:     dir,
+		opts:    opts,
+		logger:  logger,
+		byID:    map[string]location{},
+		dead:    map[string][]uint64{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if err := s.open(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	go s.background()
+	return s, nil
+}
+
+func (s *SegmentStore) open() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for i, id := range ids {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, filePerm)
+		if err != nil {
+			return fmt.Errorf("failed to open segment %d: %w", id, err)
+		}
+		seg := &segment{id: id, file: file}
+		s.segments = append(s.segments, seg)
+
+		if err := s.replay(seg, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		return s.startSegment(1)
+	}
+	return nil
+}
+
+// replay reads the records of a segment into the index. A torn tail is cut
+// off if the segment is the newest one.
+func (s *SegmentStore) replay(seg *segment, last bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment %d: %w", seg.id, err)
+	}
+
+	r := io.NewSectionReader(seg.file, 0, info.Size())
+	var offset int64
+	for {
+		typ, payload, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment %d is corrupted at offset %d: %w", seg.id, offset, err)
+			}
+			s.logger.Warn("segment store", "segment", seg.id, "offset", offset, "error", err, "msg", "cutting off torn record")
+			if err := seg.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate segment %d: %w", seg.id, err)
+			}
+			break
+		}
+
+		if err := s.apply(seg, typ, payload, offset); err != nil {
+			return fmt.Errorf("segment %d is corrupted at offset %d: %w", seg.id, offset, err)
+		}
+		offset += n
+	}
+
+	seg.size = offset
+	return nil
+}
+
+// apply updates the index for a record at offset in seg. The caller must
+// hold the write lock.
+func (s *SegmentStore) apply(seg *segment, typ byte, payload []byte, offset int64) error {
+	switch typ {
+	case recordResult:
+		r, err := decodeResult(payload)
+		if err != nil {
+			return err
+		}
+		s.indexResult(seg, r, offset)
+	case recordDelete:
+		ids, err := decodeIDs(payload)
+		if err != nil {
+			return err
+		}
+		s.unindex(ids)
+	case recordClear:
+		// all older segments are replaced by this one
+		s.byID = map[string]location{}
+		s.dead = map[string][]uint64{}
+		s.removeSegmentsBefore(seg.id)
+	default:
+		return fmt.Errorf("unknown record type %d", typ)
+	}
+	return nil
+}
+
+func (s *SegmentStore) indexResult(seg *segment, r Result, offset int64) {
+	// a result stored twice replaces the earlier record
+	s.unindex([]string{r.ID})
+
+	indexBlock(seg, r, offset)
+	s.byID[r.ID] = location{segment: seg.id, block: len(seg.blocks) - 1, offset: offset}
+}
+
+// unindex marks the results as dead and returns how many were live.
+func (s *SegmentStore) unindex(ids []string) int {
+	n := 0
+	for _, id := range ids {
+		loc, ok := s.byID[id]
+		if !ok {
+			continue
+		}
+		if seg := s.segment(loc.segment); seg != nil {
+			seg.live--
+			seg.blocks[loc.block].live--
+		}
+		delete(s.byID, id)
+		s.dead[id] = append(s.dead[id], loc.segment)
+		n++
+	}
+	return n
+}
+
+func (s *SegmentStore) segment(id uint64) *segment {
+	i, ok := slices.BinarySearchFunc(s.segments, id, func(seg *segment, id uint64) int {
+		return cmpUint64(seg.id, id)
+	})
+	if !ok {
+		return nil
+	}
+	return s.segments[i]
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (s *SegmentStore) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", id, segmentExt))
+}
+
+func (s *SegmentStore) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// startSegment creates a new, empty active segment. The caller must hold the
+// write lock.
+func (s *SegmentStore) startSegment(id uint64) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %d: %w", id, err)
+	}
+	s.segments = append(s.segments, &segment{id: id, file: file})
+	return syncDir(s.dir)
+}
+
+// removeSegmentsBefore deletes all segments older than id. The caller must
+// hold the write lock.
+func (s *SegmentStore) removeSegmentsBefore(id uint64) {
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.id >= id {
+			kept = append(kept, seg)
+			continue
+		}
+		seg.file.Close()
+		if err := os.Remove(s.segmentPath(seg.id)); err != nil {
+			// the clear record is replayed on the next start, which retries
+			s.logger.Error("segment store", "segment", seg.id, "error", err)
+		}
+	}
+	s.segments = kept
+}
+
+// append writes records to the active segment and syncs them according to
+// the sync policy. Records that could not be written or synced are cut off, so
+// they do not come back on the next start. It returns the offset of every
+// record. The caller must hold the write lock.
+func (s *SegmentStore) append(records ...[]byte) ([]int64, error) {
+	seg := s.active()
+
+	var buf []byte
+	offsets := make([]int64, len(records))
+	for i, record := range records {
+		offsets[i] = seg.size + int64(len(buf))
+		buf = append(buf, record...)
+	}
+
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		// cut off a partial write, so the next record starts cleanly
+		return nil, fmt.Errorf("%w: failed to write segment: %w", ErrStoreUnavailable, errors.Join(err, seg.file.Truncate(seg.size)))
+	}
+
+	switch s.opts.Sync {
+	case SyncAlways:
+		if err := seg.file.Sync(); err != nil {
+			return nil, fmt.Errorf("%w: failed to sync segment: %w", ErrStoreUnavailable, errors.Join(err, seg.file.Truncate(seg.size)))
+		}
+	case SyncInterval:
+		s.dirty = true
+	}
+	seg.size += int64(len(buf))
+	return offsets, nil
+}
+
+// sealIfFull starts a new segment once the active one reached its size. The
+// records are written by then, so a failure is only logged and the next write
+// tries again. The caller must hold the write lock.
+func (s *SegmentStore) sealIfFull() {
+	seg := s.active()
+	if seg.size < s.opts.SegmentSize {
+		return
+	}
+	if err := seg.file.Sync(); err != nil {
+		s.logger.Error("segment store", "segment", seg.id, "error", err, "msg", "failed to sync full segment")
+		return
+	}
+	if err := s.startSegment(seg.id + 1); err != nil {
+		s.logger.Error("segment store", "segment", seg.id, "error", err, "msg", "failed to start segment")
+	}
+}
+
+func (s *SegmentStore) Store(ctx context.Context, result Result) error {
+	return s.StoreMany(ctx, []Result{result})
+}
+
+// DataDir returns the directory of the segments.
+func (s *SegmentStore) DataDir() string {
+	return s.dir
+}
+
+// Len returns the number of stored results.
+func (s *SegmentStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byID)
+}
+
+// StoreMany writes the results with a single write, but not atomically: a
+// crash can leave a prefix of the batch.
+func (s *SegmentStore) StoreMany(ctx context.Context, results []Result) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	records := make([][]byte, len(results))
+	for i, r := range results {
+		records[i] = encodeRecord(recordResult, encodeResult(nil, r))
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.StoreMany")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	offsets, err := s.append(records...)
+	if err != nil {
+		return err
+	}
+	seg := s.active()
+	for i, r := range results {
+		s.indexResult(seg, r, offsets[i])
+	}
+	s.sealIfFull()
+	return nil
+}
+
+func (s *SegmentStore) Find(ctx context.Context, id string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.Find")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	defer s.mu.RUnlock()
+
+	loc, ok := s.byID[id]
+	if !ok {
+		return Result{}, ErrNotFound
+	}
+	return s.readResult(loc)
+}
+
+func (s *SegmentStore) readResult(loc location) (Result, error) {
+	seg := s.segment(loc.segment)
+	if seg == nil {
+		return Result{}, fmt.Errorf("segment %d of result is missing", loc.segment)
+	}
+
+	r := io.NewSectionReader(seg.file, loc.offset, seg.size-loc.offset)
+	typ, payload, _, err := readRecord(r)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read segment %d: %w", seg.id, err)
+	}
+	if typ != recordResult {
+		return Result{}, fmt.Errorf("segment %d has no result at offset %d", seg.id, loc.offset)
+	}
+	return decodeResult(payload)
+}
+
+// readBlock returns the live results of a block, oldest first.
+func (s *SegmentStore) readBlock(seg *segment, i int) ([]Result, error) {
+	start := seg.blocks[i].offset
+	end := seg.size
+	if i+1 < len(seg.blocks) {
+		end = seg.blocks[i+1].offset
+	}
+
+	results := make([]Result, 0, seg.blocks[i].live)
+	r := io.NewSectionReader(seg.file, start, end-start)
+	offset := start
+	for {
+		typ, payload, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return results, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %d: %w", seg.id, err)
+		}
+
+		if typ == recordResult {
+			result, err := decodeResult(payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read segment %d: %w", seg.id, err)
+			}
+			if loc, ok := s.byID[result.ID]; ok && loc.segment == seg.id && loc.offset == offset {
+				results = append(results, result)
+			}
+		}
+		offset += n
+	}
+}
+
+// Get pages newest or oldest first by skipping whole blocks of the sparse
+// index. Filters, value sorts and cursors need to read all results.
+// Snapshots are not supported.
+func (s *SegmentStore) Get(ctx context.Context, q Query) (PaginatedResult[[]Result], error) {
+	if err := ctx.Err(); err != nil {
+		return PaginatedResult[[]Result]{}, err
+	}
+	if q.Snapshot != nil {
+		return PaginatedResult[[]Result]{}, ErrSnapshotExpired
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.Get")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	defer s.mu.RUnlock()
+
+	if q.Limit > 0 || !q.Filter.isZero() || (q.Sort != "" && q.Sort != SortNewest && q.Sort != SortOldest) {
+		results, err := s.scan(ctx)
+		if err != nil {
+			return PaginatedResult[[]Result]{}, err
+		}
+		return q.run(results, false), nil
+	}
+
+	p := q.Pagination
+	p.Validate()
+	page, err := s.page(ctx, p.Offset(), p.Limit(), q.Sort == SortOldest)
+	if err != nil {
+		return PaginatedResult[[]Result]{}, err
+	}
+	return PaginatedResult[[]Result]{
+		Result:   page,
+		Metadata: p.toMetadata(len(s.byID)),
+	}, nil
+}
+
+// page reads limit results after skipping offset, newest first unless
+// oldest is set. The caller must hold the lock.
+func (s *SegmentStore) page(ctx context.Context, offset, limit int, oldest bool) ([]Result, error) {
+	type ref struct {
+		seg   *segment
+		block int
+	}
+	var blocks []ref
+	for _, seg := range s.segments {
+		for i := range seg.blocks {
+			blocks = append(blocks, ref{seg, i})
+		}
+	}
+	if !oldest {
+		slices.Reverse(blocks)
+	}
+
+	page := make([]Result, 0, limit)
+	for _, b := range blocks {
+		if len(page) == limit {
+			break
+		}
+		live := b.seg.blocks[b.block].live
+		if offset >= live {
+			offset -= live
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		results, err := s.readBlock(b.seg, b.block)
+		if err != nil {
+			return nil, err
+		}
+		if !oldest {
+			slices.Reverse(results)
+		}
+		results = results[offset:]
+		offset = 0
+		page = append(page, results[:min(len(results), limit-len(page))]...)
+	}
+	return page, nil
+}
+
+// readAfter reads the blocks from the one of the result with the ID until it
+// found limit results stored after it.
+func (s *SegmentStore) readAfter(ctx context.Context, after string, limit int) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.readAfter")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	defer s.mu.RUnlock()
+
+	loc, ok := s.byID[after]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	first, _ := slices.BinarySearchFunc(s.segments, loc.segment, func(seg *segment, id uint64) int {
+		return cmpUint64(seg.id, id)
+	})
+
+	page := make([]Result, 0, limit)
+	for _, seg := range s.segments[first:] {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for i := range seg.blocks {
+			if seg.id == loc.segment && i < loc.block || seg.blocks[i].live == 0 {
+				continue
+			}
+			results, err := s.readBlock(seg, i)
+			if err != nil {
+				return nil, err
+			}
+			for _, result := range results {
+				// the block of the result may hold older results too
+				if seg.id == loc.segment && s.byID[result.ID].offset <= loc.offset {
+					continue
+				}
+				page = append(page, result)
+				if len(page) == limit {
+					return page, nil
+				}
+			}
+		}
+	}
+	return page, nil
+}
+
+// scan reads all live results, oldest first. The caller must hold the lock.
+func (s *SegmentStore) scan(ctx context.Context) ([]Result, error) {
+	results := make([]Result, 0, len(s.byID))
+	for _, seg := range s.segments {
+		for i := range seg.blocks {
+			if seg.blocks[i].live == 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			block, err := s.readBlock(seg, i)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, block...)
+		}
+	}
+	return results, nil
+}
+
+func (s *SegmentStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.Delete")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[id]; !ok {
+		return ErrNotFound
+	}
+	return s.delete([]string{id})
+}
+
+// delete appends a tombstone for the IDs. The caller must hold the write
+// lock.
+func (s *SegmentStore) delete(ids []string) error {
+	if _, err := s.append(encodeRecord(recordDelete, encodeIDs(nil, ids))); err != nil {
+		return err
+	}
+	s.unindex(ids)
+	s.sealIfFull()
+	return nil
+}
+
+// Clear starts a new segment with a clear record and removes all older
+// segments.
+func (s *SegmentStore) Clear(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.Clear")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	n := len(s.byID)
+	// the segment is sealed, whether or not the clear record makes it
+	if err := s.active().file.Sync(); err != nil {
+		return 0, fmt.Errorf("%w: failed to sync segment: %w", ErrStoreUnavailable, err)
+	}
+	s.dirty = false
+	if err := s.startSegment(s.active().id + 1); err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	offsets, err := s.append(encodeRecord(recordClear, nil))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.active().file.Sync(); err != nil {
+		return 0, fmt.Errorf("%w: failed to sync segment: %w", ErrStoreUnavailable, err)
+	}
+	if err := s.apply(s.active(), recordClear, nil, offsets[0]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Evict reads the oldest blocks until it found the results the retention
+// policy no longer allows. Results are assumed to be stored roughly in
+// creation order, so the search for expired results stops at the first block
+// without any.
+func (s *SegmentStore) Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	_, span := web.StartSpan(ctx, "SegmentStore.Evict")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	excess := 0
+	if policy.MaxCount > 0 {
+		excess = max(0, len(s.byID)-policy.MaxCount)
+	}
+	cutoff := int64(math.MinInt64)
+	if policy.MaxAge > 0 {
+		cutoff = now.Add(-policy.MaxAge).UnixNano()
+	}
+
+	var ids []string
+scan:
+	for _, seg := range s.segments {
+		for i, b := range seg.blocks {
+			if b.live == 0 {
+				continue
+			}
+			if excess <= 0 && b.oldest >= cutoff {
+				break scan
+			}
+			results, err := s.readBlock(seg, i)
+			if err != nil {
+				return 0, err
+			}
+			for _, r := range results {
+				if excess > 0 || policy.expired(r, now) {
+					ids = append(ids, r.ID)
+					excess--
+				}
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	if err := s.delete(ids); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func (s *SegmentStore) background() {
+	defer close(s.stopped)
+
+	compact := time.NewTicker(s.opts.CompactInterval)
+	defer compact.Stop()
+
+	var syncC <-chan time.Time
+	if s.opts.Sync == SyncInterval {
+		ticker := time.NewTicker(s.opts.SyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-syncC:
+			s.mu.Lock()
+			if s.dirty {
+				// a failed sync is retried on the next tick and reported by Close
+				if err := s.active().file.Sync(); err == nil {
+					s.dirty = false
+				}
+			}
+			s.mu.Unlock()
+		case <-compact.C:
+			if err := s.Compact(); err != nil {
+				s.logger.Error("segment store", "error", err)
+			}
+		}
+	}
+}
+
+// Compact rewrites the sealed segments whose share of dead records reached
+// the compaction ratio and removes empty ones. Segments are read and written
+// without the lock, which is only held to look up the index and to swap in
+// the rewritten segment.
+func (s *SegmentStore) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.RLock()
+	var candidates []*segment
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		if seg.results == 0 {
+			if seg.compacted == s.compactions && seg.compacted > 0 {
+				continue
+			}
+		} else if float64(seg.results-seg.live)/float64(seg.results) < s.opts.CompactRatio {
+			continue
+		}
+		candidates = append(candidates, seg)
+	}
+	s.mu.RUnlock()
+
+	for _, seg := range candidates {
+		if err := s.compact(seg); err != nil {
+			return fmt.Errorf("failed to compact segment %d: %w", seg.id, err)
+		}
+	}
+	return nil
+}
+
+// segmentRecord is a record read for compaction.
+type segmentRecord struct {
+	typ     byte
+	payload []byte
+	offset  int64
+	// id is the ID of a result, ids those of a tombstone.
+	id  string
+	ids []string
+}
+
+// compact rewrites a sealed segment with only its live results, the
+// tombstones that are still needed and a clear record while older segments
+// are left on disk. Sealed segments are never appended to, so while the lock
+// is not held the only changes are results of the segment that die and
+// Clear removing it. The caller must hold compactMu.
+func (s *SegmentStore) compact(seg *segment) error {
+	records, err := readSegment(seg)
+	if err != nil {
+		if s.removed(seg) {
+			return nil
+		}
+		return err
+	}
+
+	hasOlder := false
+	if slices.ContainsFunc(records, func(rec segmentRecord) bool { return rec.typ == recordClear }) {
+		// the clear record is replayed to remove older segments, which may
+		// have been left on disk if removing them failed
+		if hasOlder, err = s.hasSegmentsBefore(seg.id); err != nil {
+			return err
+		}
+	}
+
+	// which results are live and which tombstones still hide results in
+	// older segments; older segments only lose records in the meantime, so
+	// the tombstones stay correct
+	s.mu.RLock()
+	live := map[int64]bool{}
+	needed := map[string]bool{}
+	for _, rec := range records {
+		switch rec.typ {
+		case recordResult:
+			if loc, ok := s.byID[rec.id]; ok && loc.segment == seg.id && loc.offset == rec.offset {
+				live[rec.offset] = true
+			}
+		case recordDelete:
+			for _, id := range rec.ids {
+				if slices.ContainsFunc(s.dead[id], func(d uint64) bool { return d < seg.id }) {
+					needed[id] = true
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	type move struct {
+		id       string
+		from, to int64
+	}
+	var out []byte
+	var moved []move
+	var dropped []string
+	rewritten := &segment{id: seg.id}
+	for _, rec := range records {
+		switch rec.typ {
+		case recordResult:
+			if !live[rec.offset] {
+				dropped = append(dropped, rec.id)
+				continue
+			}
+			r, err := decodeResult(rec.payload)
+			if err != nil {
+				return err
+			}
+			moved = append(moved, move{rec.id, rec.offset, int64(len(out))})
+			indexBlock(rewritten, r, int64(len(out)))
+			out = append(out, encodeRecord(recordResult, rec.payload)...)
+		case recordDelete:
+			ids := slices.DeleteFunc(rec.ids, func(id string) bool { return !needed[id] })
+			if len(ids) > 0 {
+				out = append(out, encodeRecord(recordDelete, encodeIDs(nil, ids))...)
+			}
+		case recordClear:
+			if hasOlder {
+				out = append(out, encodeRecord(recordClear, nil)...)
+			}
+		}
+	}
+
+	var file *os.File
+	if len(out) > 0 {
+		if file, err = s.writeTemp(seg.id, out); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.segmentPath(seg.id)
+	if s.segment(seg.id) != seg {
+		// cleared in the meantime
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return nil
+	}
+	if file == nil {
+		seg.file.Close()
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		s.segments = slices.DeleteFunc(s.segments, func(other *segment) bool { return other == seg })
+	} else {
+		if err := os.Rename(file.Name(), path); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		if err := syncDir(s.dir); err != nil {
+			s.logger.Warn("segment store", "segment", seg.id, "error", err, "msg", "failed to sync directory after compaction")
+		}
+		seg.file.Close()
+
+		rewritten.file = file
+		rewritten.size = int64(len(out))
+		for _, m := range moved {
+			loc, ok := s.byID[m.id]
+			if !ok || loc.segment != seg.id || loc.offset != m.from {
+				// the result died while the segment was rewritten, so it is
+				// a dead record of the new segment, which s.dead already
+				// lists for it
+				rewritten.blocks[blockOf(rewritten, m.to)].live--
+				rewritten.live--
+				continue
+			}
+			loc.offset = m.to
+			loc.block = blockOf(rewritten, m.to)
+			s.byID[m.id] = loc
+		}
+		*seg = *rewritten
+	}
+
+	// every dead record of a result has one entry in s.dead
+	for _, id := range dropped {
+		segs := s.dead[id]
+		if i := slices.Index(segs, seg.id); i >= 0 {
+			segs = slices.Delete(segs, i, i+1)
+		}
+		if len(segs) > 0 {
+			s.dead[id] = segs
+		} else {
+			delete(s.dead, id)
+		}
+	}
+
+	s.compactions++
+	seg.compacted = s.compactions
+	return nil
+}
+
+// readSegment reads all records of a sealed segment.
+func readSegment(seg *segment) ([]segmentRecord, error) {
+	src := io.NewSectionReader(seg.file, 0, seg.size)
+
+	var records []segmentRecord
+	var offset int64
+	for {
+		typ, payload, n, err := readRecord(src)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rec := segmentRecord{typ: typ, payload: payload, offset: offset}
+		switch typ {
+		case recordResult:
+			r, err := decodeResult(payload)
+			if err != nil {
+				return nil, err
+			}
+			rec.id = r.ID
+		case recordDelete:
+			if rec.ids, err = decodeIDs(payload); err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, rec)
+		offset += n
+	}
+}
+
+// removed reports whether the segment is no longer part of the store.
+func (s *SegmentStore) removed(seg *segment) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.segment(seg.id) != seg
+}
+
+// hasSegmentsBefore reports whether segment files older than id are left in
+// the directory.
+func (s *SegmentStore) hasSegmentsBefore(id uint64) (bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if other, err := strconv.ParseUint(name, 10, 64); err == nil && other < id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeTemp writes and syncs the data of a rewritten segment to a temporary
+// file next to it, which is renamed into place once the index is swapped.
+func (s *SegmentStore) writeTemp(id uint64, data []byte) (*os.File, error) {
+	return writeTempFile(s.segmentPath(id), data)
+}
+
+// indexBlock adds a live result at offset to the sparse index of seg.
+func indexBlock(seg *segment, r Result, offset int64) {
+	if n := len(seg.blocks); n == 0 || seg.blocks[n-1].results >= indexInterval {
+		seg.blocks = append(seg.blocks, block{offset: offset, oldest: math.MaxInt64})
+	}
+	b := &seg.blocks[len(seg.blocks)-1]
+	b.results++
+	b.live++
+	b.oldest = min(b.oldest, r.Created.UnixNano())
+	seg.results++
+	seg.live++
+}
+
+func blockOf(seg *segment, offset int64) int {
+	i, found := slices.BinarySearchFunc(seg.blocks, offset, func(b block, offset int64) int {
+		return int(b.offset - offset)
+	})
+	if !found {
+		i--
+	}
+	return i
+}
+
+// Close stops the background work and syncs and closes all segments.
+func (s *SegmentStore) Close() error {
+	close(s.done)
+	<-s.stopped
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.active().file.Sync()
+	return errors.Join(err, s.closeFiles())
+}
+
+func (s *SegmentStore) closeFiles() error {
+	var errs []error
+	for _, seg := range s.segments {
+		errs = append(errs, seg.file.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+func encodeRecord(typ byte, payload []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	record[8] = typ
+	record = append(record, payload...)
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], crcTable))
+	return record
+}
+
+// readRecord reads the next record and returns its type, payload and total
+// size. It returns io.EOF at the end of the data and errCorruptRecord for
+// torn or damaged records.
+func readRecord(r io.Reader) (byte, []byte, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, nil, 0, io.EOF
+		}
+		return 0, nil, 0, fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return 0, nil, 0, fmt.Errorf("%w: size %d", errCorruptRecord, size)
+	}
+
+	data := make([]byte, 1+size)
+	data[0] = header[8]
+	if _, err := io.ReadFull(r, data[1:]); err != nil {
+		return 0, nil, 0, fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, nil, 0, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+	return data[0], data[1:], int64(recordHeaderSize + size), nil
+}
+
+// encodeResult appends the binary encoding of r: strings and lists are
+// length-prefixed with uvarints, the value is stored as IEEE 754 bits and the
+// creation time in Unix nanoseconds.
+func encodeResult(buf []byte, r Result) []byte {
+	buf = appendString(buf, r.ID)
+	buf = appendString(buf, r.Operator)
+	buf = binary.AppendUvarint(buf, uint64(len(r.Operands)))
+	for _, operand := range r.Operands {
+		buf = appendString(buf, string(operand))
+	}
+	buf = binary.AppendVarint(buf, int64(r.Precision))
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(r.Value))
+	buf = appendString(buf, string(r.Raw))
+	buf = appendString(buf, r.Source)
+	buf = appendString(buf, r.Decimal)
+	buf = appendString(buf, r.Expression)
+	buf = appendString(buf, string(r.Mode))
+	return binary.AppendVarint(buf, r.Created.UnixNano())
+}
+
+func decodeResult(data []byte) (Result, error) {
+	d := decoder{data: data}
+	r := Result{
+		ID:       d.string(),
+		Operator: d.string(),
+	}
+	if n := d.uvarint(); n > 0 && n <= uint64(len(data)) {
+		r.Operands = make([]Number, n)
+		for i := range r.Operands {
+			r.Operands[i] = Number(d.string())
+		}
+	}
+	r.Precision = int(d.varint())
+	r.Value = math.Float64frombits(d.uint64())
+	r.Raw = Number(d.string())
+	r.Source = d.string()
+	r.Decimal = d.string()
+	r.Expression = d.string()
+	r.Mode = Mode(d.string())
+	r.Created = time.Unix(0, d.varint()).UTC()
+
+	if d.err != nil || len(d.data) != 0 {
+		return Result{}, fmt.Errorf("%w: invalid result", errCorruptRecord)
+	}
+	return r, nil
+}
+
+func encodeIDs(buf []byte, ids []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(ids)))
+	for _, id := range ids {
+		buf = appendString(buf, id)
+	}
+	return buf
+}
+
+func decodeIDs(data []byte) ([]string, error) {
+	d := decoder{data: data}
+	n := d.uvarint()
+	if n > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: invalid tombstone", errCorruptRecord)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = d.string()
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return nil, fmt.Errorf("%w: invalid tombstone", errCorruptRecord)
+	}
+	return ids, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decoder reads the binary encoding. The first error sticks and makes all
+// further reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil || len(d.data) < 8 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.err = errCorruptRecord
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
@@ -0,0 +1,464 @@
+package calculator
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openSegmentTestStore(t *testing.T, dir string, opts SegmentOptions) *SegmentStore {
+	t.Helper()
+	// compaction is triggered by the tests
+	opts.CompactInterval = time.Hour
+	store, err := NewSegmentStore(slog.New(slog.DiscardHandler), dir, opts)
+	if err != nil {
+		t.Fatalf("NewSegmentStore() error = %v", err)
+	}
+	return store
+}
+
+func segmentIDs(t *testing.T, store getter) string {
+	t.Helper()
+	var ids string
+	for _, r := range mustGet(t, store, Query{Sort: SortOldest, Pagination: Pagination{PageSize: MaxPageSize}}).Result {
+		ids += r.ID
+	}
+	return ids
+}
+
+func TestSegmentStore_Get(t *testing.T) {
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	// small segments, so the results span many segments and blocks
+	store := openSegmentTestStore(t, t.TempDir(), SegmentOptions{SegmentSize: 4096})
+	defer store.Close()
+	reference := NewResultStore()
+
+	for i := range 500 {
+		r := Result{
+			ID:         fmt.Sprintf("%04d", i),
+			Operator:   []string{"addition", "division"}[i%2],
+			Value:      float64(i % 37),
+			Expression: "1 + 2 = 3",
+			Created:    day.Add(time.Duration(i) * time.Minute),
+		}
+		mustStore(t, store, r)
+		mustStore(t, reference, r)
+	}
+	for i := 0; i < 500; i += 3 {
+		id := fmt.Sprintf("%04d", i)
+		if err := store.Delete(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+		if err := reference.Delete(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(store.segments) < 3 {
+		t.Fatalf("results were written to %d segments, want several", len(store.segments))
+	}
+
+	min10 := 10.0
+	queries := []Query{
+		{},
+		{Pagination: Pagination{Page: 3, PageSize: 7}},
+		{Pagination: Pagination{Page: 12, PageSize: 30}},
+		{Sort: SortOldest, Pagination: Pagination{Page: 5, PageSize: 13}},
+		{Pagination: Pagination{Page: 100, PageSize: 10}},
+		{Filter: Filter{Operators: []string{"division"}, Min: &min10}, Pagination: Pagination{Page: 2, PageSize: 10}},
+		{Sort: SortValueDesc, Pagination: Pagination{Page: 1, PageSize: 20}},
+		{Limit: 15},
+	}
+
+	for _, q := range queries {
+		t.Run(fmt.Sprintf("%+v", q), func(t *testing.T) {
+			got := mustGet(t, store, q)
+			want := mustGet(t, reference, q)
+			want.Snapshot = ""
+			if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+				t.Errorf("Get() metadata = %+v, want %+v", got.Metadata, want.Metadata)
+			}
+			if len(got.Result) != len(want.Result) {
+				t.Fatalf("Get() returned %d results, want %d", len(got.Result), len(want.Result))
+			}
+			for i := range got.Result {
+				if got.Result[i].ID != want.Result[i].ID {
+					t.Fatalf("Get() result %d = %q, want %q", i, got.Result[i].ID, want.Result[i].ID)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentStore_Recover(t *testing.T) {
+	dir := t.TempDir()
+	full := Result{
+		ID:         "a",
+		Operator:   "division",
+		Operands:   []Number{"1.00", "-3"},
+		Precision:  2,
+		Value:      -1.0 / 3,
+		Raw:        "-0.3333333333",
+		Source:     "api",
+		Decimal:    "-0.33",
+		Expression: "1.00 / -3 = -0.33",
+		Mode:       ModeDecimal,
+		Created:    time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC),
+	}
+
+	store := openSegmentTestStore(t, dir, SegmentOptions{})
+	if err := store.StoreMany(t.Context(), []Result{{ID: "b"}, {ID: "c"}, {ID: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, full)
+	if err := store.Delete(t.Context(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Evict(t.Context(), RetentionPolicy{MaxCount: 2}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "e"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{})
+	if got := segmentIDs(t, store); got != "dae" {
+		t.Errorf("recovered %q, want %q", got, "dae")
+	}
+	got, err := store.Find(t.Context(), "a")
+	if err != nil {
+		t.Fatalf("Find() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, full) {
+		t.Errorf("Find() = %+v, want %+v", got, full)
+	}
+
+	if n, err := store.Clear(t.Context()); err != nil || n != 3 {
+		t.Fatalf("Clear() = %d, %v, want 3", n, err)
+	}
+	mustStore(t, store, Result{ID: "f"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{})
+	defer store.Close()
+	if got := segmentIDs(t, store); got != "f" {
+		t.Errorf("recovered %q after clear, want %q", got, "f")
+	}
+	if len(store.segments) != 1 {
+		t.Errorf("%d segments left after clear, want 1", len(store.segments))
+	}
+}
+
+func TestSegmentStore_TornWrite(t *testing.T) {
+	record := func(id string) []byte {
+		return encodeRecord(recordResult, encodeResult(nil, Result{ID: id}))
+	}
+	corrupted := record("c")
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{name: "partial header", tail: record("c")[:5]},
+		{name: "partial payload", tail: record("c")[:15]},
+		{name: "checksum mismatch", tail: corrupted},
+		{name: "huge length", tail: []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, recordResult}},
+		{name: "intact record after a corrupted one", tail: append(corrupted, record("c")...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openSegmentTestStore(t, dir, SegmentOptions{})
+			mustStore(t, store, Result{ID: "a"}, Result{ID: "b"})
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, "0000000000000001.seg")
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tt.tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			store = openSegmentTestStore(t, dir, SegmentOptions{})
+			if got := segmentIDs(t, store); got != "ab" {
+				t.Errorf("recovered %q, want %q", got, "ab")
+			}
+			mustStore(t, store, Result{ID: "d"})
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store = openSegmentTestStore(t, dir, SegmentOptions{})
+			defer store.Close()
+			if got := segmentIDs(t, store); got != "abd" {
+				t.Errorf("recovered %q after append, want %q", got, "abd")
+			}
+		})
+	}
+}
+
+func TestSegmentStore_CorruptedSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	store := openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1})
+	mustStore(t, store, Result{ID: "a"})
+	mustStore(t, store, Result{ID: "b"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "0000000000000001.seg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSegmentStore(slog.New(slog.DiscardHandler), dir, SegmentOptions{}); err == nil {
+		t.Error("NewSegmentStore() opened a corrupted sealed segment")
+	}
+}
+
+func TestSegmentStore_Compact(t *testing.T) {
+	dir := t.TempDir()
+	// every result seals its segment
+	store := openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1})
+
+	mustStore(t, store, Result{ID: "a"}, Result{ID: "b"})
+	mustStore(t, store, Result{ID: "c"})
+	// "a" is stored again, so an older copy stays on disk
+	mustStore(t, store, Result{ID: "a"})
+	if err := store.Delete(t.Context(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(t.Context(), "c"); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "d"})
+
+	before := len(store.segments)
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if len(store.segments) >= before {
+		t.Errorf("Compact() left %d of %d segments", len(store.segments), before)
+	}
+	if got := segmentIDs(t, store); got != "bd" {
+		t.Errorf("got %q after compaction, want %q", got, "bd")
+	}
+	if len(store.dead) != 0 {
+		t.Errorf("dead results left after compaction: %v", store.dead)
+	}
+
+	// a second pass has nothing left to do
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	mustStore(t, store, Result{ID: "e"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{})
+	defer store.Close()
+	if got := segmentIDs(t, store); got != "bde" {
+		t.Errorf("recovered %q after compaction, want %q", got, "bde")
+	}
+}
+
+func TestSegmentStore_CompactKeepsNeededTombstones(t *testing.T) {
+	dir := t.TempDir()
+	store := openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1, CompactRatio: 0.9})
+
+	// a segment with "a" and three live results is below the ratio
+	mustStore(t, store, Result{ID: "a"}, Result{ID: "b"}, Result{ID: "c"}, Result{ID: "d"})
+	if err := store.Delete(t.Context(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "e"})
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{})
+	defer store.Close()
+	if got := segmentIDs(t, store); got != "bcde" {
+		t.Errorf("recovered %q, want %q", got, "bcde")
+	}
+}
+
+func TestSegmentStore_CompactKeepsClearRecord(t *testing.T) {
+	dir := t.TempDir()
+	store := openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1})
+
+	mustStore(t, store, Result{ID: "a"})
+	stale := store.segmentPath(store.segments[0].id)
+	data, err := os.ReadFile(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Clear(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// removing the segment failed, so only the clear record hides it
+	if err := os.WriteFile(stale, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "b"}, Result{ID: "c"})
+	if err := store.Delete(t.Context(), "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1})
+	if got := segmentIDs(t, store); got != "b" {
+		t.Errorf("recovered %q, want %q", got, "b")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale segment left after replaying the clear record: %v", err)
+	}
+
+	// without older segments the clear record is dropped
+	if err := store.Delete(t.Context(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if len(store.segments) != 1 {
+		t.Errorf("%d segments left, want only the active one", len(store.segments))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSegmentStore_CompactConcurrently deletes and stores results while
+// segments are rewritten, so results die during a rewrite.
+func TestSegmentStore_CompactConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	store := openSegmentTestStore(t, dir, SegmentOptions{SegmentSize: 1, Sync: SyncNever})
+
+	for i := range 100 {
+		mustStore(t, store, Result{ID: fmt.Sprintf("%03d", 2*i)}, Result{ID: fmt.Sprintf("%03d", 2*i+1)})
+	}
+
+	done := make(chan struct{})
+	compacted := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				compacted <- nil
+				return
+			default:
+			}
+			if err := store.Compact(); err != nil {
+				compacted <- err
+				return
+			}
+		}
+	}()
+
+	var want []string
+	for i := range 200 {
+		id := fmt.Sprintf("%03d", i)
+		if i%2 == 0 || i%3 == 0 {
+			if err := store.Delete(t.Context(), id); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want = append(want, id)
+	}
+	mustStore(t, store, Result{ID: "new"})
+	want = append(want, "new")
+	// more results than fit on a page
+	check := func(store *SegmentStore) {
+		t.Helper()
+		if n := store.Len(); n != len(want) {
+			t.Errorf("Len() = %d, want %d", n, len(want))
+		}
+		for _, id := range want {
+			if _, err := store.Find(t.Context(), id); err != nil {
+				t.Errorf("Find(%s) error = %v", id, err)
+			}
+		}
+	}
+	close(done)
+	if err := <-compacted; err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	check(store)
+	if len(store.dead) != 0 {
+		t.Errorf("dead results left after compaction: %v", store.dead)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openSegmentTestStore(t, dir, SegmentOptions{})
+	defer store.Close()
+	check(store)
+}
+
+func BenchmarkSegmentStore_Get(b *testing.B) {
+	store, err := NewSegmentStore(slog.New(slog.DiscardHandler), b.TempDir(), SegmentOptions{Sync: SyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	results := make([]Result, 100_000)
+	for i := range results {
+		results[i] = benchmarkResult(i)
+	}
+	if err := store.StoreMany(b.Context(), results); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name string
+		q    Query
+	}{
+		{name: "newest", q: Query{Pagination: Pagination{Page: 1, PageSize: 10}}},
+		{name: "deep", q: Query{Pagination: Pagination{Page: 5000, PageSize: 10}}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := store.Get(b.Context(), bm.q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package calculator
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
 	"math"
+	"math/big"
 	"strconv"
 	"time"
 )
@@ -12,64 +16,356 @@ var (
 	ErrDivByZero = errors.New("division by zero")
 	ErrOverflow  = errors.New("result is infinite (overflow)")
 	ErrNaN       = errors.New("result is not a number (NaN)")
+
+	ErrModuloByZero     = errors.New("modulo by zero")
+	ErrComplexPower     = errors.New("negative base with a non-integer exponent")
+	ErrRootDegree       = errors.New("root degree must not be zero")
+	ErrNegativeRadicand = errors.New("root of a negative number requires an odd integer degree")
+	ErrLogDomain        = errors.New("logarithm of a non-positive number")
+	ErrLogBase          = errors.New("logarithm base must be positive and not 1")
+
+	// ErrStorage wraps errors of the store, as opposed to errors caused by
+	// the request.
+	ErrStorage = errors.New("storage failure")
 )
 
 type storer interface {
-	Store(Result)
+	Store(ctx context.Context, result Result) error
+}
+
+// batchStorer is implemented by stores that can store many results at once
+// more efficiently than one by one.
+type batchStorer interface {
+	StoreMany(ctx context.Context, results []Result) error
 }
 
 type Service struct {
-	precision int
-	saver     storer
+	precision  int
+	saver      storer
+	operations *Registry
+	metrics    *Metrics
 }
 
 func NewService(precision int, saver storer) *Service {
+	return NewServiceWithOperations(precision, saver, DefaultOperations(), nil)
+}
+
+// NewServiceWithOperations returns a service for the operations that counts
+// its calculations in metrics, unless it is nil.
+func NewServiceWithOperations(precision int, saver storer, operations *Registry, metrics *Metrics) *Service {
 	return &Service{
 		precision,
 		saver,
+		operations,
+		metrics,
+	}
+}
+
+func (s *Service) Operations() *Registry {
+	return s.operations
+}
+
+func (s *Service) Add(ctx context.Context, a, b float64) (Result, error) {
+	return s.calc(ctx, "+", a, b)
+}
+
+func (s *Service) Sub(ctx context.Context, a, b float64) (Result, error) {
+	return s.calc(ctx, "-", a, b)
+}
+
+func (s *Service) Mul(ctx context.Context, a, b float64) (Result, error) {
+	return s.calc(ctx, "*", a, b)
+}
+
+func (s *Service) Div(ctx context.Context, a, b float64) (Result, error) {
+	return s.calc(ctx, "/", a, b)
+}
+
+// Calculate applies the operation with the given name or symbol to the
+// operands in the given mode.
+func (s *Service) Calculate(ctx context.Context, mode Mode, operation string, operands ...Number) (_ Result, err error) {
+	ctx, span := web.StartSpan(ctx, "Service.Calculate", slog.String("operation", operation), slog.String("mode", string(mode)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	_, computeSpan := web.StartSpan(ctx, "Service.compute")
+	res, err := s.compute(mode, operation, operands)
+	computeSpan.End()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := s.store(ctx, res); err != nil {
+		return Result{}, err
+	}
+	return res, nil
+}
+
+type BatchItem struct {
+	Operation string
+	Operands  []Number
+}
+
+type BatchResult struct {
+	Result Result
+	Err    error
+}
+
+// CalculateBatch calculates all items independently and returns their
+// results in the same order. Failed items do not affect the others. If
+// atomic is set, results are only stored if every item succeeded. It
+// returns the number of stored results. An error is only returned if the
+// results could not be stored.
+func (s *Service) CalculateBatch(ctx context.Context, mode Mode, items []BatchItem, atomic bool) (_ []BatchResult, _ int, err error) {
+	ctx, span := web.StartSpan(ctx, "Service.CalculateBatch", slog.Int("items", len(items)), slog.String("mode", string(mode)), slog.Bool("atomic", atomic))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	results := make([]BatchResult, len(items))
+	succeeded := make([]Result, 0, len(items))
+
+	_, computeSpan := web.StartSpan(ctx, "Service.compute")
+	for i, item := range items {
+		res, err := s.compute(mode, item.Operation, item.Operands)
+		results[i] = BatchResult{Result: res, Err: err}
+		if err == nil {
+			succeeded = append(succeeded, res)
+		}
+	}
+	computeSpan.SetAttributes(slog.Int("succeeded", len(succeeded)))
+	computeSpan.End()
+
+	if atomic && len(succeeded) != len(items) {
+		return results, 0, nil
+	}
+
+	if bs, ok := s.saver.(batchStorer); ok {
+		if err := bs.StoreMany(ctx, succeeded); err != nil {
+			return nil, 0, fmt.Errorf("%w: %w", ErrStorage, err)
+		}
+		return results, len(succeeded), nil
+	}
+
+	for i, res := range succeeded {
+		if err := s.store(ctx, res); err != nil {
+			return nil, i, err
+		}
+	}
+	return results, len(succeeded), nil
+}
+
+// compute calculates a result without storing it.
+func (s *Service) compute(mode Mode, operation string, operands []Number) (_ Result, err error) {
+	op, err := s.operations.Lookup(operation)
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() {
+		s.metrics.calculated(op.Name, mode, err)
+	}()
+
+	if mode == ModeDecimal {
+		args := make([]*big.Rat, len(operands))
+		formatted := make([]string, len(operands))
+		for i, operand := range operands {
+			x, ok := operand.Rat()
+			if !ok {
+				return Result{}, fmt.Errorf("invalid number %q", operand)
+			}
+			args[i] = x
+			formatted[i] = formatDecimal(x, s.precision)
+		}
+
+		result, err := op.evalDecimal(args)
+		if err != nil {
+			return Result{}, err
+		}
+
+		res, err := s.decimalResult(result, op.format(formatted))
+		if err != nil {
+			return Result{}, err
+		}
+		res.Operator = op.Name
+		res.Operands = append([]Number(nil), operands...)
+		return res, nil
 	}
+
+	args := make([]float64, len(operands))
+	for i, operand := range operands {
+		args[i] = operand.Float64()
+	}
+
+	res, err := s.floatResult(op, args)
+	if err != nil {
+		return Result{}, err
+	}
+	res.Operands = append([]Number(nil), operands...)
+	return res, nil
 }
 
-func (s *Service) Add(a, b float64) (Result, error) {
-	return s.calc(a, b, a+b, "+")
+// Evaluate parses and evaluates a free-form arithmetic expression and stores
+// a single result for it, using the normalized form of the expression.
+func (s *Service) Evaluate(ctx context.Context, mode Mode, expression string) (_ Result, err error) {
+	ctx, span := web.StartSpan(ctx, "Service.Evaluate", slog.String("mode", string(mode)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	_, evalSpan := web.StartSpan(ctx, "Service.evaluate")
+	res, err := s.evaluate(mode, expression)
+	evalSpan.End()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := s.store(ctx, res); err != nil {
+		return Result{}, err
+	}
+	return res, nil
 }
 
-func (s *Service) Sub(a, b float64) (Result, error) {
-	return s.calc(a, b, a-b, "-")
+func (s *Service) store(ctx context.Context, res Result) error {
+	ctx, span := web.StartSpan(ctx, "Service.store")
+	defer span.End()
+
+	if err := s.saver.Store(ctx, res); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("%w: %w", ErrStorage, err)
+	}
+	return nil
 }
 
-func (s *Service) Mul(a, b float64) (Result, error) {
-	return s.calc(a, b, a*b, "*")
+func (s *Service) evaluate(mode Mode, expression string) (_ Result, err error) {
+	ast, err := parseExpression(expression, s.operations)
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() {
+		s.metrics.calculated(OperatorExpression, mode, err)
+	}()
+
+	var res Result
+	if mode == ModeDecimal {
+		result, err := ast.evalDecimal()
+		if err != nil {
+			return Result{}, err
+		}
+
+		res, err = s.decimalResult(result, ast.String())
+		if err != nil {
+			return Result{}, err
+		}
+	} else {
+		result, err := ast.eval()
+		if err != nil {
+			return Result{}, err
+		}
+		if err := validateFloat(result); err != nil {
+			return Result{}, err
+		}
+		res = s.round(result, ast.String())
+	}
+
+	res.Operator = OperatorExpression
+	res.Source = ast.String()
+	return res, nil
 }
 
-func (s *Service) Div(a, b float64) (Result, error) {
-	if b == 0 {
-		return Result{}, ErrDivByZero
+func (s *Service) calc(ctx context.Context, operation string, args ...float64) (_ Result, err error) {
+	ctx, span := web.StartSpan(ctx, "Service.calc", slog.String("operation", operation))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	op, err := s.operations.Lookup(operation)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res, err := s.floatResult(op, args)
+	s.metrics.calculated(op.Name, ModeFloat, err)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := s.store(ctx, res); err != nil {
+		return Result{}, err
 	}
-	return s.calc(a, b, a/b, "/")
+	return res, nil
 }
 
-func (s *Service) calc(a, b, result float64, op string) (Result, error) {
-	if err := validateFloat(result); err != nil {
+func (s *Service) floatResult(op *Operation, args []float64) (Result, error) {
+	result, err := op.evalFloat(args)
+	if err != nil {
 		return Result{}, err
 	}
 
+	formatted := make([]string, len(args))
+	operands := make([]Number, len(args))
+	for i, arg := range args {
+		formatted[i] = fmt.Sprintf(s.format(), arg)
+		operands[i] = floatNumber(arg)
+	}
+
+	res := s.round(result, op.format(formatted))
+	res.Operator = op.Name
+	res.Operands = operands
+	return res, nil
+}
+
+// round rounds the result to the configured precision and renders the
+// expression. lhs is the left-hand side of the rendered expression.
+func (s *Service) round(result float64, lhs string) Result {
+	raw := result
 	scale := math.Pow10(s.precision)
 	result = math.Round(result*scale) / scale
 
-	format := "%." + strconv.Itoa(s.precision) + "f"
-	expr := fmt.Sprintf(format+" %s "+format+" = "+format, a, op, b, result)
-
 	res := Result{
+		ID:         newID(),
+		Precision:  s.precision,
 		Value:      result,
-		Expression: expr,
+		Raw:        floatNumber(raw),
+		Expression: fmt.Sprintf("%s = "+s.format(), lhs, result),
+		Mode:       ModeFloat,
 		Created:    time.Now(),
 	}
+	return res
+}
+
+// decimalResult is the ModeDecimal counterpart of round. The rounded result
+// is kept as exact digits in Result.Decimal; Value holds the nearest float64.
+func (s *Service) decimalResult(result *big.Rat, lhs string) (Result, error) {
+	// FloatString rounds halves away from zero, like math.Round in round
+	digits := result.FloatString(s.precision)
+
+	value, _ := strconv.ParseFloat(digits, 64)
+	if err := validateFloat(value); err != nil {
+		return Result{}, err
+	}
 
-	s.saver.Store(res)
+	res := Result{
+		ID:         newID(),
+		Precision:  s.precision,
+		Value:      value,
+		Raw:        rawDecimal(result),
+		Decimal:    digits,
+		Expression: lhs + " = " + digits,
+		Mode:       ModeDecimal,
+		Created:    time.Now(),
+	}
 	return res, nil
 }
 
+func (s *Service) format() string {
+	return "%." + strconv.Itoa(s.precision) + "f"
+}
+
 func validateFloat(val float64) error {
 	if math.IsNaN(val) {
 		return ErrNaN
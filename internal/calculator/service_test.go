@@ -1,7 +1,9 @@
 package calculator
 
 import (
+	"errors"
 	"math"
+	"strings"
 	"testing"
 )
 
@@ -88,7 +90,7 @@ func TestCalculator_Add(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := NewService(tt.precision, NewResultStore())
-			got, err := c.Add(tt.a, tt.b)
+			got, err := c.Add(t.Context(), tt.a, tt.b)
 
 			if tt.wantErr != nil {
 				if err == nil || err.Error() != tt.wantErr.Error() {
@@ -196,7 +198,7 @@ func TestCalculator_Subtract(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := NewService(tt.precision, NewResultStore())
-			got, err := c.Sub(tt.a, tt.b)
+			got, err := c.Sub(t.Context(), tt.a, tt.b)
 
 			if tt.wantErr != nil {
 				if err == nil || err.Error() != tt.wantErr.Error() {
@@ -313,7 +315,7 @@ func TestCalculator_Multiply(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := NewService(tt.precision, NewResultStore())
-			got, err := c.Mul(tt.a, tt.b)
+			got, err := c.Mul(t.Context(), tt.a, tt.b)
 
 			if tt.wantErr != nil {
 				if err == nil || err.Error() != tt.wantErr.Error() {
@@ -426,7 +428,7 @@ func TestCalculator_Divide(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := NewService(tt.precision, NewResultStore())
-			got, err := c.Div(tt.a, tt.b)
+			got, err := c.Div(t.Context(), tt.a, tt.b)
 
 			if tt.wantErr != nil {
 				if err == nil || err.Error() != tt.wantErr.Error() {
@@ -450,3 +452,644 @@ func TestCalculator_Divide(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculator_Evaluate(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		precision  int
+		wantValue  float64
+		wantExpr   string
+		wantErr    string
+	}{
+		{
+			name:       "precedence",
+			expression: "1 + 2 * 3",
+			precision:  2,
+			wantValue:  7,
+			wantExpr:   "1 + 2 * 3 = 7.00",
+		},
+		{
+			name:       "parentheses",
+			expression: "(3 + 4) * 2 / 7",
+			precision:  4,
+			wantValue:  2,
+			wantExpr:   "(3 + 4) * 2 / 7 = 2.0000",
+		},
+		{
+			name:       "left associativity",
+			expression: "10 - 4 - 3",
+			precision:  0,
+			wantValue:  3,
+			wantExpr:   "10 - 4 - 3 = 3",
+		},
+		{
+			name:       "right operand keeps parentheses",
+			expression: "10-(4-3)",
+			precision:  0,
+			wantValue:  9,
+			wantExpr:   "10 - (4 - 3) = 9",
+		},
+		{
+			name:       "redundant parentheses are removed",
+			expression: "((1.5)) + (2 * 3)",
+			precision:  1,
+			wantValue:  7.5,
+			wantExpr:   "1.5 + 2 * 3 = 7.5",
+		},
+		{
+			name:       "unary minus",
+			expression: "-(2 + 3) * -2",
+			precision:  0,
+			wantValue:  10,
+			wantExpr:   "-(2 + 3) * -2 = 10",
+		},
+		{
+			name:       "exponent notation",
+			expression: "1e3 / 8",
+			precision:  3,
+			wantValue:  125,
+			wantExpr:   "1e3 / 8 = 125.000",
+		},
+		{
+			name:       "rounding to precision",
+			expression: "2 / 3",
+			precision:  2,
+			wantValue:  0.67,
+			wantExpr:   "2 / 3 = 0.67",
+		},
+		{
+			name:       "power is right-associative",
+			expression: "2 ^ 3 ^ 2",
+			precision:  0,
+			wantValue:  512,
+			wantExpr:   "2 ^ 3 ^ 2 = 512",
+		},
+		{
+			name:       "power binds tighter than unary minus",
+			expression: "-2^2 + (-2)^2",
+			precision:  0,
+			wantValue:  0,
+			wantExpr:   "-2 ^ 2 + (-2) ^ 2 = 0",
+		},
+		{
+			name:       "modulo",
+			expression: "7 % 4 * 2",
+			precision:  0,
+			wantValue:  6,
+			wantExpr:   "7 % 4 * 2 = 6",
+		},
+		{
+			name:       "function calls",
+			expression: "max(1, root(27, 3), abs(-2)) + log(8,2)",
+			precision:  2,
+			wantValue:  6,
+			wantExpr:   "max(1, root(27, 3), abs(-2)) + log(8, 2) = 6.00",
+		},
+		{
+			name:       "domain error in function call",
+			expression: "root(-4, 2)",
+			precision:  2,
+			wantErr:    ErrNegativeRadicand.Error(),
+		},
+		{
+			name:       "unknown function",
+			expression: "1 + sqrt(4)",
+			precision:  2,
+			wantErr:    "parse error at position 5: unknown function \"sqrt\"",
+		},
+		{
+			name:       "wrong number of arguments",
+			expression: "abs(1, 2)",
+			precision:  2,
+			wantErr:    "parse error at position 1: wrong number of operands: absolute expects 1, got 2",
+		},
+		{
+			name:       "division by zero",
+			expression: "1 / (2 - 2)",
+			precision:  2,
+			wantErr:    ErrDivByZero.Error(),
+		},
+		{
+			name:       "overflow",
+			expression: "1e308 * 10",
+			precision:  2,
+			wantErr:    ErrOverflow.Error(),
+		},
+		{
+			name:       "empty expression",
+			expression: "   ",
+			precision:  2,
+			wantErr:    "parse error at position 4: empty expression",
+		},
+		{
+			name:       "unexpected character",
+			expression: "2 + $",
+			precision:  2,
+			wantErr:    "parse error at position 5: unexpected character '$'",
+		},
+		{
+			name:       "missing operand",
+			expression: "2 *",
+			precision:  2,
+			wantErr:    "parse error at position 4: expected number or \"(\", found end of expression",
+		},
+		{
+			name:       "unbalanced parentheses",
+			expression: "(1 + 2",
+			precision:  2,
+			wantErr:    "parse error at position 7: expected \")\" to close \"(\" at position 1, found end of expression",
+		},
+		{
+			name:       "trailing tokens",
+			expression: "(1 + 2))",
+			precision:  2,
+			wantErr:    "parse error at position 8: unexpected \")\"",
+		},
+		{
+			name:       "invalid number",
+			expression: "1.2.3 + 1",
+			precision:  2,
+			wantErr:    "parse error at position 1: invalid number \"1.2.3\"",
+		},
+		{
+			name:       "nested too deeply",
+			expression: strings.Repeat("(", MaxExpressionDepth) + "1" + strings.Repeat(")", MaxExpressionDepth),
+			precision:  2,
+			wantErr:    "parse error at position 257: expression is nested deeper than 256 levels",
+		},
+		{
+			name:       "signs nested too deeply",
+			expression: strings.Repeat("-", MaxExpressionDepth) + "1",
+			precision:  2,
+			wantErr:    "parse error at position 257: expression is nested deeper than 256 levels",
+		},
+		{
+			name:       "maximum depth",
+			expression: strings.Repeat("(", MaxExpressionDepth-1) + "1" + strings.Repeat(")", MaxExpressionDepth-1),
+			precision:  2,
+			wantValue:  1,
+			wantExpr:   "1 = 1.00",
+		},
+		{
+			name:       "too long",
+			expression: strings.Repeat("1+", MaxExpressionLength/2) + "1",
+			precision:  2,
+			wantErr:    "parse error at position 4097: expression is longer than 4096 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewService(tt.precision, NewResultStore())
+			got, err := c.Evaluate(t.Context(), ModeFloat, tt.expression)
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Evaluate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if got.Value != tt.wantValue {
+				t.Errorf("Evaluate() got value = %v, want %v", got.Value, tt.wantValue)
+			}
+
+			if got.Expression != tt.wantExpr {
+				t.Errorf("Evaluate() got expression = %q, want %q", got.Expression, tt.wantExpr)
+			}
+		})
+	}
+}
+
+func TestCalculator_EvaluateDecimalSize(t *testing.T) {
+	c := NewService(2, NewResultStore())
+	if _, err := c.Evaluate(t.Context(), ModeDecimal, "9^200000 - 9^200000"); err != nil {
+		t.Fatalf("Evaluate() of powers below the limit error = %v", err)
+	}
+	// every power is below the limit, but their product is not
+	for _, expression := range []string{
+		"(9^200000) * (9^200000)",
+		"1 / 9^200000 / 9^200000",
+		"9^200000 * 9^200000 * 9^200000",
+	} {
+		if _, err := c.Evaluate(t.Context(), ModeDecimal, expression); !errors.Is(err, ErrOverflow) {
+			t.Errorf("Evaluate(%q) error = %v, want ErrOverflow", expression, err)
+		}
+	}
+}
+
+func TestCalculator_CalculateDecimal(t *testing.T) {
+	tests := []struct {
+		name      string
+		a         Number
+		b         Number
+		op        string
+		precision int
+		wantValue string
+		wantExpr  string
+		wantErr   error
+	}{
+		{
+			name:      "exact addition",
+			a:         "0.1",
+			b:         "0.2",
+			op:        "+",
+			precision: 20,
+			wantValue: "0.30000000000000000000",
+			wantExpr:  "0.10000000000000000000 + 0.20000000000000000000 = 0.30000000000000000000",
+		},
+		{
+			name:      "operands keep all digits",
+			a:         "1.23456",
+			b:         "2",
+			op:        "*",
+			precision: 2,
+			wantValue: "2.47",
+			wantExpr:  "1.23456 * 2.00 = 2.47",
+		},
+		{
+			name:      "large integers",
+			a:         "12345678901234567890",
+			b:         "1",
+			op:        "+",
+			precision: 0,
+			wantValue: "12345678901234567891",
+			wantExpr:  "12345678901234567890 + 1 = 12345678901234567891",
+		},
+		{
+			name:      "rounds half away from zero",
+			a:         "-1",
+			b:         "8",
+			op:        "/",
+			precision: 2,
+			wantValue: "-0.13",
+			wantExpr:  "-1.00 / 8.00 = -0.13",
+		},
+		{
+			name:      "exponent notation",
+			a:         "1e-3",
+			b:         "1E3",
+			op:        "-",
+			precision: 1,
+			wantValue: "-1000.0",
+			wantExpr:  "0.001 - 1000.0 = -1000.0",
+		},
+		{
+			name:      "division by zero",
+			a:         "1",
+			b:         "0.0",
+			op:        "/",
+			precision: 2,
+			wantErr:   ErrDivByZero,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewService(tt.precision, NewResultStore())
+			got, err := c.Calculate(t.Context(), ModeDecimal, tt.op, tt.a, tt.b)
+
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Errorf("Calculate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if got.Decimal != tt.wantValue {
+				t.Errorf("Calculate() got value = %v, want %v", got.Decimal, tt.wantValue)
+			}
+
+			if got.Expression != tt.wantExpr {
+				t.Errorf("Calculate() got expression = %q, want %q", got.Expression, tt.wantExpr)
+			}
+		})
+	}
+}
+
+func TestCalculator_Calculate(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		operands  []Number
+		mode      Mode
+		precision int
+		wantExpr  string
+		wantErr   error
+	}{
+		{
+			name:      "power",
+			operation: "power",
+			operands:  []Number{"2", "10"},
+			precision: 0,
+			wantExpr:  "2 ^ 10 = 1024",
+		},
+		{
+			name:      "power of zero with negative exponent",
+			operation: "power",
+			operands:  []Number{"0", "-1"},
+			wantErr:   ErrDivByZero,
+		},
+		{
+			name:      "negative base with fractional exponent",
+			operation: "power",
+			operands:  []Number{"-8", "0.5"},
+			wantErr:   ErrComplexPower,
+		},
+		{
+			name:      "exact decimal power",
+			operation: "power",
+			operands:  []Number{"1.1", "-2"},
+			mode:      ModeDecimal,
+			precision: 6,
+			wantExpr:  "1.100000 ^ -2.000000 = 0.826446",
+		},
+		{
+			name:      "modulo keeps the sign of the dividend",
+			operation: "%",
+			operands:  []Number{"-7", "3"},
+			precision: 1,
+			wantExpr:  "-7.0 % 3.0 = -1.0",
+		},
+		{
+			name:      "decimal modulo",
+			operation: "modulo",
+			operands:  []Number{"5.5", "0.2"},
+			mode:      ModeDecimal,
+			precision: 2,
+			wantExpr:  "5.50 % 0.20 = 0.10",
+		},
+		{
+			name:      "modulo by zero",
+			operation: "modulo",
+			operands:  []Number{"1", "0"},
+			wantErr:   ErrModuloByZero,
+		},
+		{
+			name:      "odd root of a negative number",
+			operation: "root",
+			operands:  []Number{"-27", "3"},
+			precision: 2,
+			wantExpr:  "root(-27.00, 3.00) = -3.00",
+		},
+		{
+			name:      "even root of a negative number",
+			operation: "root",
+			operands:  []Number{"-16", "4"},
+			wantErr:   ErrNegativeRadicand,
+		},
+		{
+			name:      "zero root degree",
+			operation: "root",
+			operands:  []Number{"16", "0"},
+			wantErr:   ErrRootDegree,
+		},
+		{
+			name:      "logarithm",
+			operation: "logarithm",
+			operands:  []Number{"1000", "10"},
+			precision: 2,
+			wantExpr:  "log(1000.00, 10.00) = 3.00",
+		},
+		{
+			name:      "logarithm of zero",
+			operation: "logarithm",
+			operands:  []Number{"0", "10"},
+			wantErr:   ErrLogDomain,
+		},
+		{
+			name:      "logarithm base one",
+			operation: "logarithm",
+			operands:  []Number{"10", "1"},
+			wantErr:   ErrLogBase,
+		},
+		{
+			name:      "logarithm in decimal mode",
+			operation: "logarithm",
+			operands:  []Number{"10", "10"},
+			mode:      ModeDecimal,
+			wantErr:   ErrDecimalMode,
+		},
+		{
+			name:      "minimum",
+			operation: "min",
+			operands:  []Number{"3", "-1.5", "2"},
+			precision: 1,
+			wantExpr:  "min(3.0, -1.5, 2.0) = -1.5",
+		},
+		{
+			name:      "maximum",
+			operation: "maximum",
+			operands:  []Number{"0.1", "0.3", "0.2"},
+			mode:      ModeDecimal,
+			precision: 1,
+			wantExpr:  "max(0.1, 0.3, 0.2) = 0.3",
+		},
+		{
+			name:      "maximum without operands",
+			operation: "maximum",
+			wantErr:   ErrArity,
+		},
+		{
+			name:      "absolute value",
+			operation: "absolute",
+			operands:  []Number{"-4.25"},
+			precision: 2,
+			wantExpr:  "abs(-4.25) = 4.25",
+		},
+		{
+			name:      "unknown operation",
+			operation: "factorial",
+			operands:  []Number{"3"},
+			wantErr:   ErrUnknownOperation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := tt.mode
+			if mode == "" {
+				mode = ModeFloat
+			}
+
+			c := NewService(tt.precision, NewResultStore())
+			got, err := c.Calculate(t.Context(), mode, tt.operation, tt.operands...)
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Calculate() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if got.Expression != tt.wantExpr {
+				t.Errorf("Calculate() got expression = %q, want %q", got.Expression, tt.wantExpr)
+			}
+		})
+	}
+}
+
+func TestCalculator_CalculateBatch(t *testing.T) {
+	items := []BatchItem{
+		{Operation: "addition", Operands: []Number{"1", "2"}},
+		{Operation: "division", Operands: []Number{"1", "0"}},
+		{Operation: "multiplication", Operands: []Number{"1e308", "10"}},
+		{Operation: "*", Operands: []Number{"2", "3"}},
+	}
+
+	tests := []struct {
+		name       string
+		atomic     bool
+		wantStored int
+	}{
+		{
+			name:       "failed items do not fail the batch",
+			atomic:     false,
+			wantStored: 2,
+		},
+		{
+			name:       "atomic batch stores nothing if an item failed",
+			atomic:     true,
+			wantStored: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewResultStore()
+			c := NewService(2, store)
+			results, stored, err := c.CalculateBatch(t.Context(), ModeFloat, items, tt.atomic)
+			if err != nil {
+				t.Fatalf("CalculateBatch() error = %v", err)
+			}
+
+			if len(results) != len(items) {
+				t.Fatalf("CalculateBatch() got %d results, want %d", len(results), len(items))
+			}
+			if results[0].Err != nil || results[0].Result.Expression != "1.00 + 2.00 = 3.00" {
+				t.Errorf("CalculateBatch() item 0 = %q, %v", results[0].Result.Expression, results[0].Err)
+			}
+			if !errors.Is(results[1].Err, ErrDivByZero) {
+				t.Errorf("CalculateBatch() item 1 error = %v, want %v", results[1].Err, ErrDivByZero)
+			}
+			if !errors.Is(results[2].Err, ErrOverflow) {
+				t.Errorf("CalculateBatch() item 2 error = %v, want %v", results[2].Err, ErrOverflow)
+			}
+			if results[3].Err != nil || results[3].Result.Value != 6 {
+				t.Errorf("CalculateBatch() item 3 = %v, %v", results[3].Result.Value, results[3].Err)
+			}
+
+			if stored != tt.wantStored {
+				t.Errorf("CalculateBatch() stored = %d, want %d", stored, tt.wantStored)
+			}
+			got := mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: MaxPageSize}})
+			if got.TotalRecords != tt.wantStored {
+				t.Errorf("store has %d results, want %d", got.TotalRecords, tt.wantStored)
+			}
+			if tt.wantStored > 0 && got.Result[0].Value != 6 {
+				t.Errorf("most recent result = %v, want the last batch item", got.Result[0].Value)
+			}
+		})
+	}
+}
+
+func TestCalculator_ResultIDs(t *testing.T) {
+	store := NewResultStore()
+	c := NewService(2, store)
+
+	var previous string
+	for i := 0; i < 1000; i++ {
+		got, err := c.Add(t.Context(), float64(i), 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(got.ID) != 36 || got.ID[14] != '7' {
+			t.Fatalf("Add() got ID %q, want a UUIDv7", got.ID)
+		}
+		if got.ID <= previous {
+			t.Fatalf("Add() got ID %q after %q, want increasing IDs", got.ID, previous)
+		}
+		previous = got.ID
+	}
+
+	found, err := store.Find(t.Context(), previous)
+	if err != nil {
+		t.Fatalf("Find(%q) found nothing", previous)
+	}
+	if found.Operator != "addition" || len(found.Operands) != 2 || found.Precision != 2 {
+		t.Errorf("Find() got %+v, want the structured record", found)
+	}
+
+	if _, err := store.Find(t.Context(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find() found a result for an unknown ID")
+	}
+}
+
+func TestResult_Render(t *testing.T) {
+	tests := []struct {
+		name      string
+		calc      func(c *Service) (Result, error)
+		precision int
+		want      string
+	}{
+		{
+			name: "float operation",
+			calc: func(c *Service) (Result, error) {
+				return c.Div(t.Context(), 2, 3)
+			},
+			precision: 6,
+			want:      "2.000000 / 3.000000 = 0.666667",
+		},
+		{
+			name: "decimal operation uses the unrounded value",
+			calc: func(c *Service) (Result, error) {
+				return c.Calculate(t.Context(), ModeDecimal, "division", "1", "3")
+			},
+			precision: 8,
+			want:      "1.00000000 / 3.00000000 = 0.33333333",
+		},
+		{
+			name: "expression",
+			calc: func(c *Service) (Result, error) {
+				return c.Evaluate(t.Context(), ModeFloat, "max(1, 2) / 3")
+			},
+			precision: 3,
+			want:      "max(1, 2) / 3 = 0.667",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewService(1, NewResultStore())
+			res, err := tt.calc(c)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := res.Render(c.Operations(), tt.precision)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Render() got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package calculator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSessionPingInterval = 30 * time.Second
+	// MaxSessionMessageSize is the largest message a session client may send.
+	MaxSessionMessageSize = 64 << 10
+	// MaxSessionSubscriptions is the number of subscriptions a session may
+	// hold at once.
+	MaxSessionSubscriptions = 16
+)
+
+// Session message types.
+const (
+	SessionCalculate   = "calculate"
+	SessionEvaluate    = "evaluate"
+	SessionSubscribe   = "subscribe"
+	SessionUnsubscribe = "unsubscribe"
+
+	SessionResult       = "result"
+	SessionSubscribed   = "subscribed"
+	SessionUnsubscribed = "unsubscribed"
+	SessionEvent        = "event"
+	SessionError        = "error"
+)
+
+// SessionHandler serves calculator sessions over WebSocket. Clients send
+// SessionRequest messages and receive SessionResponse messages with the same
+// ID.
+type SessionHandler struct {
+	service        *Service
+	getter         getter
+	hub            *Hub
+	mode           Mode
+	pingInterval   time.Duration
+	allowedOrigins []string
+	logger         *slog.Logger
+}
+
+func NewSessionHandler(service *Service, getter getter, hub *Hub, mode Mode, pingInterval time.Duration, allowedOrigins []string, logger *slog.Logger) *SessionHandler {
+	return &SessionHandler{
+		service,
+		getter,
+		hub,
+		mode,
+		pingInterval,
+		allowedOrigins,
+		logger,
+	}
+}
+
+type session struct {
+	*SessionHandler
+	conn *web.Conn
+
+	mu   sync.Mutex
+	subs map[string]*Subscription
+	wg   sync.WaitGroup
+}
+
+// Session upgrades the request to a WebSocket and handles its messages
+// until either side closes it. Browsers may only open sessions from pages of
+// the same origin or of the allowed origins. The server pings every ping interval and
+// closes connections that stay silent for two intervals. Closing the hub
+// closes every session with CloseGoingAway.
+func (h *SessionHandler) Session(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	conn, err := web.Upgrade(w, r, h.allowedOrigins)
+	if err != nil {
+		return err
+	}
+	_ = web.SetStatusCode(ctx, http.StatusSwitchingProtocols)
+
+	s := &session{
+		SessionHandler: h,
+		conn:           conn,
+		subs:           map[string]*Subscription{},
+	}
+	s.run(ctx)
+	return nil
+}
+
+func (s *session) run(ctx context.Context) {
+	pongWait := 2 * s.pingInterval
+	s.conn.SetReadLimit(MaxSessionMessageSize)
+	s.conn.SetPongHandler(func() {
+		_ = s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	_ = s.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+	done := make(chan struct{})
+	s.wg.Add(1)
+	go s.keepalive(done)
+
+	defer func() {
+		close(done)
+		s.mu.Lock()
+		for _, sub := range s.subs {
+			sub.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+		_ = s.conn.Close(web.CloseNormal, "")
+	}()
+
+	for {
+		typ, data, err := s.conn.ReadMessage()
+		if err != nil {
+			var closeErr *web.CloseError
+			if !errors.As(err, &closeErr) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Info("session", "error", err)
+			}
+			return
+		}
+		_ = s.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		if typ != web.TextMessage {
+			_ = s.conn.Close(web.CloseUnsupportedData, "only text messages are supported")
+			return
+		}
+		s.handle(ctx, data)
+	}
+}
+
+// keepalive pings the client and closes the session once the hub closes.
+func (s *session) keepalive(done <-chan struct{}) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.hub.Done():
+			_ = s.conn.Close(web.CloseGoingAway, "server shutting down")
+			return
+		case <-ticker.C:
+			if err := s.conn.Ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *session) handle(ctx context.Context, data []byte) {
+	var req SessionRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		s.fail("", web.NewError(http.StatusBadRequest, fmt.Sprintf("invalid message: %v", err)))
+		return
+	}
+	if req.ID == "" {
+		s.fail("", web.NewError(http.StatusBadRequest, "message requires an id"))
+		return
+	}
+
+	switch req.Type {
+	case SessionCalculate, SessionEvaluate:
+		mode, err := s.parseMode(req.Mode)
+		if err != nil {
+			s.fail(req.ID, web.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var result Result
+		if req.Type == SessionCalculate {
+			result, err = s.service.Calculate(ctx, mode, req.Op, req.Operands...)
+		} else {
+			result, err = s.service.Evaluate(ctx, mode, req.Expression)
+		}
+		if err != nil {
+			s.fail(req.ID, serviceError(err))
+			return
+		}
+
+		resp := newResultResponse(result)
+		s.send(SessionResponse{ID: req.ID, Type: SessionResult, Result: &resp})
+	case SessionSubscribe:
+		s.subscribe(ctx, req)
+	case SessionUnsubscribe:
+		s.mu.Lock()
+		sub, ok := s.subs[req.Subscription]
+		delete(s.subs, req.Subscription)
+		s.mu.Unlock()
+		if !ok {
+			s.fail(req.ID, web.NewError(http.StatusNotFound, fmt.Sprintf("subscription %q not found", req.Subscription)))
+			return
+		}
+		sub.Close()
+		s.send(SessionResponse{ID: req.ID, Type: SessionUnsubscribed})
+	default:
+		s.fail(req.ID, web.NewError(http.StatusBadRequest, fmt.Sprintf("unknown message type %q", req.Type)))
+	}
+}
+
+func (s *session) parseMode(mode Mode) (Mode, error) {
+	if mode == "" {
+		return s.mode, nil
+	}
+	return ParseMode(string(mode))
+}
+
+// subscribe sends every newly stored result as an event with the ID of the
+// subscribe request, after the results stored after req.After, if given.
+func (s *session) subscribe(ctx context.Context, req SessionRequest) {
+	// only the reader adds subscriptions, so the ID stays free and the count
+	// cannot grow until then
+	s.mu.Lock()
+	_, exists := s.subs[req.ID]
+	count := len(s.subs)
+	s.mu.Unlock()
+	if exists {
+		s.fail(req.ID, web.NewError(http.StatusConflict, fmt.Sprintf("subscription %q already exists", req.ID)))
+		return
+	}
+	if count >= MaxSessionSubscriptions {
+		s.fail(req.ID, web.NewError(http.StatusTooManyRequests, fmt.Sprintf("a session may hold at most %d subscriptions", MaxSessionSubscriptions)))
+		return
+	}
+
+	// subscribe before reading the store, so no result falls in between
+	sub := s.hub.Subscribe(streamBuffer)
+	if err := sub.Err(); err != nil {
+		s.fail(req.ID, web.WrapError(http.StatusServiceUnavailable, "server shutting down", err))
+		return
+	}
+
+	var replay []Result
+	if req.After != "" {
+		page, err := replayPage(ctx, s.getter, req.After)
+		if err != nil {
+			sub.Close()
+			s.fail(req.ID, storageError(err))
+			return
+		}
+		replay = page
+	}
+
+	s.mu.Lock()
+	s.subs[req.ID] = sub
+	s.mu.Unlock()
+	s.send(SessionResponse{ID: req.ID, Type: SessionSubscribed})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.forward(ctx, req.ID, sub, replay)
+	}()
+}
+
+func (s *session) forward(ctx context.Context, id string, sub *Subscription, replay []Result) {
+	var sent replayWindow
+	for len(replay) > 0 {
+		cursor := ""
+		for _, result := range replay {
+			s.event(id, result)
+			sent.add(result.ID)
+			cursor = result.ID
+		}
+
+		page, err := replayPage(ctx, s.getter, cursor)
+		if err != nil {
+			s.fail(id, storageError(err))
+			s.unsubscribe(id, sub)
+			return
+		}
+		replay = page
+	}
+
+	for result := range sub.Results() {
+		if !sent.seen(result.ID) {
+			s.event(id, result)
+		}
+	}
+
+	if err := sub.Err(); errors.Is(err, ErrSlowConsumer) {
+		s.logger.Info("session", "error", err, "msg", "ending subscription of slow consumer")
+		s.fail(id, web.NewError(http.StatusServiceUnavailable, "too slow, subscribe again with after"))
+	}
+	s.unsubscribe(id, sub)
+}
+
+// unsubscribe removes the subscription unless it was replaced already.
+func (s *session) unsubscribe(id string, sub *Subscription) {
+	sub.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[id] == sub {
+		delete(s.subs, id)
+	}
+}
+
+func (s *session) event(id string, result Result) {
+	resp := newResultResponse(result)
+	s.send(SessionResponse{ID: id, Type: SessionEvent, Result: &resp})
+}
+
+// fail sends err as an error message. Like the Errors middleware, it only
+// sends the message of a web.Error and logs the rest.
+func (s *session) fail(id string, err error) {
+	var webErr *web.Error
+	if !errors.As(err, &webErr) {
+		webErr = web.WrapError(http.StatusInternalServerError, "There was an internal server error", err)
+	}
+	if webErr.Err != nil {
+		s.logger.Error("session", "id", id, "error", err)
+	}
+	s.send(SessionResponse{ID: id, Type: SessionError, Error: webErr.Message, Status: webErr.Status})
+}
+
+// send writes a message. Failed writes end the session through the reader.
+func (s *session) send(resp SessionResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Error("session", "error", err)
+		return
+	}
+	_ = s.conn.WriteMessage(web.TextMessage, data)
+}
@@ -0,0 +1,52 @@
+package calculator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	// ErrSnapshotExpired is returned for snapshots the store no longer keeps,
+	// e.g. after deletions once snapshotTTL passed, or after a restart.
+	ErrSnapshotExpired = errors.New("snapshot expired")
+)
+
+const (
+	// snapshotTTL is how long the generation of a snapshot is kept after
+	// the last page that was read from it, if results are removed.
+	snapshotTTL = 5 * time.Minute
+	// maxRetiredSnapshots is how many generations of results a store keeps
+	// at most for readers of older snapshots after results were removed.
+	maxRetiredSnapshots = 4
+)
+
+// Snapshot identifies the state of a store at one point in time. Results are
+// only ever appended within a generation, so the first Len results of a
+// generation are that state. Removing results starts a new generation.
+type Snapshot struct {
+	Store      uint32 `json:"s"`
+	Generation uint64 `json:"g"`
+	Len        int    `json:"n"`
+}
+
+// Encode returns the opaque string form of the snapshot.
+func (s Snapshot) Encode() string {
+	data, _ := json.Marshal(s)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeSnapshot(s string) (*Snapshot, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil || snap.Len < 0 {
+		return nil, ErrInvalidSnapshot
+	}
+	return snap, nil
+}
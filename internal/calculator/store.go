@@ -1,52 +1,435 @@
 package calculator
 
 import (
+	"context"
+	"errors"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
+var (
+	ErrNotFound = errors.New("result not found")
+	// ErrStoreUnavailable is returned by stores that cannot serve a request
+	// right now but might be able to later, e.g. because the disk is full.
+	ErrStoreUnavailable = errors.New("store unavailable")
+)
+
+// Store is implemented by all result stores. Methods return the context's
+// error if it is done before the operation started.
 type Store interface {
 	storer
 	getter
+	deleter
+}
+
+type deleter interface {
+	// Delete removes the result with the given ID. It returns ErrNotFound if
+	// it does not exist.
+	Delete(ctx context.Context, id string) error
+	// Clear removes all results and returns how many there were.
+	Clear(ctx context.Context) (int, error)
+	// Evict removes the results that the retention policy no longer allows
+	// and returns how many were removed.
+	Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error)
 }
 
+// ResultStore keeps the results in memory, ordered by ID. New IDs sort last,
+// so storing a result is an amortized O(1) append, and read newest first.
+//
+// Removals start a new generation. While a reader or an issued snapshot
+// references the old generation, its elements are never modified: removals
+// build a new slice, so a prefix of results is an immutable snapshot that
+// readers can use without holding the lock. Otherwise the results are
+// compacted in place.
 type ResultStore struct {
+	// results is ordered oldest first by ID, so cursor pages are found by
+	// binary search.
 	results []Result
-	mu      sync.RWMutex
+	// byID maps IDs to indexes into results.
+	byID map[string]int
+	mu   sync.RWMutex
+
+	// id tells snapshots of different stores, or of a restarted one, apart.
+	id         uint32
+	generation uint64
+
+	// snapMu guards refs and retired. It is taken with or without mu, but
+	// never before it.
+	snapMu sync.Mutex
+	refs   map[uint64]*generationRef
+	// retired keeps the results of older generations that are still
+	// referenced.
+	retired map[uint64][]Result
+}
+
+// generationRef counts the readers of a generation and keeps it until the
+// snapshots issued for it expire.
+type generationRef struct {
+	readers int
+	expires time.Time
 }
 
 func NewResultStore() *ResultStore {
 	return &ResultStore{
 		results: []Result{},
+		byID:    map[string]int{},
+		id:      uint32(randomSeq())<<16 | uint32(randomSeq()),
+		refs:    map[uint64]*generationRef{},
+		retired: map[uint64][]Result{},
+	}
+}
+
+func (s *ResultStore) Store(ctx context.Context, result Result) error {
+	return s.StoreMany(ctx, []Result{result})
+}
+
+// StoreMany stores the results in order, so the last one becomes the most
+// recent result.
+func (s *ResultStore) StoreMany(ctx context.Context, results []Result) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.StoreMany", slog.Int("results", len(results)))
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	s.add(results)
+	return nil
+}
+
+func (s *ResultStore) Find(ctx context.Context, id string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.Find")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	defer s.mu.RUnlock()
+
+	i, ok := s.byID[id]
+	if !ok {
+		return Result{}, ErrNotFound
+	}
+	return s.results[i], nil
+}
+
+// readAfter returns up to limit results stored after the result with the ID,
+// copying only the page.
+func (s *ResultStore) readAfter(ctx context.Context, after string, limit int) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.readAfter")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	defer s.mu.RUnlock()
+
+	i, ok := s.byID[after]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(s.results[i+1 : min(i+1+limit, len(s.results))]), nil
+}
+
+// Get runs the query on a consistent snapshot of the store: the one given in
+// the query or the current one. The returned page references its snapshot,
+// so later pages can read the same state.
+func (s *ResultStore) Get(ctx context.Context, q Query) (PaginatedResult[[]Result], error) {
+	if err := ctx.Err(); err != nil {
+		return PaginatedResult[[]Result]{}, err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.Get")
+	defer span.End()
+
+	lock(span, s.mu.RLocker())
+	results, snap, err := s.view(q.Snapshot)
+	if err == nil {
+		s.acquire(snap.Generation)
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		return PaginatedResult[[]Result]{}, err
+	}
+
+	// the view is immutable while it is acquired, so the query runs without
+	// the lock
+	page := q.run(results, true)
+	// the snapshot is only worth keeping if there are other pages to read
+	// from it
+	s.release(snap.Generation, page.TotalRecords > len(page.Result))
+	span.SetAttributes(slog.Int("results", len(page.Result)))
+	page.Snapshot = snap.Encode()
+	return page, nil
+}
+
+// view returns the results of the snapshot, or of the current state if snap
+// is nil. The caller must hold the lock.
+func (s *ResultStore) view(snap *Snapshot) ([]Result, Snapshot, error) {
+	if snap == nil {
+		n := len(s.results)
+		return s.results[:n:n], Snapshot{Store: s.id, Generation: s.generation, Len: n}, nil
+	}
+
+	if snap.Store != s.id {
+		return nil, Snapshot{}, ErrSnapshotExpired
+	}
+	results := s.results
+	if snap.Generation != s.generation {
+		s.snapMu.Lock()
+		retired, ok := s.retired[snap.Generation]
+		s.snapMu.Unlock()
+		if !ok {
+			return nil, Snapshot{}, ErrSnapshotExpired
+		}
+		results = retired
+	}
+	if snap.Len > len(results) {
+		return nil, Snapshot{}, ErrInvalidSnapshot
+	}
+	return results[:snap.Len:snap.Len], *snap, nil
+}
+
+// acquire marks the generation as read until release is called. The caller
+// must hold the lock.
+func (s *ResultStore) acquire(generation uint64) {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	ref, ok := s.refs[generation]
+	if !ok {
+		ref = &generationRef{}
+		s.refs[generation] = ref
+	}
+	ref.readers++
+}
+
+// release ends a read of the generation. If keep is set, the generation is
+// kept for snapshotTTL for the snapshot issued to the reader.
+func (s *ResultStore) release(generation uint64, keep bool) {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	ref := s.refs[generation]
+	ref.readers--
+	if keep {
+		ref.expires = time.Now().Add(snapshotTTL)
 	}
+	s.expire(time.Now())
 }
 
-func (s *ResultStore) Store(result Result) {
-	s.mu.Lock()
-	s.results = append([]Result{result}, s.results...)
-	s.mu.Unlock()
+// expire forgets the generations that are neither read nor referenced by a
+// snapshot that has not expired. The current generation keeps its results
+// in s.results. The caller must hold snapMu.
+func (s *ResultStore) expire(now time.Time) {
+	for generation, ref := range s.refs {
+		if ref.readers == 0 && !ref.expires.After(now) {
+			delete(s.refs, generation)
+			delete(s.retired, generation)
+		}
+	}
 }
 
-func (s *ResultStore) Get(p Pagination) PaginatedResult[[]Result] {
-	p.Validate()
+// retire starts a new generation before results are removed. It reports
+// whether the results of the old generation are still referenced, in which
+// case they are kept for their snapshots and must not be modified. The
+// caller must hold the write lock.
+func (s *ResultStore) retire() bool {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
 
-	if len(s.results) == 0 || p.Offset() >= len(s.results) {
-		return PaginatedResult[[]Result]{
-			Result:   []Result{},
-			Metadata: p.toMetadata(len(s.results)),
+	s.expire(time.Now())
+	_, referenced := s.refs[s.generation]
+	if referenced {
+		s.retired[s.generation] = s.results
+		if len(s.retired) > maxRetiredSnapshots {
+			// the generations are running numbers, so the oldest has the
+			// smallest
+			oldest := s.generation
+			for generation := range s.retired {
+				oldest = min(oldest, generation)
+			}
+			delete(s.retired, oldest)
 		}
 	}
+	s.generation++
+	return referenced
+}
+
+func (s *ResultStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.Delete")
+	defer span.End()
 
-	startIndex := p.Offset()
-	endIndex := startIndex + p.Limit()
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
 
-	if endIndex > len(s.results) {
-		endIndex = len(s.results)
+	if s.remove([]string{id}) == 0 {
+		return ErrNotFound
 	}
+	return nil
+}
+
+func (s *ResultStore) Clear(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.Clear")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
 
+	return s.clear(), nil
+}
+
+func (s *ResultStore) Evict(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	_, span := web.StartSpan(ctx, "ResultStore.Evict")
+	defer span.End()
+
+	lock(span, &s.mu)
+	defer s.mu.Unlock()
+
+	return s.remove(s.evictable(policy, now)), nil
+}
+
+// Len returns the number of stored results.
+func (s *ResultStore) Len() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return PaginatedResult[[]Result]{
-		Result:   s.results[startIndex:endIndex],
-		Metadata: p.toMetadata(len(s.results)),
+	return len(s.results)
+}
+
+// add appends the results, keeping them ordered by ID. The caller must hold
+// the write lock.
+func (s *ResultStore) add(results []Result) {
+	for _, result := range results {
+		n := len(s.results)
+		if n > 0 && s.results[n-1].ID > result.ID {
+			s.insert(result)
+			continue
+		}
+		s.byID[result.ID] = n
+		s.results = append(s.results, result)
+	}
+}
+
+// insert adds a result that sorts before the newest one, e.g. one whose ID
+// was generated before that of a result stored concurrently. Like a removal,
+// it starts a new generation. The caller must hold the write lock.
+func (s *ResultStore) insert(result Result) {
+	i, _ := slices.BinarySearchFunc(s.results, result.ID, func(r Result, id string) int {
+		return strings.Compare(r.ID, id)
+	})
+	if s.retire() {
+		results := make([]Result, 0, len(s.results)+1)
+		s.results = append(results, s.results...)
+	}
+	s.results = slices.Insert(s.results, i, result)
+	for ; i < len(s.results); i++ {
+		s.byID[s.results[i].ID] = i
+	}
+}
+
+// clear removes all results and returns how many there were. The caller must
+// hold the write lock.
+func (s *ResultStore) clear() int {
+	n := len(s.results)
+	s.retire()
+	s.results = []Result{}
+	s.byID = map[string]int{}
+	return n
+}
+
+// evictable returns the IDs of the results that the retention policy no
+// longer allows. The caller must hold the lock.
+func (s *ResultStore) evictable(policy RetentionPolicy, now time.Time) []string {
+	var ids []string
+	for i, r := range s.results {
+		newer := len(s.results) - 1 - i
+		if (policy.MaxCount > 0 && newer >= policy.MaxCount) || policy.expired(r, now) {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// remove deletes the results with the given IDs and returns how many existed.
+// The caller must hold the write lock.
+func (s *ResultStore) remove(ids []string) int {
+	n := 0
+	for _, id := range ids {
+		if _, ok := s.byID[id]; ok {
+			delete(s.byID, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+
+	// copy if the old generation is referenced, so its snapshots stay
+	// intact and the removed results are not kept alive once it expires
+	referenced := s.retire()
+	kept := s.results[:0]
+	if referenced {
+		kept = make([]Result, 0, len(s.results)-n)
+	}
+	for _, r := range s.results {
+		if _, ok := s.byID[r.ID]; ok {
+			s.byID[r.ID] = len(kept)
+			kept = append(kept, r)
+		}
+	}
+	if !referenced {
+		clear(s.results[len(kept):])
+	}
+	s.results = kept
+	return n
+}
+
+// newestFirst returns a copy of the results ordered newest first. The caller
+// must hold the lock.
+func (s *ResultStore) newestFirst() []Result {
+	results := slices.Clone(s.results)
+	slices.Reverse(results)
+	return results
+}
+
+// reindex rebuilds the ID index. The caller must hold the write lock.
+func (s *ResultStore) reindex() {
+	s.byID = make(map[string]int, len(s.results))
+	for i := range s.results {
+		s.byID[s.results[i].ID] = i
+	}
+}
+
+// lock acquires l and records on the span how long that took.
+func lock(span *web.Span, l sync.Locker) {
+	if span == nil {
+		l.Lock()
+		return
 	}
+	start := time.Now()
+	l.Lock()
+	span.SetAttributes(slog.Duration("lock.wait", time.Since(start)))
 }
@@ -0,0 +1,644 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestResultStore_GetQuery(t *testing.T) {
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	store := NewResultStore()
+	for i, r := range []Result{
+		{Operator: "addition", Value: 3, Expression: "1 + 2 = 3", Created: day.Add(-time.Hour)},
+		{Operator: "division", Value: 0.5, Expression: "1 / 2 = 0.5", Created: day.Add(time.Hour)},
+		{Operator: "division", Value: 2000, Expression: "4000 / 2 = 2000", Created: day.Add(2 * time.Hour)},
+		{Operator: OperatorExpression, Value: 1500, Expression: "max(1500, 2) = 1500", Created: day.Add(3 * time.Hour)},
+		{Operator: "division", Value: 10, Expression: "20 / 2 = 10", Created: day.Add(25 * time.Hour)},
+	} {
+		r.ID = string(rune('a' + i))
+		mustStore(t, store, r)
+	}
+
+	min1000 := 1000.0
+
+	tests := []struct {
+		name      string
+		query     Query
+		wantIDs   string
+		wantTotal int
+	}{
+		{
+			name:      "newest first by default",
+			query:     Query{},
+			wantIDs:   "edcba",
+			wantTotal: 5,
+		},
+		{
+			name:      "oldest first",
+			query:     Query{Sort: SortOldest},
+			wantIDs:   "abcde",
+			wantTotal: 5,
+		},
+		{
+			name: "divisions from one day",
+			query: Query{Filter: Filter{
+				Operators: []string{"division"},
+				From:      day,
+				To:        day.Add(24 * time.Hour),
+			}},
+			wantIDs:   "cb",
+			wantTotal: 2,
+		},
+		{
+			name:      "results above 1000 by value",
+			query:     Query{Filter: Filter{Min: &min1000}, Sort: SortValueDesc},
+			wantIDs:   "cd",
+			wantTotal: 2,
+		},
+		{
+			name:      "search ignores case",
+			query:     Query{Filter: Filter{Search: "MAX("}},
+			wantIDs:   "d",
+			wantTotal: 1,
+		},
+		{
+			name:      "total counts all filtered results across pages",
+			query:     Query{Pagination: Pagination{Page: 2, PageSize: 2}, Sort: SortValueAsc},
+			wantIDs:   "ed",
+			wantTotal: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustGet(t, store, tt.query)
+
+			var ids string
+			for _, r := range got.Result {
+				ids += r.ID
+			}
+			if ids != tt.wantIDs {
+				t.Errorf("Get() got results %q, want %q", ids, tt.wantIDs)
+			}
+			if got.TotalRecords != tt.wantTotal {
+				t.Errorf("Get() got total %d, want %d", got.TotalRecords, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestResultStore_GetCursor(t *testing.T) {
+	store := NewResultStore()
+	c := NewService(0, store)
+	for i := 1; i <= 7; i++ {
+		if _, err := c.Add(t.Context(), float64(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values := func(page PaginatedResult[[]Result]) []float64 {
+		var v []float64
+		for _, r := range page.Result {
+			v = append(v, r.Value)
+		}
+		return v
+	}
+
+	first := mustGet(t, store, Query{Limit: 3})
+	if got := values(first); !slices.Equal(got, []float64{7, 6, 5}) {
+		t.Fatalf("first page = %v", got)
+	}
+	if first.PrevCursor != "" || first.NextCursor == "" {
+		t.Fatalf("first page cursors = %q, %q", first.PrevCursor, first.NextCursor)
+	}
+
+	// new results must not shift the following pages
+	if _, err := c.Add(t.Context(), 8, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := DecodeCursor(first.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := mustGet(t, store, Query{Limit: 3, After: after})
+	if got := values(second); !slices.Equal(got, []float64{4, 3, 2}) {
+		t.Fatalf("second page = %v", got)
+	}
+
+	next, _ := DecodeCursor(second.NextCursor)
+	last := mustGet(t, store, Query{Limit: 3, After: next})
+	if got := values(last); !slices.Equal(got, []float64{1}) || last.NextCursor != "" {
+		t.Fatalf("last page = %v, next cursor %q", got, last.NextCursor)
+	}
+
+	before, _ := DecodeCursor(second.PrevCursor)
+	prev := mustGet(t, store, Query{Limit: 3, Before: before})
+	if got := values(prev); !slices.Equal(got, []float64{7, 6, 5}) {
+		t.Fatalf("previous page = %v", got)
+	}
+	if prev.PrevCursor == "" {
+		t.Errorf("previous page has no prev cursor although result 8 is newer")
+	}
+
+	byValue := mustGet(t, store, Query{Limit: 2, Sort: SortValueAsc, Filter: Filter{Search: "+"}})
+	if got := values(byValue); !slices.Equal(got, []float64{1, 2}) || byValue.TotalRecords != 8 {
+		t.Fatalf("value sorted page = %v, total %d", got, byValue.TotalRecords)
+	}
+}
+
+func TestResultStore_SeekCursor(t *testing.T) {
+	store := NewResultStore()
+	// stored slightly out of ID order, as concurrent requests can
+	for _, i := range []int{0, 2, 1, 3, 5, 4, 6, 9, 7, 8, 10, 11, 14, 12, 13, 15, 16, 18, 17, 19} {
+		mustStore(t, store, Result{ID: fmt.Sprintf("%02d", i), Value: float64(i % 4)})
+	}
+	if !slices.IsSortedFunc(store.results, func(a, b Result) int { return strings.Compare(a.ID, b.ID) }) {
+		t.Fatal("results are not ordered by ID")
+	}
+	for i, r := range store.results {
+		if store.byID[r.ID] != i {
+			t.Fatalf("index of %s = %d, want %d", r.ID, store.byID[r.ID], i)
+		}
+	}
+
+	// an insert does not change the pages of an earlier snapshot
+	first := mustGet(t, store, Query{Sort: SortOldest, Pagination: Pagination{PageSize: 10}})
+	snap, err := DecodeSnapshot(first.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustStore(t, store, Result{ID: "05a"})
+	again := mustGet(t, store, Query{Sort: SortOldest, Pagination: Pagination{PageSize: 10}, Snapshot: snap})
+	if !reflect.DeepEqual(again.Result, first.Result) {
+		t.Errorf("snapshot page after an insert = %v, want %v", again.Result, first.Result)
+	}
+	if got := mustGet(t, store, Query{Sort: SortOldest, Limit: 1, After: &Cursor{Sort: SortOldest, ID: "05"}}); got.Result[0].ID != "05a" {
+		t.Errorf("result after 05 = %s, want the inserted 05a", got.Result[0].ID)
+	}
+
+	min2 := 2.0
+	for _, sort := range []Sort{SortNewest, SortOldest} {
+		for _, filter := range []Filter{{}, {Min: &min2}} {
+			for _, cursor := range []string{"", "00", "07", "19", "xx"} {
+				for _, limit := range []int{1, 3, 50} {
+					queries := []Query{{Sort: sort, Filter: filter, Limit: limit}}
+					if cursor != "" {
+						c := &Cursor{Sort: sort, ID: cursor}
+						queries = append(queries,
+							Query{Sort: sort, Filter: filter, Limit: limit, After: c},
+							Query{Sort: sort, Filter: filter, Limit: limit, Before: c},
+							Query{Sort: sort, Filter: filter, Limit: limit, After: &Cursor{Sort: sort, ID: "05"}, Before: c},
+						)
+					}
+					for _, q := range queries {
+						got := q.run(store.results, true)
+						want := q.cursorPage(q.apply(store.results))
+						if !reflect.DeepEqual(got, want) {
+							t.Errorf("seek page of %+v = %+v, want %+v", q, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestResultStore_Evict(t *testing.T) {
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		policy      RetentionPolicy
+		wantIDs     string
+		wantEvicted int
+	}{
+		{
+			name:        "no policy",
+			policy:      RetentionPolicy{},
+			wantIDs:     "edcba",
+			wantEvicted: 0,
+		},
+		{
+			name:        "max count keeps the newest",
+			policy:      RetentionPolicy{MaxCount: 2},
+			wantIDs:     "ed",
+			wantEvicted: 3,
+		},
+		{
+			name:        "max age",
+			policy:      RetentionPolicy{MaxAge: 45 * time.Minute},
+			wantIDs:     "ed",
+			wantEvicted: 3,
+		},
+		{
+			name:        "both limits",
+			policy:      RetentionPolicy{MaxCount: 1, MaxAge: time.Hour},
+			wantIDs:     "e",
+			wantEvicted: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewResultStore()
+			for i := range 5 {
+				mustStore(t, store, Result{
+					ID:      string(rune('a' + i)),
+					Created: now.Add(time.Duration(i-4) * 30 * time.Minute),
+				})
+			}
+
+			got, err := store.Evict(t.Context(), tt.policy, now)
+			if err != nil {
+				t.Fatalf("Evict() error = %v", err)
+			}
+			if got != tt.wantEvicted {
+				t.Errorf("Evict() = %d, want %d", got, tt.wantEvicted)
+			}
+
+			var ids string
+			for _, r := range mustGet(t, store, Query{Pagination: Pagination{PageSize: MaxPageSize}}).Result {
+				ids += r.ID
+			}
+			if ids != tt.wantIDs {
+				t.Errorf("remaining = %q, want %q", ids, tt.wantIDs)
+			}
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				_, err := store.Find(t.Context(), id)
+				found := err == nil
+				if want := strings.Contains(tt.wantIDs, id); found != want {
+					t.Errorf("Find(%q) found = %v, want %v", id, found, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResultStore_Delete(t *testing.T) {
+	store := NewResultStore()
+	for _, id := range []string{"a", "b", "c"} {
+		mustStore(t, store, Result{ID: id})
+	}
+
+	if err := store.Delete(t.Context(), "b"); err != nil {
+		t.Fatalf("Delete(b) error = %v", err)
+	}
+	if err := store.Delete(t.Context(), "b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Delete(b) error = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Find(t.Context(), "b"); !errors.Is(err, ErrNotFound) {
+		t.Fatal("b is still found")
+	}
+	if got := mustGet(t, store, Query{}).TotalRecords; got != 2 {
+		t.Fatalf("total = %d, want 2", got)
+	}
+
+	if n, err := store.Clear(t.Context()); err != nil || n != 2 {
+		t.Fatalf("Clear() = %d, %v, want 2", n, err)
+	}
+	if got := mustGet(t, store, Query{}).TotalRecords; got != 0 {
+		t.Fatalf("total after clear = %d, want 0", got)
+	}
+}
+
+func mustStore(t *testing.T, store storer, results ...Result) {
+	t.Helper()
+	for _, r := range results {
+		if err := store.Store(t.Context(), r); err != nil {
+			t.Fatalf("Store() error = %v", err)
+		}
+	}
+}
+
+func mustGet(t *testing.T, store getter, q Query) PaginatedResult[[]Result] {
+	t.Helper()
+	page, err := store.Get(t.Context(), q)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	return page
+}
+
+func TestResultStore_Canceled(t *testing.T) {
+	store := NewResultStore()
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if err := store.Store(ctx, Result{ID: "a"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Store() error = %v, want context.Canceled", err)
+	}
+	if _, err := store.Get(ctx, Query{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get() error = %v, want context.Canceled", err)
+	}
+	if got := mustGet(t, store, Query{}).TotalRecords; got != 0 {
+		t.Errorf("canceled Store() stored %d results", got)
+	}
+}
+
+func benchmarkResult(i int) Result {
+	return Result{
+		ID:         formatUUIDv7(int64(i), 0),
+		Operator:   "addition",
+		Value:      float64(i),
+		Expression: "1 + 2 = 3",
+		Mode:       ModeFloat,
+		Created:    time.UnixMilli(int64(i)),
+	}
+}
+
+// filledStore returns a store with n results. Results are created once and
+// shared between benchmarks, since filling the store dominates otherwise.
+func filledStore(b *testing.B, n int) *ResultStore {
+	b.Helper()
+	store := NewResultStore()
+	results := make([]Result, n)
+	for i := range results {
+		results[i] = benchmarkResult(i)
+	}
+	if err := store.StoreMany(b.Context(), results); err != nil {
+		b.Fatal(err)
+	}
+	return store
+}
+
+func BenchmarkResultStore_Store(b *testing.B) {
+	for _, n := range []int{0, 1_000_000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			store := filledStore(b, n)
+			ctx := b.Context()
+			i := n
+			for b.Loop() {
+				if err := store.Store(ctx, benchmarkResult(i)); err != nil {
+					b.Fatal(err)
+				}
+				i++
+			}
+		})
+	}
+}
+
+func BenchmarkResultStore_Get(b *testing.B) {
+	store := filledStore(b, 1_000_000)
+	ctx := b.Context()
+
+	queries := map[string]Query{
+		"newest":   {Pagination: Pagination{Page: 1, PageSize: MaxPageSize}},
+		"deep":     {Pagination: Pagination{Page: 40_000, PageSize: MaxPageSize}},
+		"filtered": {Pagination: Pagination{Page: 1, PageSize: MaxPageSize}, Filter: Filter{Min: new(float64)}},
+	}
+	for name, q := range queries {
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := store.Get(ctx, q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkResultStore_Concurrent mixes one write with every nine reads of
+// the newest page.
+func BenchmarkResultStore_Concurrent(b *testing.B) {
+	store := filledStore(b, 1_000_000)
+	ctx := b.Context()
+	var next atomic.Int64
+	next.Store(1_000_000)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			var err error
+			if i%10 == 0 {
+				err = store.Store(ctx, benchmarkResult(int(next.Add(1))))
+			} else {
+				_, err = store.Get(ctx, Query{Pagination: Pagination{Page: 1, PageSize: MaxPageSize}})
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func TestResultStore_Snapshot(t *testing.T) {
+	store := NewResultStore()
+	for i := range 5 {
+		mustStore(t, store, Result{ID: string(rune('a' + i))})
+	}
+
+	first := mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: 2}})
+	snap, err := DecodeSnapshot(first.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustStore(t, store, Result{ID: "f"})
+	if err := store.Delete(t.Context(), "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := mustGet(t, store, Query{Pagination: Pagination{Page: 2, PageSize: 2}, Snapshot: snap})
+	var ids string
+	for _, r := range second.Result {
+		ids += r.ID
+	}
+	if ids != "cb" || second.TotalRecords != 5 {
+		t.Errorf("page 2 of the snapshot = %q of %d, want %q of 5", ids, second.TotalRecords, "cb")
+	}
+	if second.Snapshot != first.Snapshot {
+		t.Errorf("page 2 got snapshot %q, want %q", second.Snapshot, first.Snapshot)
+	}
+
+	current := mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: MaxPageSize}})
+	if current.TotalRecords != 5 || current.Snapshot == first.Snapshot {
+		t.Errorf("current state = %d results with snapshot %q", current.TotalRecords, current.Snapshot)
+	}
+
+	// removals keep the generations of newer snapshots, pushing out the
+	// oldest
+	for _, id := range []string{"a", "b", "d", "e"} {
+		mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: 1}})
+		if err := store.Delete(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(store.retired); n != maxRetiredSnapshots {
+		t.Errorf("%d generations retired, want %d", n, maxRetiredSnapshots)
+	}
+	if _, err := store.Get(t.Context(), Query{Snapshot: snap}); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Get() with an old snapshot error = %v, want ErrSnapshotExpired", err)
+	}
+
+	other := &Snapshot{Store: snap.Store + 1, Len: 1}
+	if _, err := store.Get(t.Context(), Query{Snapshot: other}); !errors.Is(err, ErrSnapshotExpired) {
+		t.Errorf("Get() with a snapshot of another store error = %v, want ErrSnapshotExpired", err)
+	}
+}
+
+func TestResultStore_RetiredGenerations(t *testing.T) {
+	const n = 10_000
+	store := NewResultStore()
+	for i := range n {
+		mustStore(t, store, Result{ID: strconv.Itoa(i)})
+	}
+
+	// without snapshots to read, removals neither copy nor keep the results
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := range 1000 {
+		if err := store.Delete(t.Context(), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if len(store.retired) != 0 || len(store.refs) != 0 {
+		t.Errorf("%d generations retired, %d referenced, want none", len(store.retired), len(store.refs))
+	}
+	// a copy of the results per removal would be about a thousand times as
+	// much
+	if perDelete, size := (after.TotalAlloc-before.TotalAlloc)/1000, uint64(n)*uint64(unsafe.Sizeof(Result{})); perDelete > size/10 {
+		t.Errorf("allocated %d bytes per removal, the results take %d", perDelete, size)
+	}
+
+	// a page that fits all results needs no snapshot
+	mustGet(t, store, Query{Filter: Filter{Operators: []string{"none"}}})
+	if err := store.Delete(t.Context(), "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.retired) != 0 {
+		t.Errorf("%d generations retired after a single page, want none", len(store.retired))
+	}
+
+	// every generation a snapshot was issued for is kept, up to the limit
+	for i := 1001; i < 1100; i++ {
+		mustGet(t, store, Query{Pagination: Pagination{Page: 1, PageSize: 2}})
+		if err := store.Delete(t.Context(), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if len(store.retired) > maxRetiredSnapshots {
+			t.Fatalf("%d generations retired, want at most %d", len(store.retired), maxRetiredSnapshots)
+		}
+	}
+	if n := len(store.retired); n != maxRetiredSnapshots {
+		t.Errorf("%d generations retired, want %d", n, maxRetiredSnapshots)
+	}
+
+	// expired snapshots are forgotten on the next removal
+	for _, ref := range store.refs {
+		ref.expires = time.Now().Add(-time.Second)
+	}
+	if err := store.Delete(t.Context(), "1100"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.retired) != 0 || len(store.refs) != 0 {
+		t.Errorf("%d generations retired, %d referenced after expiry, want none", len(store.retired), len(store.refs))
+	}
+}
+
+// TestResultStore_ConcurrentSnapshots mixes heavy writes and removals with
+// readers that page through snapshots. Run it with -race.
+func TestResultStore_ConcurrentSnapshots(t *testing.T) {
+	const (
+		writers = 4
+		readers = 4
+		writes  = 2000
+	)
+
+	store := NewResultStore()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				r := Result{ID: newID(), Value: float64(w*writes + i)}
+				if err := store.Store(t.Context(), r); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%100 == 99 {
+					if _, err := store.Evict(t.Context(), RetentionPolicy{MaxCount: 5000}, time.Now()); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var readerWG sync.WaitGroup
+	for range readers {
+		readerWG.Add(1)
+		go func() {
+			defer readerWG.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				first, err := store.Get(t.Context(), Query{Pagination: Pagination{Page: 1, PageSize: MaxPageSize}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				snap, err := DecodeSnapshot(first.Snapshot)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				// all pages of a snapshot agree on the total and never
+				// repeat a result
+				seen := map[string]bool{}
+				for page := 1; page <= min(first.LastPage, 5); page++ {
+					got, err := store.Get(t.Context(), Query{Pagination: Pagination{Page: page, PageSize: MaxPageSize}, Snapshot: snap})
+					if errors.Is(err, ErrSnapshotExpired) {
+						break
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if got.TotalRecords != first.TotalRecords {
+						t.Errorf("page %d of snapshot has %d records, page 1 had %d", page, got.TotalRecords, first.TotalRecords)
+						return
+					}
+					for _, r := range got.Result {
+						if seen[r.ID] {
+							t.Errorf("result %s on more than one page of a snapshot", r.ID)
+							return
+						}
+						seen[r.ID] = true
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readerWG.Wait()
+
+	if got := mustGet(t, store, Query{}).TotalRecords; got != 5000 {
+		t.Errorf("total = %d, want 5000 after eviction", got)
+	}
+}
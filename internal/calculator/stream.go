@@ -0,0 +1,213 @@
+package calculator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultStreamHeartbeat = 15 * time.Second
+
+	// streamBuffer is how many results a stream may fall behind before it is
+	// disconnected.
+	streamBuffer = 256
+	// streamWriteTimeout disconnects clients that stop reading.
+	streamWriteTimeout = 10 * time.Second
+	// replayPageSize is the page size used to resume a stream from the store.
+	replayPageSize = 500
+)
+
+// StreamHandler pushes newly stored results to clients as Server-Sent
+// Events.
+type StreamHandler struct {
+	getter    getter
+	hub       *Hub
+	heartbeat time.Duration
+	logger    *slog.Logger
+}
+
+func NewStreamHandler(getter getter, hub *Hub, heartbeat time.Duration, logger *slog.Logger) *StreamHandler {
+	return &StreamHandler{
+		getter,
+		hub,
+		heartbeat,
+		logger,
+	}
+}
+
+// Recent streams every newly stored result as an event with the result ID as
+// its event ID. A client that reconnects with Last-Event-ID first receives
+// the results stored after that ID. Heartbeat comments keep idle
+// connections open. Clients that fall behind are disconnected and can
+// resume with Last-Event-ID.
+func (h *StreamHandler) Recent(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	// subscribe before reading the store, so no result falls in between
+	sub := h.hub.Subscribe(streamBuffer)
+	defer sub.Close()
+
+	var replay []Result
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor != "" {
+		page, err := replayPage(ctx, h.getter, cursor)
+		if err != nil {
+			return storageError(err)
+		}
+		replay = page
+	}
+
+	rc := http.NewResponseController(w)
+	// the connection may be reused once the stream ends
+	defer rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	_ = web.SetStatusCode(ctx, http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Cache-Control")
+		return web.WrapError(http.StatusInternalServerError, "streaming is not supported", err)
+	}
+
+	var sent replayWindow
+	for len(replay) > 0 {
+		for _, result := range replay {
+			if err := h.send(rc, w, result); err != nil {
+				return nil
+			}
+			sent.add(result.ID)
+			cursor = result.ID
+		}
+
+		page, err := replayPage(ctx, h.getter, cursor)
+		if err != nil {
+			h.logger.Error("stream", "error", err)
+			return nil
+		}
+		replay = page
+	}
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if err := h.write(rc, w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case result, ok := <-sub.Results():
+			if !ok {
+				if err := sub.Err(); errors.Is(err, ErrSlowConsumer) {
+					h.logger.Info("stream", "error", err, "msg", "disconnecting slow consumer")
+					_ = h.write(rc, w, "event: error\ndata: {\"error\":\"too slow, reconnect with Last-Event-ID\"}\n\n")
+				}
+				return nil
+			}
+			if sent.seen(result.ID) {
+				continue
+			}
+			if err := h.send(rc, w, result); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// afterReader is implemented by stores that read the results stored after a
+// result directly, without querying and sorting all results for every page.
+type afterReader interface {
+	// readAfter returns up to limit results stored after the result with the
+	// ID, in the order they were stored. It returns ErrNotFound if there is
+	// no result with the ID.
+	readAfter(ctx context.Context, after string, limit int) ([]Result, error)
+}
+
+// replayPage returns the next results stored after the ID, oldest first.
+// Stores that cannot read them directly, or no longer have the result with
+// the ID, are queried for the results with greater IDs.
+func replayPage(ctx context.Context, getter getter, id string) ([]Result, error) {
+	if r, ok := getter.(afterReader); ok {
+		page, err := r.readAfter(ctx, id, replayPageSize)
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, errors.ErrUnsupported) {
+			return page, err
+		}
+	}
+
+	page, err := getter.Get(ctx, Query{
+		Sort:  SortOldest,
+		Limit: replayPageSize,
+		After: &Cursor{Sort: SortOldest, ID: id},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page.Result, nil
+}
+
+// replayWindow remembers the IDs of the results last sent by a replay, since
+// they may arrive from the subscription as well. Only results published after
+// subscribing can, and a subscription that falls more than streamBuffer
+// results behind is closed, so the last streamBuffer replayed IDs are enough.
+// For the same reason the window is dropped after as many live results.
+type replayWindow struct {
+	ids  map[string]bool
+	ring []string
+	next int
+	live int
+}
+
+func (w *replayWindow) add(id string) {
+	if w.ids == nil {
+		w.ids = map[string]bool{}
+		w.ring = make([]string, 0, streamBuffer)
+	}
+	if len(w.ring) < streamBuffer {
+		w.ring = append(w.ring, id)
+	} else {
+		delete(w.ids, w.ring[w.next])
+		w.ring[w.next] = id
+		w.next = (w.next + 1) % streamBuffer
+	}
+	w.ids[id] = true
+}
+
+// seen reports whether a live result was sent by the replay already.
+func (w *replayWindow) seen(id string) bool {
+	if w.ids == nil {
+		return false
+	}
+	sent := w.ids[id]
+	delete(w.ids, id)
+	if w.live++; w.live >= streamBuffer || len(w.ids) == 0 {
+		*w = replayWindow{}
+	}
+	return sent
+}
+
+func (h *StreamHandler) send(rc *http.ResponseController, w http.ResponseWriter, result Result) error {
+	data, err := json.Marshal(newResultResponse(result))
+	if err != nil {
+		return err
+	}
+	return h.write(rc, w, fmt.Sprintf("id: %s\nevent: result\ndata: %s\n\n", result.ID, data))
+}
+
+// write writes and flushes an event. A client that does not take it within
+// streamWriteTimeout is disconnected.
+func (h *StreamHandler) write(rc *http.ResponseController, w http.ResponseWriter, event string) error {
+	if err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := w.Write([]byte(event)); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
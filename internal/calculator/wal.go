@@ -0,0 +1,457 @@
+package calculator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs the log after every record.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs the log in the background, so a crash can lose
+	// the records of the last interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+var ErrUnknownSyncPolicy = errors.New("unknown sync policy")
+
+// ErrCorruptLog is returned for a corrupted record in the middle of the log,
+// which unlike a torn last record is not left behind by a crash.
+var ErrCorruptLog = errors.New("write-ahead log is corrupted")
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch SyncPolicy(s) {
+	case SyncAlways, SyncInterval, SyncNever:
+		return SyncPolicy(s), nil
+	}
+	return "", fmt.Errorf("%w %q (expected %s, %s or %s)", ErrUnknownSyncPolicy, s, SyncAlways, SyncInterval, SyncNever)
+}
+
+const (
+	DefaultSyncInterval  = time.Second
+	DefaultSnapshotEvery = 1000
+)
+
+type WALOptions struct {
+	// Path is the location of the log. Without a path changes are only
+	// persisted by Save.
+	Path string
+	Sync SyncPolicy
+	// SyncInterval is how often the log is fsynced with SyncInterval.
+	SyncInterval time.Duration
+	// SnapshotEvery writes a snapshot and truncates the log after this many
+	// records. Zero only snapshots on Save.
+	SnapshotEvery int
+}
+
+type walOp string
+
+const (
+	walStore  walOp = "store"
+	walDelete walOp = "delete"
+	walClear  walOp = "clear"
+)
+
+// walRecord is a single log entry. Records are idempotent: stored results
+// that already exist are skipped on replay, so replaying records that are
+// already part of the snapshot does no harm.
+type walRecord struct {
+	Op      walOp    `json:"op"`
+	Results []Result `json:"results,omitempty"`
+	IDs     []string `json:"ids,omitempty"`
+}
+
+// wal is an append-only log of store mutations. Each record is written as a
+// single line of the form "<crc32c> <json>\n", so a torn write at the end of
+// the file can be detected and cut off on replay. With a keyring the JSON is
+// the encrypted record.
+type wal struct {
+	mu   sync.Mutex
+	file walFile
+	// size is the length of the intact records, where the next one is
+	// written.
+	size    int64
+	opts    WALOptions
+	keys    *Keyring
+	records int
+	dirty   bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// walFile is the part of *os.File the log writes to.
+type walFile interface {
+	io.WriteSeeker
+	io.ReaderAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// openWAL opens the log, calls apply for every intact record and cuts off a
+// torn last record. Records that are intact but cannot be decrypted, and
+// corrupted records followed by intact ones, are an error rather than a torn
+// write.
+func openWAL(opts WALOptions, keys *Keyring, apply func(walRecord)) (*wal, error) {
+	file, err := os.OpenFile(opts.Path, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	valid, records, err := replayWAL(file, keys, apply)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	w := &wal{
+		file:    file,
+		size:    valid,
+		opts:    opts,
+		keys:    keys,
+		records: records,
+	}
+	if opts.Sync == SyncInterval {
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		w.done = make(chan struct{})
+		w.stopped = make(chan struct{})
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+// replayWAL reads records until the end of the log or a torn last record and
+// returns the offset after the last intact record.
+func replayWAL(r io.Reader, keys *Keyring, apply func(walRecord)) (int64, int, error) {
+	reader := bufio.NewReader(r)
+	var offset int64
+	records := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// an unterminated last line is a torn write
+			return offset, records, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+
+		record, err := decodeWALRecord(line, keys)
+		if errors.Is(err, errCorruptRecord) {
+			intact, err := intactRecordFollows(reader)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to read write-ahead log: %w", err)
+			}
+			if intact {
+				return 0, 0, fmt.Errorf("%w: record %d at offset %d is followed by intact records", ErrCorruptLog, records+1, offset)
+			}
+			return offset, records, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read write-ahead log: %w", err)
+		}
+		apply(record)
+		offset += int64(len(line))
+		records++
+	}
+}
+
+// intactRecordFollows reports whether a line with a valid checksum follows.
+func intactRecordFollows(reader *bufio.Reader) (bool, error) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if validChecksum(bytes.TrimSuffix(line, []byte("\n"))) {
+			return true, nil
+		}
+	}
+}
+
+func encodeWALRecord(record walRecord, keys *Keyring) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = keys.seal(data); err != nil {
+		return nil, err
+	}
+
+	line := make([]byte, 0, 8+1+len(data)+1)
+	line = fmt.Appendf(line, "%08x ", crc32.Checksum(data, crcTable))
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+func decodeWALRecord(line []byte, keys *Keyring) (walRecord, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if !validChecksum(line) {
+		return walRecord{}, errCorruptRecord
+	}
+
+	_, data, _ := bytes.Cut(line, []byte(" "))
+	data, _, err := keys.open(data)
+	if err != nil {
+		return walRecord{}, err
+	}
+
+	var record walRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return walRecord{}, errCorruptRecord
+	}
+	return record, nil
+}
+
+// validChecksum reports whether the line, without the newline, is a checksum
+// and the data it matches.
+func validChecksum(line []byte) bool {
+	sum, data, ok := bytes.Cut(line, []byte(" "))
+	if !ok || len(sum) != 8 {
+		return false
+	}
+	want, err := strconv.ParseUint(string(sum), 16, 32)
+	return err == nil && crc32.Checksum(data, crcTable) == uint32(want)
+}
+
+// append writes the record and syncs it according to the sync policy. It
+// reports whether the log has grown enough to be compacted. A record that
+// cannot be written or synced is cut off again, so it is not replayed
+// although the change was refused.
+func (w *wal) append(record walRecord) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	line, err := encodeWALRecord(record, w.keys)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode log record: %w", err)
+	}
+
+	if _, err := w.file.Write(line); err != nil {
+		return false, fmt.Errorf("failed to append to write-ahead log: %w", errors.Join(err, w.rollback()))
+	}
+	if w.opts.Sync == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return false, fmt.Errorf("failed to sync write-ahead log: %w", errors.Join(err, w.rollback()))
+		}
+	}
+	w.size += int64(len(line))
+	w.records++
+	if w.opts.Sync == SyncInterval {
+		w.dirty = true
+	}
+
+	return w.opts.SnapshotEvery > 0 && w.records >= w.opts.SnapshotEvery, nil
+}
+
+// walMark is a position in the log.
+type walMark struct {
+	size    int64
+	records int
+}
+
+// mark returns the end of the log.
+func (w *wal) mark() walMark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return walMark{w.size, w.records}
+}
+
+// dropBefore removes the records before the mark after they were written to
+// a snapshot. Records appended since are written to a new log that replaces
+// the old one atomically.
+func (w *wal) dropBefore(m walMark) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if m.size == w.size {
+		return w.reset()
+	}
+
+	tail := make([]byte, w.size-m.size)
+	if _, err := w.file.ReadAt(tail, m.size); err != nil {
+		return fmt.Errorf("failed to read write-ahead log: %w", err)
+	}
+	file, err := writeTempFile(w.opts.Path, tail)
+	if err != nil {
+		return fmt.Errorf("failed to write write-ahead log: %w", err)
+	}
+	if err := os.Rename(file.Name(), w.opts.Path); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to replace write-ahead log: %w", err)
+	}
+	// the old log is gone, so the new one is used even if syncing the
+	// directory fails
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(tail))
+	w.records -= m.records
+	if err := syncDir(filepath.Dir(w.opts.Path)); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log directory: %w", err)
+	}
+	return nil
+}
+
+// reset empties the log. The caller must hold the lock.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	w.size = 0
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	w.records = 0
+	w.dirty = false
+	return nil
+}
+
+// rollback cuts the log off after the last intact record. The caller must
+// hold the lock.
+func (w *wal) rollback() error {
+	if err := w.file.Truncate(w.size); err != nil {
+		return fmt.Errorf("failed to cut off the record: %w", err)
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+	return nil
+}
+
+func (w *wal) syncLoop(interval time.Duration) {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				// a failed sync is retried on the next tick and reported by close
+				if err := w.file.Sync(); err == nil {
+					w.dirty = false
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *wal) close() error {
+	if w.done != nil {
+		close(w.done)
+		<-w.stopped
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return w.file.Close()
+}
+
+// writeTempFile writes and syncs data to a temporary file next to path, to be
+// renamed into place. The file is left open at its end.
+func writeTempFile(path string, data []byte) (*os.File, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := file.Chmod(filePerm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// sync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,698 @@
+package calculator
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWebhookWorkers        = 4
+	DefaultWebhookMaxAttempts    = 6
+	DefaultWebhookInitialBackoff = time.Second
+	DefaultWebhookMaxBackoff     = 5 * time.Minute
+	DefaultWebhookTimeout        = 10 * time.Second
+	DefaultWebhookMaxDeliveries  = 100
+	DefaultWebhookMaxDeadLetters = 1000
+	DefaultWebhookMaxPending     = 1000
+	DefaultWebhookMaxQueue       = 10000
+
+	// WebhookEvent is the event of every webhook delivery.
+	WebhookEvent = "result.stored"
+
+	// webhookBuffer is how many results the dispatcher may fall behind the
+	// hub before results are missed.
+	webhookBuffer = 4096
+	// maxWebhookResponse is how much of a response body is read so the
+	// connection can be reused.
+	maxWebhookResponse = 64 << 10
+)
+
+var (
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("delivery not found")
+	// ErrNotDeadLetter is returned when redelivering a delivery that has not
+	// failed for good.
+	ErrNotDeadLetter  = errors.New("delivery is not a dead letter")
+	ErrWebhooksClosed = errors.New("webhooks closed")
+	// ErrDeliveryQueueFull is the error of deliveries that became dead
+	// letters because too many deliveries were pending, and of redeliveries
+	// that were refused for it.
+	ErrDeliveryQueueFull = errors.New("delivery queue is full")
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead deliveries failed MaxAttempts times and are kept in the
+	// dead-letter list until they are redelivered.
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// WebhookOptions configures delivery. Zero values use the defaults.
+type WebhookOptions struct {
+	// Client defaults to a client with DefaultWebhookTimeout that does not
+	// connect to loopback, private, link-local or unspecified addresses
+	// unless AllowPrivateNetworks is set. A custom client must refuse them
+	// itself.
+	Client  *http.Client
+	Workers int
+	// MaxAttempts is how often a delivery is attempted before it becomes a
+	// dead letter.
+	MaxAttempts int
+	// The backoff after the nth failed attempt is InitialBackoff * 2^(n-1),
+	// at most MaxBackoff, of which up to half is random jitter.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxDeliveries is how many deliveries are kept per webhook for the
+	// status API. Pending deliveries are always kept.
+	MaxDeliveries  int
+	MaxDeadLetters int
+	// MaxPending is how many deliveries of a webhook may wait for an attempt
+	// or a retry, MaxQueue how many of all webhooks. Deliveries beyond them,
+	// e.g. while a receiver is down, become dead letters right away.
+	MaxPending int
+	MaxQueue   int
+	// AllowPrivateNetworks permits receivers on loopback, private, link-local
+	// and unspecified addresses. Only set it if everyone who can register a
+	// webhook may reach the internal network.
+	AllowPrivateNetworks bool
+}
+
+func (o WebhookOptions) withDefaults() WebhookOptions {
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+		if !o.AllowPrivateNetworks {
+			o.Client.Transport = publicTransport()
+		}
+	}
+	if o.Workers <= 0 {
+		o.Workers = DefaultWebhookWorkers
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = DefaultWebhookInitialBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+	if o.MaxDeliveries <= 0 {
+		o.MaxDeliveries = DefaultWebhookMaxDeliveries
+	}
+	if o.MaxDeadLetters <= 0 {
+		o.MaxDeadLetters = DefaultWebhookMaxDeadLetters
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = DefaultWebhookMaxPending
+	}
+	if o.MaxQueue <= 0 {
+		o.MaxQueue = DefaultWebhookMaxQueue
+	}
+	return o
+}
+
+// publicTransport only connects to public addresses. The address is checked
+// when dialing, after the name is resolved, so a host that resolved to a
+// public address when the webhook was registered cannot be rebound to an
+// internal one. Redirects are dialed the same way.
+func publicTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addr.Addr()) {
+				return fmt.Errorf("%s is not a public address", addr.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialed instead of the receiver
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// reservedPrefixes are not routed on the internet, besides the ranges the
+// netip.Addr methods cover.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() || addr.IsMulticast() {
+		return false
+	}
+	return !slices.ContainsFunc(reservedPrefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// Webhook receives every stored result that matches its filter.
+type Webhook struct {
+	ID  string
+	URL string
+	// Filter uses Operators, Min and Max only.
+	Filter Filter
+	// Secret signs the deliveries, see WebhookSignature.
+	Secret  string
+	Created time.Time
+}
+
+type Delivery struct {
+	ID             string
+	WebhookID      string
+	Result         Result
+	Status         DeliveryStatus
+	Attempts       int
+	LastError      string
+	LastStatusCode int
+	// NextAttempt is set while a failed delivery waits for its retry.
+	NextAttempt time.Time
+	Created     time.Time
+	Updated     time.Time
+}
+
+// WebhookPayload is the body of a delivery.
+type WebhookPayload struct {
+	ID        string         `json:"id"`
+	Event     string         `json:"event"`
+	WebhookID string         `json:"webhook_id"`
+	Result    ResultResponse `json:"result"`
+}
+
+type webhook struct {
+	Webhook
+	// deliveries are ordered oldest first.
+	deliveries []*Delivery
+	// pending counts the deliveries that are queued, being attempted or
+	// waiting for a retry.
+	pending int
+}
+
+// Webhooks delivers the results published to a hub to the registered
+// webhooks. Deliveries are POSTed by a pool of workers, so storing a result
+// never waits for a receiver. Webhooks and deliveries are kept in memory.
+type Webhooks struct {
+	opts   WebhookOptions
+	hub    *Hub
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	hooks   map[string]*webhook
+	dead    []*Delivery
+	queue   []*Delivery
+	timers  map[*Delivery]*time.Timer
+	pending int
+	sub     *Subscription
+	closed  bool
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhooks starts delivering the results published to hub. Close stops
+// it.
+func NewWebhooks(hub *Hub, opts WebhookOptions, logger *slog.Logger) *Webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Webhooks{
+		opts:   opts.withDefaults(),
+		hub:    hub,
+		logger: logger,
+		hooks:  map[string]*webhook{},
+		timers: map[*Delivery]*time.Timer{},
+		sub:    hub.Subscribe(webhookBuffer),
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	w.wg.Add(1 + w.opts.Workers)
+	go w.dispatch(w.sub)
+	for range w.opts.Workers {
+		go w.work()
+	}
+	return w
+}
+
+// Register validates and adds a webhook. The ID and creation time are set
+// by Register.
+func (w *Webhooks) Register(hook Webhook) (Webhook, error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	// names are checked when dialing, this only rejects the obvious ones early
+	if !w.opts.AllowPrivateNetworks {
+		host := strings.ToLower(u.Hostname())
+		addr, err := netip.ParseAddr(host)
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") || (err == nil && !publicAddr(addr)) {
+			return Webhook{}, fmt.Errorf("%w: url must not point to a loopback, private or link-local address", ErrInvalidWebhook)
+		}
+	}
+	if hook.Secret == "" {
+		return Webhook{}, fmt.Errorf("%w: secret is required", ErrInvalidWebhook)
+	}
+	if hook.Filter.Min != nil && hook.Filter.Max != nil && *hook.Filter.Min > *hook.Filter.Max {
+		return Webhook{}, fmt.Errorf("%w: min is greater than max", ErrInvalidWebhook)
+	}
+	hook.Filter = Filter{
+		Operators: hook.Filter.Operators,
+		Min:       hook.Filter.Min,
+		Max:       hook.Filter.Max,
+	}
+	hook.ID = newID()
+	hook.Created = time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return Webhook{}, ErrWebhooksClosed
+	}
+	w.hooks[hook.ID] = &webhook{Webhook: hook}
+	return hook, nil
+}
+
+// Webhooks returns the registered webhooks, oldest first.
+func (w *Webhooks) Webhooks() []Webhook {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(w.hooks))
+	for _, hook := range w.hooks {
+		hooks = append(hooks, hook.Webhook)
+	}
+	// IDs sort by creation
+	slices.SortFunc(hooks, func(a, b Webhook) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return hooks
+}
+
+func (w *Webhooks) Webhook(id string) (Webhook, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hook, ok := w.hooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return hook.Webhook, nil
+}
+
+// Delete removes the webhook together with its pending deliveries and dead
+// letters.
+func (w *Webhooks) Delete(id string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hook, ok := w.hooks[id]
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	delete(w.hooks, id)
+	w.pending -= hook.pending
+	for _, d := range hook.deliveries {
+		if timer, ok := w.timers[d]; ok {
+			timer.Stop()
+			delete(w.timers, d)
+		}
+	}
+	w.queue = slices.DeleteFunc(w.queue, func(d *Delivery) bool { return d.WebhookID == id })
+	w.dead = slices.DeleteFunc(w.dead, func(d *Delivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+// Deliveries returns the recent deliveries of the webhook, newest first.
+func (w *Webhooks) Deliveries(id string) ([]Delivery, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hook, ok := w.hooks[id]
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	deliveries := make([]Delivery, len(hook.deliveries))
+	for i, d := range hook.deliveries {
+		deliveries[len(deliveries)-1-i] = *d
+	}
+	return deliveries, nil
+}
+
+// DeadLetters returns the deliveries that failed for good, newest first.
+func (w *Webhooks) DeadLetters() []Delivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deliveries := make([]Delivery, len(w.dead))
+	for i, d := range w.dead {
+		deliveries[len(deliveries)-1-i] = *d
+	}
+	return deliveries
+}
+
+// Redeliver moves a dead letter of the webhook back into the queue with a
+// fresh set of attempts. It fails with ErrDeliveryQueueFull while too many
+// deliveries are pending.
+func (w *Webhooks) Redeliver(webhookID, deliveryID string) (Delivery, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hook, ok := w.hooks[webhookID]
+	if !ok {
+		return Delivery{}, ErrWebhookNotFound
+	}
+	i := slices.IndexFunc(w.dead, func(d *Delivery) bool { return d.ID == deliveryID && d.WebhookID == webhookID })
+	if i < 0 {
+		if slices.ContainsFunc(hook.deliveries, func(d *Delivery) bool { return d.ID == deliveryID }) {
+			return Delivery{}, ErrNotDeadLetter
+		}
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	if w.full(hook) {
+		return Delivery{}, ErrDeliveryQueueFull
+	}
+
+	d := w.dead[i]
+	w.dead = slices.Delete(w.dead, i, i+1)
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.Updated = time.Now()
+	if !slices.Contains(hook.deliveries, d) {
+		w.record(hook, d)
+	}
+	w.admit(hook, d)
+	return *d, nil
+}
+
+// Close stops delivering. In-flight attempts are canceled and pending
+// deliveries are dropped.
+func (w *Webhooks) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	w.sub.Close()
+	pending := w.pending
+	for d, timer := range w.timers {
+		timer.Stop()
+		delete(w.timers, d)
+	}
+	w.queue = nil
+	w.mu.Unlock()
+
+	w.cancel()
+	w.wg.Wait()
+	if pending > 0 {
+		w.logger.Warn("webhooks", "msg", "dropped pending deliveries on close", "pending", pending)
+	}
+}
+
+// dispatch queues a delivery for every webhook matching a published result.
+func (w *Webhooks) dispatch(sub *Subscription) {
+	defer w.wg.Done()
+
+	for {
+		for result := range sub.Results() {
+			w.match(result)
+		}
+		if err := sub.Err(); !errors.Is(err, ErrSlowConsumer) {
+			return
+		}
+		w.logger.Error("webhooks", "error", ErrSlowConsumer, "msg", "results were missed, resubscribing")
+
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		sub = w.hub.Subscribe(webhookBuffer)
+		w.sub = sub
+		w.mu.Unlock()
+	}
+}
+
+func (w *Webhooks) match(result Result) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for _, hook := range w.hooks {
+		if !hook.Filter.Match(result) {
+			continue
+		}
+		d := &Delivery{
+			ID:        newID(),
+			WebhookID: hook.ID,
+			Result:    result,
+			Status:    DeliveryPending,
+			Created:   now,
+			Updated:   now,
+		}
+		w.record(hook, d)
+		w.admit(hook, d)
+	}
+}
+
+// record adds the delivery to the webhook and drops its oldest finished
+// delivery beyond MaxDeliveries. The caller must hold the lock.
+func (w *Webhooks) record(hook *webhook, d *Delivery) {
+	hook.deliveries = append(hook.deliveries, d)
+	if len(hook.deliveries) <= w.opts.MaxDeliveries {
+		return
+	}
+	if i := slices.IndexFunc(hook.deliveries, func(d *Delivery) bool { return d.Status != DeliveryPending }); i >= 0 {
+		hook.deliveries = slices.Delete(hook.deliveries, i, i+1)
+	}
+}
+
+// full reports whether no more deliveries of the webhook may be pending. The
+// caller must hold the lock.
+func (w *Webhooks) full(hook *webhook) bool {
+	return hook.pending >= w.opts.MaxPending || w.pending >= w.opts.MaxQueue
+}
+
+// admit enqueues the pending delivery, or makes it a dead letter if the
+// webhook or all webhooks have too many pending deliveries. The caller must
+// hold the lock.
+func (w *Webhooks) admit(hook *webhook, d *Delivery) {
+	if w.full(hook) {
+		d.Status = DeliveryDead
+		d.LastError = ErrDeliveryQueueFull.Error()
+		w.bury(d)
+		return
+	}
+	hook.pending++
+	w.pending++
+	w.enqueue(d)
+}
+
+// settle counts the delivery of the webhook as no longer pending. The caller
+// must hold the lock.
+func (w *Webhooks) settle(webhookID string) {
+	if hook, ok := w.hooks[webhookID]; ok {
+		hook.pending--
+		w.pending--
+	}
+}
+
+// bury adds the delivery to the dead letters and drops the oldest beyond
+// MaxDeadLetters. The caller must hold the lock.
+func (w *Webhooks) bury(d *Delivery) {
+	w.dead = append(w.dead, d)
+	if len(w.dead) > w.opts.MaxDeadLetters {
+		w.dead = slices.Delete(w.dead, 0, len(w.dead)-w.opts.MaxDeadLetters)
+	}
+}
+
+// enqueue hands the delivery to the workers. The caller must hold the lock.
+func (w *Webhooks) enqueue(d *Delivery) {
+	w.queue = append(w.queue, d)
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Webhooks) work() {
+	defer w.wg.Done()
+
+	for {
+		d, hook, ok := w.next()
+		if !ok {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-w.wake:
+			}
+			continue
+		}
+		w.attempt(d, hook)
+	}
+}
+
+// next takes the next delivery off the queue and passes the wake-up on if
+// there is more.
+func (w *Webhooks) next() (*Delivery, Webhook, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.queue) > 0 {
+		d := w.queue[0]
+		w.queue = w.queue[1:]
+		hook, ok := w.hooks[d.WebhookID]
+		if !ok {
+			continue
+		}
+		if len(w.queue) > 0 {
+			select {
+			case w.wake <- struct{}{}:
+			default:
+			}
+		}
+		return d, hook.Webhook, true
+	}
+	return nil, Webhook{}, false
+}
+
+// attempt posts the delivery once and schedules a retry or moves it to the
+// dead letters if that fails.
+func (w *Webhooks) attempt(d *Delivery, hook Webhook) {
+	// the ID and the result never change
+	payload := WebhookPayload{
+		ID:        d.ID,
+		Event:     WebhookEvent,
+		WebhookID: hook.ID,
+		Result:    newResultResponse(d.Result),
+	}
+	status, err := w.post(hook, payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	d.Attempts++
+	d.LastStatusCode = status
+	d.Updated = now
+	d.NextAttempt = time.Time{}
+	if err == nil {
+		d.Status = DeliveryDelivered
+		d.LastError = ""
+		w.settle(hook.ID)
+		return
+	}
+	d.LastError = err.Error()
+
+	if _, ok := w.hooks[hook.ID]; !ok {
+		return
+	}
+	if d.Attempts >= w.opts.MaxAttempts {
+		d.Status = DeliveryDead
+		w.settle(hook.ID)
+		w.bury(d)
+		w.logger.Warn("webhooks", "msg", "delivery failed for good", "webhook", hook.ID, "delivery", d.ID, "attempts", d.Attempts, "error", err)
+		return
+	}
+
+	backoff := w.backoff(d.Attempts)
+	d.NextAttempt = now.Add(backoff)
+	w.timers[d] = time.AfterFunc(backoff, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.timers[d]; !ok {
+			return
+		}
+		delete(w.timers, d)
+		w.enqueue(d)
+	})
+}
+
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	backoff := w.opts.MaxBackoff
+	if shift := attempts - 1; shift < 32 && w.opts.InitialBackoff<<shift < w.opts.MaxBackoff {
+		backoff = w.opts.InitialBackoff << shift
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// post sends the payload and returns the status code of the response. Any
+// status other than 2xx is an error.
+func (w *Webhooks) post(hook Webhook, payload WebhookPayload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", hook.ID)
+	req.Header.Set("X-Webhook-Delivery", payload.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", WebhookSignature(hook.Secret, timestamp, body))
+
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookSignature returns the X-Webhook-Signature of a delivery: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" with the webhook's secret, prefixed
+// with "sha256=". Receivers recompute it from X-Webhook-Timestamp and the
+// raw body.
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
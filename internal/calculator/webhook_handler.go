@@ -0,0 +1,151 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"net/http"
+)
+
+type WebhookHandler struct {
+	webhooks   *Webhooks
+	operations *Registry
+}
+
+func NewWebhookHandler(webhooks *Webhooks, operations *Registry) *WebhookHandler {
+	return &WebhookHandler{
+		webhooks,
+		operations,
+	}
+}
+
+// Create registers a webhook. Operators of the filter may be given by name
+// or symbol.
+func (h *WebhookHandler) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	req := WebhookRequest{}
+	if err := web.Decode(r, &req); err != nil {
+		return err
+	}
+
+	var operators []string
+	for _, name := range req.Filter.Operators {
+		if name == OperatorExpression {
+			operators = append(operators, name)
+			continue
+		}
+		op, err := h.operations.Lookup(name)
+		if err != nil {
+			return web.NewError(http.StatusBadRequest, err.Error())
+		}
+		operators = append(operators, op.Name)
+	}
+
+	hook, err := h.webhooks.Register(Webhook{
+		URL:    req.URL,
+		Secret: req.Secret,
+		Filter: Filter{
+			Operators: operators,
+			Min:       req.Filter.Min,
+			Max:       req.Filter.Max,
+		},
+	})
+	if errors.Is(err, ErrInvalidWebhook) {
+		return web.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return web.WrapError(http.StatusServiceUnavailable, "webhooks are unavailable", err)
+	}
+
+	w.Header().Set("Location", r.URL.Path+"/"+hook.ID)
+	return web.Respond(ctx, w, newWebhookResponse(hook), http.StatusCreated)
+}
+
+func (h *WebhookHandler) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	hooks := h.webhooks.Webhooks()
+
+	resp := WebhooksResponse{
+		Webhooks: make([]WebhookResponse, len(hooks)),
+	}
+	for i, hook := range hooks {
+		resp.Webhooks[i] = newWebhookResponse(hook)
+	}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+func (h *WebhookHandler) Get(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	hook, err := h.webhooks.Webhook(r.PathValue("id"))
+	if err != nil {
+		return webhookError(err, r)
+	}
+	return web.Respond(ctx, w, newWebhookResponse(hook), http.StatusOK)
+}
+
+func (h *WebhookHandler) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if err := h.webhooks.Delete(r.PathValue("id")); err != nil {
+		return webhookError(err, r)
+	}
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Deliveries returns the recent deliveries of a webhook, newest first,
+// optionally only those with the given status.
+func (h *WebhookHandler) Deliveries(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	status := DeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		return web.NewError(http.StatusBadRequest, fmt.Sprintf("unknown status %q (expected %s, %s or %s)", status, DeliveryPending, DeliveryDelivered, DeliveryDead))
+	}
+
+	deliveries, err := h.webhooks.Deliveries(r.PathValue("id"))
+	if err != nil {
+		return webhookError(err, r)
+	}
+
+	resp := DeliveriesResponse{
+		Deliveries: []DeliveryResponse{},
+	}
+	for _, d := range deliveries {
+		if status == "" || d.Status == status {
+			resp.Deliveries = append(resp.Deliveries, newDeliveryResponse(d))
+		}
+	}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// DeadLetters returns the deliveries of all webhooks that failed for good.
+func (h *WebhookHandler) DeadLetters(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	deliveries := h.webhooks.DeadLetters()
+
+	resp := DeliveriesResponse{
+		Deliveries: make([]DeliveryResponse, len(deliveries)),
+	}
+	for i, d := range deliveries {
+		resp.Deliveries[i] = newDeliveryResponse(d)
+	}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
+
+// Redeliver queues a dead letter again.
+func (h *WebhookHandler) Redeliver(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	d, err := h.webhooks.Redeliver(r.PathValue("id"), r.PathValue("delivery"))
+	if err != nil {
+		return webhookError(err, r)
+	}
+	return web.Respond(ctx, w, newDeliveryResponse(d), http.StatusAccepted)
+}
+
+func webhookError(err error, r *http.Request) error {
+	switch {
+	case errors.Is(err, ErrWebhookNotFound):
+		return web.NewError(http.StatusNotFound, fmt.Sprintf("webhook %q not found", r.PathValue("id")))
+	case errors.Is(err, ErrDeliveryNotFound):
+		return web.NewError(http.StatusNotFound, fmt.Sprintf("delivery %q not found", r.PathValue("delivery")))
+	case errors.Is(err, ErrNotDeadLetter):
+		return web.NewError(http.StatusConflict, err.Error())
+	case errors.Is(err, ErrDeliveryQueueFull):
+		return web.NewError(http.StatusServiceUnavailable, err.Error())
+	}
+	return err
+}
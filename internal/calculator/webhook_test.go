@@ -0,0 +1,341 @@
+package calculator
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receiver records the deliveries it accepts and fails with the status
+// returned by fail.
+type receiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	requests int
+	fail     func(n int) int
+	received chan WebhookPayload
+}
+
+func newReceiver(t *testing.T, secret string, fail func(n int) int) (*receiver, *httptest.Server) {
+	rec := &receiver{t: t, secret: secret, fail: fail, received: make(chan WebhookPayload, 100)}
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+	return rec, server
+}
+
+func (rec *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rec.t.Error(err)
+		return
+	}
+	want := WebhookSignature(rec.secret, r.Header.Get("X-Webhook-Timestamp"), body)
+	if got := r.Header.Get("X-Webhook-Signature"); got != want {
+		rec.t.Errorf("signature = %q, want %q", got, want)
+	}
+
+	rec.mu.Lock()
+	rec.requests++
+	n := rec.requests
+	rec.mu.Unlock()
+	if status := rec.fail(n); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		rec.t.Error(err)
+	}
+	if r.Header.Get("X-Webhook-Delivery") != payload.ID {
+		rec.t.Errorf("X-Webhook-Delivery = %q, want %q", r.Header.Get("X-Webhook-Delivery"), payload.ID)
+	}
+	rec.received <- payload
+}
+
+func (rec *receiver) next(t *testing.T) WebhookPayload {
+	t.Helper()
+	select {
+	case p := <-rec.received:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery within 2s")
+		return WebhookPayload{}
+	}
+}
+
+func newTestWebhooks(t *testing.T, hub *Hub) *Webhooks {
+	t.Helper()
+	w := NewWebhooks(hub, WebhookOptions{
+		Workers:        2,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		// the receivers listen on loopback
+		AllowPrivateNetworks: true,
+	}, slog.New(slog.DiscardHandler))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// waitDelivery waits until the delivery of the result reaches the status.
+func waitDelivery(t *testing.T, w *Webhooks, hookID, resultID string, status DeliveryStatus) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		deliveries, err := w.Deliveries(hookID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range deliveries {
+			if d.Result.ID == resultID && d.Status == status {
+				return d
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery of %s did not become %s: %+v", resultID, status, deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhooks_Deliver(t *testing.T) {
+	hub := NewHub()
+	w := newTestWebhooks(t, hub)
+
+	// the first two attempts fail
+	rec, server := newReceiver(t, "s3cret", func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	threshold := 10.0
+	hook, err := w.Register(Webhook{URL: server.URL, Secret: "s3cret", Filter: Filter{Operators: []string{"addition"}, Min: &threshold}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Publish(
+		Result{ID: "small", Operator: "addition", Value: 3},
+		Result{ID: "other", Operator: "subtraction", Value: 30},
+		Result{ID: "large", Operator: "addition", Value: 30},
+	)
+
+	payload := rec.next(t)
+	if payload.Event != WebhookEvent || payload.WebhookID != hook.ID || payload.Result.ID != "large" {
+		t.Errorf("delivered %+v, want result large", payload)
+	}
+	d := waitDelivery(t, w, hook.ID, "large", DeliveryDelivered)
+	if d.Attempts != 3 || d.LastStatusCode != http.StatusOK || d.LastError != "" {
+		t.Errorf("delivery = %+v, want delivered on the third attempt", d)
+	}
+	if deliveries, _ := w.Deliveries(hook.ID); len(deliveries) != 1 {
+		t.Errorf("got %d deliveries, want only the matching one", len(deliveries))
+	}
+}
+
+func TestWebhooks_DeadLetters(t *testing.T) {
+	hub := NewHub()
+	w := newTestWebhooks(t, hub)
+
+	var (
+		mu   sync.Mutex
+		down = true
+	)
+	rec, server := newReceiver(t, "s3cret", func(int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	hook, err := w.Register(Webhook{URL: server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Publish(Result{ID: "a"})
+	d := waitDelivery(t, w, hook.ID, "a", DeliveryDead)
+	if d.Attempts != 3 || d.LastStatusCode != http.StatusInternalServerError || d.LastError == "" {
+		t.Errorf("dead letter = %+v", d)
+	}
+	if dead := w.DeadLetters(); len(dead) != 1 || dead[0].ID != d.ID {
+		t.Fatalf("DeadLetters() = %+v", dead)
+	}
+
+	if _, err := w.Redeliver(hook.ID, "missing"); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("Redeliver(missing) error = %v, want ErrDeliveryNotFound", err)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	if _, err := w.Redeliver(hook.ID, d.ID); err != nil {
+		t.Fatal(err)
+	}
+	if payload := rec.next(t); payload.ID != d.ID {
+		t.Errorf("redelivered %q, want %q", payload.ID, d.ID)
+	}
+	waitDelivery(t, w, hook.ID, "a", DeliveryDelivered)
+	if dead := w.DeadLetters(); len(dead) != 0 {
+		t.Errorf("DeadLetters() after redelivery = %+v", dead)
+	}
+	if _, err := w.Redeliver(hook.ID, d.ID); !errors.Is(err, ErrNotDeadLetter) {
+		t.Errorf("Redeliver(delivered) error = %v, want ErrNotDeadLetter", err)
+	}
+}
+
+func TestWebhooks_Register(t *testing.T) {
+	w := newTestWebhooks(t, NewHub())
+	lower, upper := 2.0, 1.0
+
+	tests := []struct {
+		name string
+		hook Webhook
+	}{
+		{name: "missing url", hook: Webhook{Secret: "s"}},
+		{name: "relative url", hook: Webhook{URL: "/hook", Secret: "s"}},
+		{name: "unsupported scheme", hook: Webhook{URL: "ftp://example.com", Secret: "s"}},
+		{name: "missing secret", hook: Webhook{URL: "http://example.com"}},
+		{name: "empty value range", hook: Webhook{URL: "http://example.com", Secret: "s", Filter: Filter{Min: &lower, Max: &upper}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := w.Register(tt.hook); !errors.Is(err, ErrInvalidWebhook) {
+				t.Errorf("Register() error = %v, want ErrInvalidWebhook", err)
+			}
+		})
+	}
+
+	hook, err := w.Register(Webhook{URL: "https://example.com/hook", Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hooks := w.Webhooks(); len(hooks) != 1 || hooks[0].ID != hook.ID {
+		t.Errorf("Webhooks() = %+v", hooks)
+	}
+	if err := w.Delete(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Webhook(hook.ID); !errors.Is(err, ErrWebhookNotFound) {
+		t.Errorf("Webhook() after Delete() error = %v, want ErrWebhookNotFound", err)
+	}
+}
+
+func TestWebhooks_PrivateNetworks(t *testing.T) {
+	w := NewWebhooks(NewHub(), WebhookOptions{}, slog.New(slog.DiscardHandler))
+	t.Cleanup(w.Close)
+
+	for _, url := range []string{
+		"http://localhost:8080/hook",
+		"http://api.localhost/hook",
+		"http://127.0.0.1/hook",
+		"http://10.1.2.3/hook",
+		"http://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://100.64.0.1/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://[fd00::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		if _, err := w.Register(Webhook{URL: url, Secret: "s"}); !errors.Is(err, ErrInvalidWebhook) {
+			t.Errorf("Register(%s) error = %v, want ErrInvalidWebhook", url, err)
+		}
+	}
+	for _, url := range []string{"https://example.com/hook", "http://93.184.215.14/hook", "http://[2606:4700::1111]/hook"} {
+		if _, err := w.Register(Webhook{URL: url, Secret: "s"}); err != nil {
+			t.Errorf("Register(%s) error = %v", url, err)
+		}
+	}
+
+	// a name is only resolved when dialing, which must refuse loopback as
+	// well
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		requests.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	_, err := w.post(Webhook{ID: "hook", URL: server.URL, Secret: "s"}, WebhookPayload{ID: "delivery"})
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("post() error = %v, want the address refused", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("receiver got %d requests, want none", n)
+	}
+}
+
+func TestWebhooks_MaxPending(t *testing.T) {
+	hub := NewHub()
+	w := NewWebhooks(hub, WebhookOptions{
+		MaxAttempts: 10,
+		// failed deliveries stay pending for the rest of the test
+		InitialBackoff:       time.Hour,
+		MaxPending:           2,
+		MaxQueue:             3,
+		AllowPrivateNetworks: true,
+	}, slog.New(slog.DiscardHandler))
+	t.Cleanup(w.Close)
+
+	_, server := newReceiver(t, "s3cret", func(int) int { return http.StatusServiceUnavailable })
+	first, err := w.Register(Webhook{URL: server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the third delivery exceeds the webhook's limit
+	hub.Publish(Result{ID: "a"}, Result{ID: "b"}, Result{ID: "c"})
+	d := waitDelivery(t, w, first.ID, "c", DeliveryDead)
+	if d.Attempts != 0 || d.LastError != ErrDeliveryQueueFull.Error() {
+		t.Errorf("overflowing delivery = %+v", d)
+	}
+	waitDelivery(t, w, first.ID, "a", DeliveryPending)
+	waitDelivery(t, w, first.ID, "b", DeliveryPending)
+
+	second, err := w.Register(Webhook{URL: server.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second webhook's first delivery fills the queue, so its next one
+	// exceeds MaxQueue
+	hub.Publish(Result{ID: "d"})
+	waitDelivery(t, w, second.ID, "d", DeliveryPending)
+	hub.Publish(Result{ID: "e"})
+	waitDelivery(t, w, second.ID, "e", DeliveryDead)
+
+	if dead := w.DeadLetters(); len(dead) != 4 {
+		t.Errorf("got %d dead letters, want 4: %+v", len(dead), dead)
+	}
+	if _, err := w.Redeliver(first.ID, d.ID); !errors.Is(err, ErrDeliveryQueueFull) {
+		t.Errorf("Redeliver() error = %v, want ErrDeliveryQueueFull", err)
+	}
+
+	// deleting a webhook frees its share of the queue
+	if err := w.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	hub.Publish(Result{ID: "f"})
+	waitDelivery(t, w, second.ID, "f", DeliveryPending)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := WebhookSignature("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("WebhookSignature() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"github.com/leandersteiner/interview-assignment/internal/calculator"
+	"github.com/leandersteiner/interview-assignment/internal/handlers/middleware"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime/debug"
+	"time"
+)
+
+type AdminConfig struct {
+	Logger *slog.Logger
+	// Level is the level of the logger, changed with PUT /loglevel.
+	Level *slog.LevelVar
+	Store calculator.Store
+	// Config is served at /config. It must not contain secrets.
+	Config any
+}
+
+// NewAdminMux returns the routes for operators: profiling, expvar, build
+// information, the effective configuration, the log level and flushing the
+// store. It must only be served on a listener that is not public.
+func NewAdminMux(cfg AdminConfig) *web.App {
+	app := web.NewApp(
+		cfg.Logger,
+		nil,
+		middleware.Log(cfg.Logger),
+		middleware.Errors(cfg.Logger),
+		middleware.Panic(cfg.Logger),
+	)
+
+	app.Get("", "/debug/pprof/", web.HTTPHandler(http.HandlerFunc(pprof.Index)))
+	app.Get("", "/debug/pprof/cmdline", web.HTTPHandler(http.HandlerFunc(pprof.Cmdline)))
+	app.Get("", "/debug/pprof/profile", web.HTTPHandler(http.HandlerFunc(pprof.Profile)))
+	app.Get("", "/debug/pprof/symbol", web.HTTPHandler(http.HandlerFunc(pprof.Symbol)))
+	app.Post("", "/debug/pprof/symbol", web.HTTPHandler(http.HandlerFunc(pprof.Symbol)))
+	app.Get("", "/debug/pprof/trace", web.HTTPHandler(http.HandlerFunc(pprof.Trace)))
+	app.Get("", "/debug/vars", web.HTTPHandler(expvar.Handler()))
+
+	app.Get("", "/buildinfo", buildInfo)
+	app.Get("", "/config", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return web.Respond(ctx, w, cfg.Config, http.StatusOK)
+	})
+	app.Get("", "/loglevel", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return web.Respond(ctx, w, LogLevel{Level: cfg.Level.Level().String()}, http.StatusOK)
+	})
+	app.Put("", "/loglevel", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		req := LogLevel{}
+		if err := web.Decode(r, &req); err != nil {
+			return err
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			return web.NewError(http.StatusBadRequest, err.Error())
+		}
+
+		previous := cfg.Level.Level()
+		cfg.Level.Set(level)
+		cfg.Logger.Info("log level changed", "from", previous, "to", level)
+		return web.Respond(ctx, w, LogLevel{Level: level.String()}, http.StatusOK)
+	})
+	app.Post("", "/store/flush", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		saver, ok := cfg.Store.(interface{ Save() error })
+		if !ok {
+			return web.NewError(http.StatusNotImplemented, "the store does not support flushing")
+		}
+
+		start := time.Now()
+		if err := saver.Save(); err != nil {
+			return web.WrapError(http.StatusServiceUnavailable, "the store could not be flushed", err)
+		}
+		return web.Respond(ctx, w, FlushResponse{Duration: time.Since(start).String()}, http.StatusOK)
+	})
+
+	return app
+}
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+type FlushResponse struct {
+	Duration string `json:"duration"`
+}
+
+type BuildInfo struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path"`
+	Main      Module            `json:"main"`
+	Deps      []Module          `json:"deps"`
+	Settings  map[string]string `json:"settings"`
+}
+
+type Module struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+}
+
+func buildInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return web.NewError(http.StatusNotFound, "the binary has no build information")
+	}
+
+	resp := BuildInfo{
+		GoVersion: info.GoVersion,
+		Path:      info.Path,
+		Main:      Module{Path: info.Main.Path, Version: info.Main.Version, Sum: info.Main.Sum},
+		Deps:      make([]Module, len(info.Deps)),
+		Settings:  make(map[string]string, len(info.Settings)),
+	}
+	for i, dep := range info.Deps {
+		resp.Deps[i] = Module{Path: dep.Path, Version: dep.Version, Sum: dep.Sum}
+	}
+	for _, setting := range info.Settings {
+		resp.Settings[setting.Key] = setting.Value
+	}
+	return web.Respond(ctx, w, resp, http.StatusOK)
+}
@@ -1,36 +1,104 @@
 package handlers
 
 import (
-	"context"
 	"github.com/leandersteiner/interview-assignment/internal/calculator"
 	"github.com/leandersteiner/interview-assignment/internal/handlers/middleware"
 	"github.com/leandersteiner/interview-assignment/internal/web"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 type MuxConfig struct {
-	Logger *slog.Logger
-	Store  calculator.Store
+	Logger       *slog.Logger
+	Store        calculator.Store
+	Mode         calculator.Mode
+	MaxBatchSize int
+	Hub          *calculator.Hub
+	// StreamHeartbeat defaults to calculator.DefaultStreamHeartbeat.
+	StreamHeartbeat time.Duration
+	// SessionPingInterval defaults to calculator.DefaultSessionPingInterval.
+	SessionPingInterval time.Duration
+	// SessionAllowedOrigins may open sessions besides the API's own origin.
+	SessionAllowedOrigins []string
+	Webhooks              *calculator.Webhooks
+	// Tracer traces sampled requests; tracing is disabled if it is nil.
+	Tracer *web.Tracer
+	// Metrics is served at /metrics. It defaults to a new registry and must
+	// not be shared between muxes, since every mux registers its series.
+	Metrics *web.Registry
+	// Health serves /livez and /readyz. It defaults to a registry without
+	// checks that is ready.
+	Health *web.Health
 }
 
-func NewMux(cfg MuxConfig) http.Handler {
+func NewMux(cfg MuxConfig) *web.App {
+	metrics := cfg.Metrics
+	if metrics == nil {
+		metrics = web.NewRegistry()
+	}
+	web.RegisterRuntimeMetrics(metrics)
+
 	app := web.NewApp(
 		cfg.Logger,
-		middleware.Panic(cfg.Logger),
+		cfg.Tracer,
+		middleware.Metrics(metrics),
 		middleware.Log(cfg.Logger),
 		middleware.Errors(cfg.Logger),
+		middleware.Panic(cfg.Logger),
 	)
 
-	app.Get("", "/healthz", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-		return web.Respond(ctx, w, struct {
-			Status string `json:"status"`
-		}{
-			Status: "ok",
-		}, http.StatusOK)
-	})
+	health := cfg.Health
+	if health == nil {
+		health = web.NewHealth()
+		health.SetState(web.HealthReady)
+	}
+	probes(app, health)
+	app.Get("", "/metrics", web.MetricsHandler(metrics))
 
-	calculator.V1Routes(app, calculator.Config{Logger: cfg.Logger, Store: cfg.Store})
+	calculator.V1Routes(app, calculator.Config{
+		Logger:                cfg.Logger,
+		Store:                 cfg.Store,
+		Mode:                  cfg.Mode,
+		MaxBatchSize:          cfg.MaxBatchSize,
+		Hub:                   cfg.Hub,
+		StreamHeartbeat:       cfg.StreamHeartbeat,
+		SessionPingInterval:   cfg.SessionPingInterval,
+		SessionAllowedOrigins: cfg.SessionAllowedOrigins,
+		Webhooks:              cfg.Webhooks,
+		Metrics:               metrics,
+	})
 
 	return app
 }
+
+// NewStartupMux serves the probes while the store is loading and refuses all
+// other requests until the mux of NewMux takes over.
+func NewStartupMux(logger *slog.Logger, health *web.Health) http.Handler {
+	app := web.NewApp(
+		logger,
+		nil,
+		middleware.Errors(logger),
+		middleware.Panic(logger),
+	)
+	probes(app, health)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/livez", "/readyz", "/healthz":
+			app.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":"the service is starting"}`))
+	})
+}
+
+func probes(app *web.App, health *web.Health) {
+	app.Get("", "/livez", health.Livez)
+	app.Get("", "/readyz", health.Readyz)
+	// Deprecated: /healthz predates the split into /livez and /readyz.
+	app.Get("", "/healthz", health.Livez)
+}
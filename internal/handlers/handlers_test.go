@@ -0,0 +1,1273 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leandersteiner/interview-assignment/internal/calculator"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingStore fails every write and read with err.
+type failingStore struct {
+	*calculator.ResultStore
+	err error
+}
+
+func (s failingStore) Store(context.Context, calculator.Result) error {
+	return s.err
+}
+
+func (s failingStore) Get(context.Context, calculator.Query) (calculator.PaginatedResult[[]calculator.Result], error) {
+	return calculator.PaginatedResult[[]calculator.Result]{}, s.err
+}
+
+func TestNewMux_StorageErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "unavailable store",
+			err:        fmt.Errorf("%w: disk full", calculator.ErrStoreUnavailable),
+			method:     http.MethodPost,
+			path:       "/api/v1/calculator/addition",
+			body:       `{"summand_one": 1, "summand_two": 2}`,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "broken store",
+			err:        errors.New("disk on fire"),
+			method:     http.MethodPost,
+			path:       "/api/v1/calculator/evaluate",
+			body:       `{"expression": "1 + 2"}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "timed out read",
+			err:        context.DeadlineExceeded,
+			method:     http.MethodGet,
+			path:       "/api/v1/calculator/recent",
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "broken read",
+			err:        errors.New("disk on fire"),
+			method:     http.MethodGet,
+			path:       "/api/v1/calculator/recent",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := NewMux(MuxConfig{
+				Logger: slog.New(slog.DiscardHandler),
+				Store:  failingStore{calculator.NewResultStore(), tt.err},
+				Mode:   calculator.ModeFloat,
+			})
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if strings.Contains(rec.Body.String(), "disk") {
+				t.Errorf("response leaks the cause: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewMux_MissingOperands(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "original operations default to zero",
+			path:       "/api/v1/calculator/addition",
+			body:       `{"summand_one": 2}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"sum":2`,
+		},
+		{
+			name:       "all operands of an original operation missing",
+			path:       "/api/v1/calculator/multiplication",
+			body:       `{}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"product":0`,
+		},
+		{
+			name:       "newer operations require every operand",
+			path:       "/api/v1/calculator/power",
+			body:       `{"base": 2}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `missing operand \"exponent\"`,
+		},
+	}
+
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("response = %d %s, want %d with %s", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+type event struct {
+	id, name, data string
+	comment        bool
+}
+
+// readEvents parses Server-Sent Events from r and sends them to the returned
+// channel until r fails.
+func readEvents(r io.Reader) <-chan event {
+	events := make(chan event)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(r)
+		var e event
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				events <- e
+				e = event{}
+			case strings.HasPrefix(line, ":"):
+				e.comment = true
+			default:
+				field, value, _ := strings.Cut(line, ": ")
+				switch field {
+				case "id":
+					e.id = value
+				case "event":
+					e.name = value
+				case "data":
+					e.data = value
+				}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan event, comments bool) event {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			if e.comment == comments {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("no event within 2s")
+		}
+	}
+}
+
+func TestNewMux_Stream(t *testing.T) {
+	hub := calculator.NewHub()
+	mux := NewMux(MuxConfig{
+		Logger:          slog.New(slog.DiscardHandler),
+		Store:           calculator.NewResultStore(),
+		Mode:            calculator.ModeFloat,
+		Hub:             hub,
+		StreamHeartbeat: 20 * time.Millisecond,
+	})
+	// the stream has to outlive the timeout of all other routes
+	server := httptest.NewServer(web.TimeoutHandler(mux, 100*time.Millisecond, "request timed out"))
+	defer server.Close()
+	defer hub.Close()
+
+	add := func(a, b int) string {
+		t.Helper()
+		body := fmt.Sprintf(`{"summand_one": %d, "summand_two": %d}`, a, b)
+		resp, err := http.Post(server.URL+"/api/v1/calculator/addition", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result.ID
+	}
+	stream := func(lastEventID string) <-chan event {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL+"/api/v1/calculator/recent/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+			t.Fatalf("stream responded %d with %q", resp.StatusCode, ct)
+		}
+		return readEvents(resp.Body)
+	}
+
+	first := add(1, 2)
+	second := add(3, 4)
+
+	live := stream("")
+	time.Sleep(150 * time.Millisecond)
+	nextEvent(t, live, true)
+	third := add(5, 6)
+	if e := nextEvent(t, live, false); e.id != third || e.name != "result" || !strings.Contains(e.data, `"value":11`) {
+		t.Errorf("live event = %+v, want result %s", e, third)
+	}
+
+	resumed := stream(first)
+	for _, want := range []string{second, third} {
+		if e := nextEvent(t, resumed, false); e.id != want {
+			t.Errorf("resumed event id = %q, want %q", e.id, want)
+		}
+	}
+	fourth := add(7, 8)
+	if e := nextEvent(t, resumed, false); e.id != fourth {
+		t.Errorf("resumed live event id = %q, want %q", e.id, fourth)
+	}
+
+	// closing the hub, as on shutdown, ends the streams
+	hub.Close()
+	for range live {
+	}
+}
+
+// wsClient is a minimal WebSocket client speaking the frames of RFC 6455.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialSession(t *testing.T, serverURL string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, err := http.NewRequest(http.MethodGet, serverURL+"/api/v1/calculator/session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the accept value of the key from RFC 6455 section 1.3
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake responded %d with accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &wsClient{conn, br}
+}
+
+// writeFrame writes a masked frame, as clients must.
+func (c *wsClient) writeFrame(t *testing.T, fin bool, opcode web.MessageType, payload []byte) {
+	t.Helper()
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsClient) readFrame(t *testing.T) (web.MessageType, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return web.MessageType(header[0] & 0x0f), payload
+}
+
+func (c *wsClient) send(t *testing.T, msg string) {
+	t.Helper()
+	c.writeFrame(t, true, web.TextMessage, []byte(msg))
+}
+
+// receive returns the next message, answering pings.
+func (c *wsClient) receive(t *testing.T) calculator.SessionResponse {
+	t.Helper()
+	for {
+		opcode, payload := c.readFrame(t)
+		switch opcode {
+		case web.PingMessage:
+			c.writeFrame(t, true, web.PongMessage, payload)
+		case web.TextMessage:
+			var resp calculator.SessionResponse
+			if err := json.Unmarshal(payload, &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		default:
+			t.Fatalf("got frame %d %q, want a message", opcode, payload)
+		}
+	}
+}
+
+// closeCode returns the code of the next close frame, skipping everything
+// else.
+func (c *wsClient) closeCode(t *testing.T) int {
+	t.Helper()
+	for {
+		opcode, payload := c.readFrame(t)
+		if opcode == web.CloseMessage {
+			if len(payload) < 2 {
+				t.Fatalf("close frame without code")
+			}
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func TestNewMux_Session(t *testing.T) {
+	hub := calculator.NewHub()
+	mux := NewMux(MuxConfig{
+		Logger:                slog.New(slog.DiscardHandler),
+		Store:                 calculator.NewResultStore(),
+		Mode:                  calculator.ModeFloat,
+		Hub:                   hub,
+		SessionPingInterval:   50 * time.Millisecond,
+		SessionAllowedOrigins: []string{"https://app.example.com"},
+	})
+	server := httptest.NewServer(web.TimeoutHandler(mux, 100*time.Millisecond, "request timed out"))
+	defer server.Close()
+	defer hub.Close()
+
+	t.Run("requests", func(t *testing.T) {
+		c := dialSession(t, server.URL)
+
+		c.send(t, `{"id":"sub","type":"subscribe"}`)
+		if resp := c.receive(t); resp.ID != "sub" || resp.Type != calculator.SessionSubscribed {
+			t.Fatalf("subscribe answered %+v", resp)
+		}
+
+		// the session outlives the timeout of all other routes as long as
+		// the client answers pings
+		for start := time.Now(); time.Since(start) < 150*time.Millisecond; {
+			if opcode, payload := c.readFrame(t); opcode == web.PingMessage {
+				c.writeFrame(t, true, web.PongMessage, payload)
+			}
+		}
+
+		tests := []struct {
+			msg        string
+			wantType   string
+			wantValue  string
+			wantStatus int
+		}{
+			{msg: `{"id":"1","type":"calculate","op":"addition","operands":[1,2]}`, wantType: calculator.SessionResult, wantValue: "3"},
+			{msg: `{"id":"2","type":"calculate","op":"/","operands":["1","3"],"mode":"decimal"}`, wantType: calculator.SessionResult, wantValue: "0.3333"},
+			{msg: `{"id":"3","type":"evaluate","expression":"2 * (3 + 4)"}`, wantType: calculator.SessionResult, wantValue: "14"},
+			{msg: `{"id":"4","type":"calculate","op":"division","operands":[1,0]}`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+			{msg: `{"id":"5","type":"calculate","op":"unknown","operands":[1]}`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+			{msg: `{"id":"6","type":"evaluate","expression":"1 +","mode":"roman"}`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+			{msg: `{"id":"7","type":"nonsense"}`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+			{msg: `{"id":"8","type":"unsubscribe","subscription":"missing"}`, wantType: calculator.SessionError, wantStatus: http.StatusNotFound},
+			{msg: `{"id":"sub","type":"subscribe"}`, wantType: calculator.SessionError, wantStatus: http.StatusConflict},
+			{msg: `{"type":"evaluate"}`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+			{msg: `not json`, wantType: calculator.SessionError, wantStatus: http.StatusBadRequest},
+		}
+
+		var stored []string
+		for _, tt := range tests {
+			c.send(t, tt.msg)
+			resp := c.receive(t)
+			// events of the subscription may arrive before the result
+			for resp.Type == calculator.SessionEvent {
+				stored = append(stored, resp.Result.ID)
+				resp = c.receive(t)
+			}
+
+			var want calculator.SessionRequest
+			_ = json.Unmarshal([]byte(tt.msg), &want)
+			if resp.ID != want.ID || resp.Type != tt.wantType || resp.Status != tt.wantStatus {
+				t.Errorf("%s answered %+v", tt.msg, resp)
+			}
+			if tt.wantValue != "" && (resp.Result == nil || string(resp.Result.Value) != tt.wantValue) {
+				t.Errorf("%s answered %+v, want value %s", tt.msg, resp.Result, tt.wantValue)
+			}
+		}
+
+		for len(stored) < 3 {
+			resp := c.receive(t)
+			if resp.ID != "sub" || resp.Type != calculator.SessionEvent {
+				t.Fatalf("got %+v, want an event of the subscription", resp)
+			}
+			stored = append(stored, resp.Result.ID)
+		}
+
+		c.send(t, `{"id":"9","type":"unsubscribe","subscription":"sub"}`)
+		if resp := c.receive(t); resp.ID != "9" || resp.Type != calculator.SessionUnsubscribed {
+			t.Errorf("unsubscribe answered %+v", resp)
+		}
+
+		// a resumed subscription first replays the results after the ID
+		c.send(t, fmt.Sprintf(`{"id":"resume","type":"subscribe","after":%q}`, stored[0]))
+		if resp := c.receive(t); resp.Type != calculator.SessionSubscribed {
+			t.Fatalf("subscribe answered %+v", resp)
+		}
+		for _, want := range stored[1:] {
+			if resp := c.receive(t); resp.ID != "resume" || resp.Result == nil || resp.Result.ID != want {
+				t.Errorf("replayed %+v, want %s", resp, want)
+			}
+		}
+
+		c.writeFrame(t, true, web.CloseMessage, binary.BigEndian.AppendUint16(nil, web.CloseNormal))
+		if code := c.closeCode(t); code != web.CloseNormal {
+			t.Errorf("close answered with %d", code)
+		}
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		c := dialSession(t, server.URL)
+		if opcode, _ := c.readFrame(t); opcode != web.PingMessage {
+			t.Fatalf("got frame %d, want a ping", opcode)
+		}
+		c.writeFrame(t, true, web.PingMessage, []byte("hi"))
+		opcode, payload := c.readFrame(t)
+		for opcode == web.PingMessage {
+			opcode, payload = c.readFrame(t)
+		}
+		if opcode != web.PongMessage || string(payload) != "hi" {
+			t.Errorf("got frame %d %q, want the pong", opcode, payload)
+		}
+
+		// without pongs the session ends after two ping intervals
+		start := time.Now()
+		if _, err := io.ReadAll(c.br); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("silent client was disconnected after %v", elapsed)
+		}
+	})
+
+	t.Run("subscription limit", func(t *testing.T) {
+		c := dialSession(t, server.URL)
+		for i := range calculator.MaxSessionSubscriptions {
+			c.send(t, fmt.Sprintf(`{"id":"sub%d","type":"subscribe"}`, i))
+			if resp := c.receive(t); resp.Type != calculator.SessionSubscribed {
+				t.Fatalf("subscribe %d answered %+v", i, resp)
+			}
+		}
+		c.send(t, `{"id":"over","type":"subscribe"}`)
+		if resp := c.receive(t); resp.ID != "over" || resp.Type != calculator.SessionError || resp.Status != http.StatusTooManyRequests {
+			t.Errorf("subscribe over the limit answered %+v", resp)
+		}
+
+		// ending a subscription frees its slot
+		c.send(t, `{"id":"u","type":"unsubscribe","subscription":"sub0"}`)
+		if resp := c.receive(t); resp.Type != calculator.SessionUnsubscribed {
+			t.Fatalf("unsubscribe answered %+v", resp)
+		}
+		c.send(t, `{"id":"over","type":"subscribe"}`)
+		if resp := c.receive(t); resp.ID != "over" || resp.Type != calculator.SessionSubscribed {
+			t.Errorf("subscribe after unsubscribe answered %+v", resp)
+		}
+	})
+
+	t.Run("fragmented message", func(t *testing.T) {
+		c := dialSession(t, server.URL)
+		c.writeFrame(t, false, web.TextMessage, []byte(`{"id":"f","type":"eval`))
+		c.writeFrame(t, true, web.PingMessage, nil)
+		c.writeFrame(t, true, 0, []byte(`uate","expression":"6 / 3"}`))
+		if opcode, _ := c.readFrame(t); opcode != web.PongMessage {
+			t.Errorf("got frame %d, want a pong between the fragments", opcode)
+		}
+		if resp := c.receive(t); resp.ID != "f" || resp.Result == nil || resp.Result.Value != "2" {
+			t.Errorf("fragmented message answered %+v", resp)
+		}
+	})
+
+	for _, tt := range []struct {
+		name     string
+		write    func(c *wsClient)
+		wantCode int
+	}{
+		{
+			name: "message too large",
+			write: func(c *wsClient) {
+				c.send(t, `{"id":"big","type":"evaluate","expression":"`+strings.Repeat("1+", calculator.MaxSessionMessageSize)+`1"}`)
+			},
+			wantCode: web.CloseTooLarge,
+		},
+		{
+			name:     "binary message",
+			write:    func(c *wsClient) { c.writeFrame(t, true, web.BinaryMessage, []byte{1}) },
+			wantCode: web.CloseUnsupportedData,
+		},
+		{
+			name:     "invalid UTF-8",
+			write:    func(c *wsClient) { c.writeFrame(t, true, web.TextMessage, []byte{0xff}) },
+			wantCode: web.CloseInvalidPayload,
+		},
+		{
+			name: "unmasked frame",
+			write: func(c *wsClient) {
+				if _, err := c.conn.Write([]byte{0x81, 0x01, 'x'}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCode: web.CloseProtocolError,
+		},
+		{
+			name:     "fragmented control frame",
+			write:    func(c *wsClient) { c.writeFrame(t, false, web.PingMessage, nil) },
+			wantCode: web.CloseProtocolError,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialSession(t, server.URL)
+			tt.write(c)
+			if code := c.closeCode(t); code != tt.wantCode {
+				t.Errorf("closed with %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+
+	t.Run("not a WebSocket", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/calculator/session")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUpgradeRequired {
+			t.Errorf("plain GET responded %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+		}
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		tests := []struct {
+			origin     string
+			wantStatus int
+		}{
+			{server.URL, http.StatusSwitchingProtocols},
+			{"https://app.example.com", http.StatusSwitchingProtocols},
+			{"https://evil.example.com", http.StatusForbidden},
+			{"null", http.StatusForbidden},
+		}
+		for _, tt := range tests {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/calculator/session", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Origin", tt.origin)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("handshake from %s responded %d, want %d", tt.origin, resp.StatusCode, tt.wantStatus)
+			}
+		}
+	})
+
+	// closing the hub, as on shutdown, closes the sessions
+	t.Run("shutdown", func(t *testing.T) {
+		c := dialSession(t, server.URL)
+		c.send(t, `{"id":"sub","type":"subscribe"}`)
+		c.receive(t)
+		hub.Close()
+		if code := c.closeCode(t); code != web.CloseGoingAway {
+			t.Errorf("closed with %d, want %d", code, web.CloseGoingAway)
+		}
+	})
+}
+
+func TestNewMux_Webhooks(t *testing.T) {
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Webhook-Signature") != calculator.WebhookSignature("s3cret", r.Header.Get("X-Webhook-Timestamp"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received <- r.Header.Get("X-Webhook-Delivery")
+	}))
+	defer receiver.Close()
+
+	hub := calculator.NewHub()
+	// the receiver listens on loopback
+	webhooks := calculator.NewWebhooks(hub, calculator.WebhookOptions{AllowPrivateNetworks: true}, slog.New(slog.DiscardHandler))
+	defer webhooks.Close()
+	server := httptest.NewServer(NewMux(MuxConfig{
+		Logger:   slog.New(slog.DiscardHandler),
+		Store:    calculator.NewResultStore(),
+		Mode:     calculator.ModeFloat,
+		Hub:      hub,
+		Webhooks: webhooks,
+	}))
+	defer server.Close()
+	base := server.URL + "/api/v1/calculator"
+
+	do := func(method, path, body string, wantStatus int, v any) {
+		t.Helper()
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			data, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s %s responded %d %s, want %d", method, path, resp.StatusCode, data, wantStatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	do(http.MethodPost, "/webhooks", `{"url":"not a url","secret":"s"}`, http.StatusBadRequest, nil)
+	do(http.MethodPost, "/webhooks", `{"url":"http://example.com","secret":"s","filter":{"operators":["nonexistent"]}}`, http.StatusBadRequest, nil)
+
+	var hook calculator.WebhookResponse
+	body := fmt.Sprintf(`{"url":%q,"secret":"s3cret","filter":{"operators":["*"],"min":10}}`, receiver.URL)
+	do(http.MethodPost, "/webhooks", body, http.StatusCreated, &hook)
+	if len(hook.Filter.Operators) != 1 || hook.Filter.Operators[0] != "multiplication" {
+		t.Errorf("registered filter %+v, want the operator by name", hook.Filter)
+	}
+
+	do(http.MethodPost, "/multiplication", `{"factor_one":2,"factor_two":3}`, http.StatusOK, nil)
+	do(http.MethodPost, "/multiplication", `{"factor_one":4,"factor_two":5}`, http.StatusOK, nil)
+
+	var delivery string
+	select {
+	case delivery = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery within 2s")
+	}
+
+	var deliveries calculator.DeliveriesResponse
+	for range 100 {
+		do(http.MethodGet, "/webhooks/"+hook.ID+"/deliveries?status=delivered", "", http.StatusOK, &deliveries)
+		if len(deliveries.Deliveries) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deliveries.Deliveries) != 1 || deliveries.Deliveries[0].ID != delivery || deliveries.Deliveries[0].Attempts != 1 {
+		t.Errorf("deliveries = %+v, want only %s", deliveries.Deliveries, delivery)
+	}
+
+	do(http.MethodGet, "/webhooks/dead-letters", "", http.StatusOK, &deliveries)
+	if len(deliveries.Deliveries) != 0 {
+		t.Errorf("dead letters = %+v", deliveries.Deliveries)
+	}
+	do(http.MethodPost, "/webhooks/"+hook.ID+"/deliveries/"+delivery+"/redeliver", "", http.StatusConflict, nil)
+	do(http.MethodDelete, "/webhooks/"+hook.ID, "", http.StatusNoContent, nil)
+	do(http.MethodGet, "/webhooks/"+hook.ID, "", http.StatusNotFound, nil)
+}
+
+func TestNewMux_TraceContext(t *testing.T) {
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+	})
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		traceparent string
+		tracestate  string
+		wantTraceID string
+		wantFlags   string
+		wantState   string
+	}{
+		{name: "new trace", wantFlags: "01"},
+		{name: "continued", traceparent: "00-" + traceID + "-" + parentID + "-01", tracestate: "congo=t61rcWkgMzE", wantTraceID: traceID, wantFlags: "01", wantState: "congo=t61rcWkgMzE"},
+		{name: "not sampled", traceparent: "00-" + traceID + "-" + parentID + "-00", wantTraceID: traceID, wantFlags: "00"},
+		{name: "future version", traceparent: "cc-" + traceID + "-" + parentID + "-01-extra", wantTraceID: traceID, wantFlags: "01"},
+		{name: "uppercase", traceparent: "00-" + strings.ToUpper(traceID) + "-" + parentID + "-01", tracestate: "congo=t61rcWkgMzE", wantFlags: "01"},
+		{name: "zero trace ID", traceparent: "00-" + strings.Repeat("0", 32) + "-" + parentID + "-01", wantFlags: "01"},
+		{name: "zero parent ID", traceparent: "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", wantFlags: "01"},
+		{name: "invalid version", traceparent: "ff-" + traceID + "-" + parentID + "-01", wantFlags: "01"},
+		{name: "extra field in version 00", traceparent: "00-" + traceID + "-" + parentID + "-01-extra", wantFlags: "01"},
+		{name: "garbage", traceparent: "traceid", wantFlags: "01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			if tt.tracestate != "" {
+				req.Header.Set("tracestate", tt.tracestate)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			gotTraceID, spanID, flags, ok := web.ParseTraceparent(rec.Header().Get("traceparent"))
+			if !ok {
+				t.Fatalf("invalid traceparent %q", rec.Header().Get("traceparent"))
+			}
+			if tt.wantTraceID != "" && gotTraceID != tt.wantTraceID {
+				t.Errorf("trace ID = %q, want %q", gotTraceID, tt.wantTraceID)
+			}
+			if tt.wantTraceID == "" && gotTraceID == traceID {
+				t.Error("invalid traceparent was continued")
+			}
+			if spanID == parentID {
+				t.Error("span ID of the caller was reused")
+			}
+			if got := fmt.Sprintf("%02x", flags); got != tt.wantFlags {
+				t.Errorf("flags = %s, want %s", got, tt.wantFlags)
+			}
+			if got := rec.Header().Get("tracestate"); got != tt.wantState {
+				t.Errorf("tracestate = %q, want %q", got, tt.wantState)
+			}
+			if got := rec.Header().Get("X-Request-ID"); got != gotTraceID {
+				t.Errorf("X-Request-ID = %q, want the trace ID %q", got, gotTraceID)
+			}
+		})
+	}
+}
+
+func TestNewMux_Tracing(t *testing.T) {
+	recorder := web.NewRecorder()
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+		Tracer: web.NewTracer(recorder),
+	})
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	send := func(traceparent string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculator/division", strings.NewReader(body))
+		req.Header.Set("traceparent", traceparent)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("00-"+traceID+"-"+parentID+"-01", `{"dividend": 1, "divisor": 2}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	spans := map[string]web.SpanData{}
+	ids := map[string]bool{}
+	for _, span := range recorder.Spans() {
+		spans[span.Name] = span
+		ids[span.SpanID] = true
+	}
+	root, ok := spans["POST /api/v1/calculator/division"]
+	if !ok {
+		t.Fatalf("no server span in %v", recorder.Spans())
+	}
+	_, spanID, _, _ := web.ParseTraceparent(rec.Header().Get("traceparent"))
+	if root.Kind != web.SpanKindServer || root.SpanID != spanID || root.ParentSpanID != parentID {
+		t.Errorf("server span = %+v, want span %s with parent %s", root, spanID, parentID)
+	}
+
+	for _, name := range []string{"middleware.Log", "middleware.Errors", "middleware.Panic", "Handler.Operation", "web.Decode", "Service.Calculate", "Service.compute", "Service.store", "ResultStore.StoreMany"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.TraceID != traceID || !ids[span.ParentSpanID] || span.Kind != web.SpanKindInternal {
+			t.Errorf("%s span = %+v, want a child within trace %s", name, span, traceID)
+		}
+		if span.End.Before(span.Start) {
+			t.Errorf("%s span ended before it started", name)
+		}
+	}
+	if span := spans["ResultStore.StoreMany"]; !hasAttr(span.Attributes, "lock.wait") {
+		t.Errorf("ResultStore.StoreMany attributes = %v, want lock.wait", span.Attributes)
+	}
+	if span := spans["Service.store"]; span.ParentSpanID != spans["Service.Calculate"].SpanID {
+		t.Errorf("Service.store is not a child of Service.Calculate")
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		recorder.Reset()
+		send("00-"+traceID+"-"+parentID+"-01", `{"dividend": 1, "divisor": 0}`)
+
+		for _, span := range recorder.Spans() {
+			if span.Name == "Service.Calculate" && span.Error == "" {
+				t.Errorf("Service.Calculate span has no error")
+			}
+		}
+	})
+
+	t.Run("not sampled", func(t *testing.T) {
+		recorder.Reset()
+		send("00-"+traceID+"-"+parentID+"-00", `{"dividend": 1, "divisor": 2}`)
+
+		if spans := recorder.Spans(); len(spans) != 0 {
+			t.Errorf("recorded %d spans of an unsampled request", len(spans))
+		}
+	})
+}
+
+func TestNewMux_TraceFile(t *testing.T) {
+	path := t.TempDir() + "/traces.jsonl"
+	exporter, err := web.NewFileExporter(path, "calculator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+		Tracer: web.NewTracer(exporter),
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/calculator/evaluate", strings.NewReader(`{"expression": "1 / 0"}`)))
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// spans of hijacked connections may end after Close
+	exporter.ExportSpan(web.SpanData{})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+
+	var failed bool
+	for _, span := range spans {
+		if span["name"] == "Service.Evaluate" {
+			status, _ := span["status"].(map[string]any)
+			failed = status["code"] == float64(2)
+		}
+	}
+	if len(spans) == 0 || !failed {
+		t.Errorf("spans = %v, want a failed Service.Evaluate span", spans)
+	}
+	if exporter.Dropped() != 1 {
+		t.Errorf("Dropped() = %d, want the span exported after Close", exporter.Dropped())
+	}
+}
+
+func hasAttr(attrs []slog.Attr, key string) bool {
+	for _, a := range attrs {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewMux_Metrics(t *testing.T) {
+	store, err := calculator.NewJSONStore(slog.New(slog.DiscardHandler), t.TempDir()+"/results.json", calculator.WALOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  store,
+		Mode:   calculator.ModeFloat,
+	})
+
+	for _, req := range []struct {
+		path string
+		body string
+	}{
+		{"/api/v1/calculator/division", `{"dividend": 1, "divisor": 2}`},
+		{"/api/v1/calculator/division", `{"dividend": 1, "divisor": 0}`},
+		{"/api/v1/calculator/evaluate", `{"expression": "1e308 * 10"}`},
+		{"/api/v1/calculator/evaluate", `{"expression": "2 * 3"}`},
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body)))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/calculator/results/missing", nil))
+
+	mux.Get("", "/panic", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		panic("boom")
+	})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status of a panicking handler = %d, want 500", rec.Code)
+	}
+
+	if err := store.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE http_requests_total counter\n",
+		`http_requests_total{route="/api/v1/calculator/division",method="POST",status="200"} 1` + "\n",
+		`http_requests_total{route="/api/v1/calculator/division",method="POST",status="400"} 1` + "\n",
+		`http_requests_total{route="/api/v1/calculator/results/{id}",method="GET",status="404"} 1` + "\n",
+		`http_requests_total{route="/panic",method="GET",status="500"} 1` + "\n",
+		"# TYPE http_request_duration_seconds histogram\n",
+		`http_request_duration_seconds_bucket{route="/api/v1/calculator/evaluate",method="POST",status="200",le="+Inf"} 1` + "\n",
+		`http_request_duration_seconds_count{route="/api/v1/calculator/evaluate",method="POST",status="200"} 1` + "\n",
+		`calculator_calculations_total{operation="division",mode="float"} 2` + "\n",
+		`calculator_calculations_total{operation="expression",mode="float"} 2` + "\n",
+		`calculator_errors_total{operation="division",error="division_by_zero"} 1` + "\n",
+		`calculator_errors_total{operation="expression",error="overflow"} 1` + "\n",
+		"calculator_store_results 2\n",
+		"calculator_store_saves_total 1\n",
+		"# TYPE go_goroutines gauge\n",
+		"# TYPE go_gc_cycles_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+
+	// every sample line is a name, optional labels and a value
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		if !ok || name == "" || strings.ContainsAny(value, " {}") {
+			t.Errorf("invalid sample %q", line)
+		}
+	}
+}
+
+func TestNewAdminMux(t *testing.T) {
+	path := t.TempDir() + "/results.json"
+	store, err := calculator.NewJSONStore(slog.New(slog.DiscardHandler), path, calculator.WALOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := new(slog.LevelVar)
+	admin := NewAdminMux(AdminConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Level:  level,
+		Store:  store,
+		Config: map[string]string{"store": "wal:///data"},
+	})
+	memory := NewAdminMux(AdminConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Level:  new(slog.LevelVar),
+		Store:  calculator.NewResultStore(),
+	})
+	public := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  store,
+		Mode:   calculator.ModeFloat,
+	})
+
+	tests := []struct {
+		name       string
+		mux        http.Handler
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "pprof", mux: admin, method: http.MethodGet, path: "/debug/pprof/", wantStatus: http.StatusOK, wantBody: "goroutine"},
+		{name: "pprof profile", mux: admin, method: http.MethodGet, path: "/debug/pprof/heap?debug=1", wantStatus: http.StatusOK, wantBody: "heap profile"},
+		{name: "expvar", mux: admin, method: http.MethodGet, path: "/debug/vars", wantStatus: http.StatusOK, wantBody: `"memstats"`},
+		{name: "build info", mux: admin, method: http.MethodGet, path: "/buildinfo", wantStatus: http.StatusOK, wantBody: `"go_version"`},
+		{name: "config", mux: admin, method: http.MethodGet, path: "/config", wantStatus: http.StatusOK, wantBody: `{"store":"wal:///data"}`},
+		{name: "log level", mux: admin, method: http.MethodGet, path: "/loglevel", wantStatus: http.StatusOK, wantBody: `{"level":"INFO"}`},
+		{name: "change log level", mux: admin, method: http.MethodPut, path: "/loglevel", body: `{"level": "debug"}`, wantStatus: http.StatusOK, wantBody: `{"level":"DEBUG"}`},
+		{name: "invalid log level", mux: admin, method: http.MethodPut, path: "/loglevel", body: `{"level": "loud"}`, wantStatus: http.StatusBadRequest},
+		{name: "flush", mux: admin, method: http.MethodPost, path: "/store/flush", wantStatus: http.StatusOK, wantBody: `"duration"`},
+		{name: "flush without persistence", mux: memory, method: http.MethodPost, path: "/store/flush", wantStatus: http.StatusNotImplemented},
+		{name: "pprof not public", mux: public, method: http.MethodGet, path: "/debug/pprof/", wantStatus: http.StatusNotFound},
+		{name: "flush not public", mux: public, method: http.MethodPost, path: "/store/flush", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+
+	if level.Level() != slog.LevelDebug {
+		t.Errorf("level = %v, want the changed level", level.Level())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("store was not flushed: %v", err)
+	}
+}
+
+func TestNewMux_Probes(t *testing.T) {
+	health := web.NewHealth()
+	startup := NewStartupMux(slog.New(slog.DiscardHandler), health)
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+		Health: health,
+	})
+
+	var (
+		mu      sync.Mutex
+		failure error
+	)
+	health.Register("flaky", 0, func(context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return failure
+	})
+	hang := make(chan struct{})
+	defer close(hang)
+	health.Register("ok", time.Second, func(context.Context) error {
+		return nil
+	})
+
+	get := func(t *testing.T, handler http.Handler, path string) (int, web.HealthReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var report web.HealthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, rec.Body)
+		}
+		return rec.Code, report
+	}
+
+	t.Run("starting", func(t *testing.T) {
+		if code, report := get(t, startup, "/readyz"); code != http.StatusServiceUnavailable || report.State != web.HealthStarting {
+			t.Errorf("/readyz = %d %+v, want 503 starting", code, report)
+		}
+		if code, _ := get(t, startup, "/livez"); code != http.StatusOK {
+			t.Errorf("/livez = %d, want 200", code)
+		}
+		rec := httptest.NewRecorder()
+		startup.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/calculator/addition", strings.NewReader(`{}`)))
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request while starting = %d, want 503 with Retry-After", rec.Code)
+		}
+	})
+
+	health.SetState(web.HealthReady)
+
+	t.Run("ready", func(t *testing.T) {
+		if code, report := get(t, mux, "/readyz"); code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 0 {
+			t.Errorf("/readyz = %d %+v, want 200 without checks", code, report)
+		}
+		code, report := get(t, mux, "/readyz?verbose")
+		if code != http.StatusOK || len(report.Checks) != 2 || report.Checks[0].Name != "flaky" {
+			t.Errorf("/readyz?verbose = %d %+v, want all checks by name", code, report)
+		}
+	})
+
+	t.Run("failing check", func(t *testing.T) {
+		mu.Lock()
+		failure = errors.New("disk full")
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			failure = nil
+			mu.Unlock()
+		}()
+
+		code, report := get(t, mux, "/readyz")
+		if code != http.StatusServiceUnavailable || len(report.Checks) != 1 || report.Checks[0].Error != "disk full" {
+			t.Errorf("/readyz = %d %+v, want 503 with the failed check", code, report)
+		}
+		if code, _ := get(t, mux, "/livez"); code != http.StatusOK {
+			t.Errorf("/livez = %d, want 200 despite the failed check", code)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		health.Register("hanging", 10*time.Millisecond, func(context.Context) error {
+			<-hang
+			return nil
+		})
+
+		code, report := get(t, mux, "/readyz")
+		if code != http.StatusServiceUnavailable || len(report.Checks) != 1 || report.Checks[0].Name != "hanging" {
+			t.Errorf("/readyz = %d %+v, want 503 with the hanging check", code, report)
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		health.SetState(web.HealthDraining)
+		if code, report := get(t, mux, "/readyz"); code != http.StatusServiceUnavailable || report.State != web.HealthDraining {
+			t.Errorf("/readyz = %d %+v, want 503 draining", code, report)
+		}
+	})
+}
+
+func TestNewMux_RequestLimits(t *testing.T) {
+	mux := NewMux(MuxConfig{
+		Logger: slog.New(slog.DiscardHandler),
+		Store:  calculator.NewResultStore(),
+		Mode:   calculator.ModeFloat,
+	})
+
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+	}
+	tests := []struct {
+		name       string
+		expression string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "nested", expression: nested(100), wantStatus: http.StatusOK},
+		{name: "nested too deeply", expression: nested(calculator.MaxExpressionDepth), wantStatus: http.StatusBadRequest, wantError: "nested deeper"},
+		{name: "too long", expression: strings.Repeat("1+", calculator.MaxExpressionLength) + "1", wantStatus: http.StatusBadRequest, wantError: "longer than"},
+		// would overflow the stack if it were parsed
+		{name: "body too large", expression: nested(3_000_000), wantStatus: http.StatusRequestEntityTooLarge, wantError: "too large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"expression": tt.expression})
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/calculator/evaluate", bytes.NewReader(body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("body = %.200s, want it to contain %q", rec.Body, tt.wantError)
+			}
+		})
+	}
+}
@@ -11,6 +11,9 @@ import (
 func Errors(logger *slog.Logger) web.Middleware {
 	return func(handler web.Handler) web.Handler {
 		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := web.StartSpan(ctx, "middleware.Errors")
+			defer span.End()
+
 			v, err := web.GetValues(ctx)
 			if err != nil {
 				return err
@@ -18,7 +21,8 @@ func Errors(logger *slog.Logger) web.Middleware {
 
 			err = handler(ctx, w, r)
 			if err != nil {
-				logger.Error("request error", "trace_id", v.TraceID, "method", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr, "error", err)
+				span.RecordError(err)
+				logger.Error("request error", "trace_id", v.TraceID, "span_id", v.SpanID, "method", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr, "error", err)
 
 				var webErr *web.Error
 				if errors.As(err, &webErr) {
@@ -26,7 +30,9 @@ func Errors(logger *slog.Logger) web.Middleware {
 					return nil
 				}
 
-				err = web.Respond(ctx, w, err, http.StatusInternalServerError)
+				// unknown errors may contain internals, so they are not sent
+				internal := web.NewError(http.StatusInternalServerError, "There was an internal server error")
+				err = web.Respond(ctx, w, internal, internal.Status)
 				if err != nil {
 					return err
 				}
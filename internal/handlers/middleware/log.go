@@ -12,6 +12,9 @@ import (
 func Log(logger *slog.Logger) web.Middleware {
 	return func(next web.Handler) web.Handler {
 		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := web.StartSpan(ctx, "middleware.Log")
+			defer span.End()
+
 			v, err := web.GetValues(ctx)
 			if err != nil {
 				return err
@@ -20,6 +23,7 @@ func Log(logger *slog.Logger) web.Middleware {
 			logger.Info(
 				"request started",
 				slog.String("trace_id", v.TraceID),
+				slog.String("span_id", v.SpanID),
 				slog.String("method", r.Method),
 				slog.String("path", r.URL.Path),
 				slog.String("ip", strings.Split(r.RemoteAddr, ":")[0]),
@@ -30,6 +34,7 @@ func Log(logger *slog.Logger) web.Middleware {
 			logger.Info(
 				"request finished",
 				slog.String("trace_id", v.TraceID),
+				slog.String("span_id", v.SpanID),
 				slog.String("method", r.Method),
 				slog.String("path", r.URL.Path),
 				slog.String("ip", strings.Split(r.RemoteAddr, ":")[0]),
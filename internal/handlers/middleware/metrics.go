@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"context"
+	"github.com/leandersteiner/interview-assignment/internal/web"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics counts requests and their latency by route, method and status.
+func Metrics(reg *web.Registry) web.Middleware {
+	requests := reg.Counter("http_requests_total", "Handled HTTP requests.", "route", "method", "status")
+	durations := reg.Histogram("http_request_duration_seconds", "Latency of handled HTTP requests.", web.DefaultBuckets, "route", "method", "status")
+
+	return func(next web.Handler) web.Handler {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			v, err := web.GetValues(ctx)
+			if err != nil {
+				return err
+			}
+
+			err = next(ctx, w, r)
+
+			route, status := web.Route(r), strconv.Itoa(v.StatusCode)
+			requests.Inc(route, r.Method, status)
+			durations.Observe(time.Since(v.Now).Seconds(), route, r.Method, status)
+
+			return err
+		}
+	}
+}
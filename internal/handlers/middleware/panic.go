@@ -2,15 +2,20 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"github.com/leandersteiner/interview-assignment/internal/web"
 	"log/slog"
 	"net/http"
 )
 
+// Panic turns a panic of the handler into an internal server error. It must
+// be inside Errors, so the error is sent and counted like any other.
 func Panic(logger *slog.Logger) web.Middleware {
 	return func(next web.Handler) web.Handler {
-		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-			var pErr error
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) (pErr error) {
+			ctx, span := web.StartSpan(ctx, "middleware.Panic")
+			defer span.End()
+
 			defer func() {
 				v, err := web.GetValues(ctx)
 				if err != nil {
@@ -18,13 +23,11 @@ func Panic(logger *slog.Logger) web.Middleware {
 					return
 				}
 				if err := recover(); err != nil {
-					logger.Error("panic", "trace_id", v.TraceID, "method", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr, "error", err)
+					span.RecordError(fmt.Errorf("panic: %v", err))
+					logger.Error("panic", "trace_id", v.TraceID, "span_id", v.SpanID, "method", r.Method, "path", r.URL.Path, "ip", r.RemoteAddr, "error", err)
 					pErr = web.NewError(http.StatusInternalServerError, "There was an internal server error")
 				}
 			}()
-			if pErr != nil {
-				return pErr
-			}
 			return next(ctx, w, r)
 		}
 	}
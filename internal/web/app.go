@@ -12,16 +12,24 @@ import (
 type Handler func(context.Context, http.ResponseWriter, *http.Request) error
 
 type App struct {
-	mux    *http.ServeMux
-	mw     []Middleware
-	logger *slog.Logger
+	mux *http.ServeMux
+	// streams holds the patterns of the routes registered with Stream.
+	streams *http.ServeMux
+	mw      []Middleware
+	logger  *slog.Logger
+	// tracer is nil if tracing is disabled.
+	tracer *Tracer
 }
 
-func NewApp(logger *slog.Logger, mw ...Middleware) *App {
+// NewApp returns an app that traces sampled requests with tracer, unless it
+// is nil.
+func NewApp(logger *slog.Logger, tracer *Tracer, mw ...Middleware) *App {
 	return &App{
-		mux:    http.NewServeMux(),
-		mw:     mw,
-		logger: logger,
+		mux:     http.NewServeMux(),
+		streams: http.NewServeMux(),
+		mw:      mw,
+		logger:  logger,
+		tracer:  tracer,
 	}
 }
 
@@ -36,28 +44,53 @@ func (a *App) Handle(method string, group string, path string, handler Handler,
 	h := func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		v := Values{
-			TraceID: "traceid",
-			Now:     time.Now(),
+		v := traceContext(r)
+		v.Now = time.Now()
+
+		header := w.Header()
+		header.Set(TraceparentHeader, v.Traceparent())
+		if v.TraceState != "" {
+			header.Set(TracestateHeader, v.TraceState)
 		}
+		header.Set(RequestIDHeader, v.TraceID)
 
 		ctx = context.WithValue(ctx, key, &v)
 
-		if err := handler(ctx, w, r); err != nil {
+		var span *Span
+		if a.tracer != nil && v.TraceFlags&FlagSampled != 0 {
+			ctx, span = a.tracer.startRequest(ctx, &v, r)
+			// so that code that only has the request, like Decode, can
+			// start spans
+			r = r.WithContext(ctx)
+		}
+
+		err := handler(ctx, w, r)
+		span.SetAttributes(slog.Int("http.response.status_code", v.StatusCode))
+		if v.StatusCode >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("%d %s", v.StatusCode, http.StatusText(v.StatusCode)))
+		}
+		span.RecordError(err)
+		span.End()
+
+		if err != nil {
 			a.logger.Error("handler", "error", err)
 			return
 		}
 	}
 
+	register(a.mux, method, group, path, h)
+}
+
+func register(mux *http.ServeMux, method string, group string, path string, h http.HandlerFunc) {
 	finalPath := path
 	if group != "" {
 		finalPath = "/" + group + path
 	}
 
-	a.mux.HandleFunc(fmt.Sprintf("%s %s", method, finalPath), h)
+	mux.HandleFunc(fmt.Sprintf("%s %s", method, finalPath), h)
 	s, found := strings.CutSuffix(finalPath, "/")
 	if found {
-		a.mux.HandleFunc(fmt.Sprintf("%s %s", method, s), h)
+		mux.HandleFunc(fmt.Sprintf("%s %s", method, s), h)
 	}
 }
 
@@ -68,3 +101,63 @@ func (a *App) Get(group string, path string, handler Handler, mw ...Middleware)
 func (a *App) Post(group string, path string, handler Handler, mw ...Middleware) {
 	a.Handle(http.MethodPost, group, path, handler, mw...)
 }
+
+func (a *App) Put(group string, path string, handler Handler, mw ...Middleware) {
+	a.Handle(http.MethodPut, group, path, handler, mw...)
+}
+
+func (a *App) Delete(group string, path string, handler Handler, mw ...Middleware) {
+	a.Handle(http.MethodDelete, group, path, handler, mw...)
+}
+
+// Stream registers a GET route for a long-lived response, such as an event
+// stream or a WebSocket. Stream routes are exempt from TimeoutHandler.
+func (a *App) Stream(group string, path string, handler Handler, mw ...Middleware) {
+	a.Handle(http.MethodGet, group, path, handler, mw...)
+	register(a.streams, http.MethodGet, group, path, func(http.ResponseWriter, *http.Request) {})
+}
+
+// HTTPHandler adapts a standard library handler, recording the status it
+// responds with.
+func HTTPHandler(h http.Handler) Handler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		return SetStatusCode(ctx, sw.status)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Route returns the path pattern that matched the request, without its
+// method, e.g. /api/v1/calculator/results/{id}.
+func Route(r *http.Request) string {
+	if _, path, ok := strings.Cut(r.Pattern, " "); ok {
+		return path
+	}
+	return r.Pattern
+}
+
+// Streaming reports whether the request is for a route registered with
+// Stream.
+func (a *App) Streaming(r *http.Request) bool {
+	_, pattern := a.streams.Handler(r)
+	return pattern != ""
+}
@@ -11,9 +11,16 @@ type ctxKey int
 const key ctxKey = 1
 
 type Values struct {
-	TraceID    string
-	Now        time.Time
-	StatusCode int
+	// TraceID and SpanID identify the request in its W3C trace. The trace ID
+	// is continued from an incoming traceparent header, the span ID is new
+	// for every request.
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	TraceFlags   byte
+	TraceState   string
+	Now          time.Time
+	StatusCode   int
 }
 
 func GetValues(ctx context.Context) (*Values, error) {
@@ -3,6 +3,8 @@ package web
 type Error struct {
 	Status  int    `json:"-"`
 	Message string `json:"error"`
+	// Err is the underlying cause. It is logged but never sent to clients.
+	Err error `json:"-"`
 }
 
 func NewError(code int, message string) *Error {
@@ -12,6 +14,23 @@ func NewError(code int, message string) *Error {
 	}
 }
 
+// WrapError returns an error with a message that is safe to send to clients
+// and keeps err as its cause.
+func WrapError(code int, message string, err error) *Error {
+	return &Error{
+		Status:  code,
+		Message: message,
+		Err:     err,
+	}
+}
+
 func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
 	return e.Message
 }
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
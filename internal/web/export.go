@@ -0,0 +1,274 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recorder keeps finished spans in memory, e.g. for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) ExportSpan(span SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the finished spans in the order they ended.
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData(nil), r.spans...)
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
+
+const (
+	// fileExportBuffer is how many spans may wait for the file before new
+	// ones are dropped.
+	fileExportBuffer = 4096
+	// fileExportBatch is the most spans written in one line.
+	fileExportBatch = 512
+)
+
+// FileExporter appends finished spans to a file as JSON lines. Every line is
+// an OTLP/JSON ExportTraceServiceRequest, the format of the OpenTelemetry
+// Collector's file exporter, so the file can be replayed into any OTLP
+// backend. Spans are written in the background; when the writer falls
+// behind, spans are dropped rather than slowing down requests.
+type FileExporter struct {
+	file    *os.File
+	service string
+	spans   chan SpanData
+	done    chan struct{}
+	dropped atomic.Uint64
+	// mu guards closed, so spans that end after Close, e.g. of hijacked
+	// connections, are dropped rather than sent on a closed channel.
+	mu     sync.RWMutex
+	closed bool
+	err    error
+}
+
+// NewFileExporter appends to the file at path, creating it if needed.
+// service is reported as the service.name resource attribute.
+func NewFileExporter(path string, service string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &FileExporter{
+		file:    file,
+		service: service,
+		spans:   make(chan SpanData, fileExportBuffer),
+		done:    make(chan struct{}),
+	}
+	go e.write()
+	return e, nil
+}
+
+func (e *FileExporter) ExportSpan(span SpanData) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		e.dropped.Add(1)
+		return
+	}
+
+	select {
+	case e.spans <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many spans were dropped because the writer fell
+// behind.
+func (e *FileExporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Close writes the remaining spans and closes the file. Spans exported after
+// Close are dropped.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.spans)
+	e.mu.Unlock()
+
+	<-e.done
+	return errors.Join(e.err, e.file.Close())
+}
+
+func (e *FileExporter) write() {
+	defer close(e.done)
+	w := bufio.NewWriter(e.file)
+
+	batch := make([]SpanData, 0, fileExportBatch)
+	for span := range e.spans {
+		batch = append(batch[:0], span)
+		// take whatever else is waiting
+	more:
+		for len(batch) < fileExportBatch {
+			select {
+			case span, ok := <-e.spans:
+				if !ok {
+					break more
+				}
+				batch = append(batch, span)
+			default:
+				break more
+			}
+		}
+
+		line, err := json.Marshal(e.request(batch))
+		if err == nil {
+			_, _ = w.Write(append(line, '\n'))
+			err = w.Flush()
+		}
+		if err != nil && e.err == nil {
+			e.err = err
+		}
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	// Code is 0 for unset and 2 for error.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue; 64-bit integers are strings in OTLP/JSON.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *FileExporter) request(batch []SpanData) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			spans[i].Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: otlpAttributes([]slog.Attr{slog.String("service.name", e.service)}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/leandersteiner/interview-assignment/internal/web"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts the attributes. Durations become integer
+// nanoseconds.
+func otlpAttributes(attrs []slog.Attr) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		value := a.Value.Resolve()
+		switch value.Kind() {
+		case slog.KindInt64:
+			s := strconv.FormatInt(value.Int64(), 10)
+			v.IntValue = &s
+		case slog.KindUint64:
+			s := strconv.FormatUint(value.Uint64(), 10)
+			v.IntValue = &s
+		case slog.KindDuration:
+			s := strconv.FormatInt(value.Duration().Nanoseconds(), 10)
+			v.IntValue = &s
+		case slog.KindFloat64:
+			f := value.Float64()
+			v.DoubleValue = &f
+		case slog.KindBool:
+			b := value.Bool()
+			v.BoolValue = &b
+		case slog.KindTime:
+			s := value.Time().Format(time.RFC3339Nano)
+			v.StringValue = &s
+		default:
+			s := value.String()
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultCheckTimeout is the timeout of checks registered without one.
+const DefaultCheckTimeout = 2 * time.Second
+
+// Check returns an error if a dependency is unhealthy. It should return once
+// ctx is done.
+type Check func(ctx context.Context) error
+
+// HealthState is the phase of the process that readiness depends on.
+type HealthState string
+
+const (
+	HealthStarting HealthState = "starting"
+	HealthReady    HealthState = "ready"
+	HealthDraining HealthState = "draining"
+)
+
+// Health holds the readiness checks of the subsystems. The process is ready
+// once it has been marked ready, until it starts draining, and while all
+// checks pass.
+type Health struct {
+	mu     sync.RWMutex
+	state  HealthState
+	checks []namedCheck
+}
+
+type namedCheck struct {
+	name    string
+	timeout time.Duration
+	check   Check
+}
+
+// NewHealth returns a registry in the starting state.
+func NewHealth() *Health {
+	return &Health{state: HealthStarting}
+}
+
+// Register adds a check. A timeout of 0 means DefaultCheckTimeout. Checks are
+// reported by name, so registering a name twice panics.
+func (h *Health) Register(name string, timeout time.Duration, check Check) {
+	if timeout <= 0 {
+		timeout = DefaultCheckTimeout
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if slices.ContainsFunc(h.checks, func(c namedCheck) bool { return c.name == name }) {
+		panic(fmt.Sprintf("web: health check %q registered twice", name))
+	}
+	h.checks = append(h.checks, namedCheck{name, timeout, check})
+	slices.SortFunc(h.checks, func(a, b namedCheck) int {
+		return cmp.Compare(a.name, b.name)
+	})
+}
+
+// SetState moves the process to the phase, e.g. to HealthDraining when the
+// graceful shutdown starts.
+func (h *Health) SetState(state HealthState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = state
+}
+
+func (h *Health) State() HealthState {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.state
+}
+
+// HealthReport is the result of a probe.
+type HealthReport struct {
+	Status string        `json:"status"`
+	State  HealthState   `json:"state,omitempty"`
+	Checks []CheckResult `json:"checks,omitempty"`
+}
+
+type CheckResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// Run runs all checks concurrently, each with its own timeout. A check that
+// does not return in time is reported as failed without waiting for it.
+func (h *Health) Run(ctx context.Context) []CheckResult {
+	h.mu.RLock()
+	checks := slices.Clone(h.checks)
+	h.mu.RUnlock()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func runCheck(ctx context.Context, c namedCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", c.timeout)
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = ctx.Err()
+		}
+	}
+
+	result := CheckResult{Name: c.name, Status: statusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = statusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Livez reports that the process is alive and serving requests. It runs no
+// checks: a failing dependency is a reason to stop routing traffic to the
+// process, not to restart it.
+func (h *Health) Livez(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	report := HealthReport{Status: statusOK}
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		report.State = h.State()
+	}
+	return Respond(ctx, w, report, http.StatusOK)
+}
+
+// Readyz reports whether the process should receive traffic. Without the
+// verbose query parameter only failed checks are listed.
+func (h *Health) Readyz(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	_, verbose := r.URL.Query()["verbose"]
+
+	report := HealthReport{Status: statusOK, State: h.State()}
+	if report.State != HealthReady {
+		report.Status = statusUnavailable
+	}
+	for _, result := range h.Run(ctx) {
+		if result.Status != statusOK {
+			report.Status = statusUnavailable
+		} else if !verbose {
+			continue
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	status := http.StatusOK
+	if report.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	return Respond(ctx, w, report, status)
+}
@@ -0,0 +1,335 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds for request latencies.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text exposition
+// format. Registering a name twice panics, like http.ServeMux does for
+// patterns.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]collector{},
+	}
+}
+
+type collector interface {
+	// write writes the samples of the metric, without HELP and TYPE.
+	write(w *bufio.Writer, name string)
+}
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+type registered struct {
+	help string
+	typ  metricType
+	collector
+}
+
+func (r *Registry) register(name string, help string, typ metricType, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("web: metric %q registered twice", name))
+	}
+	r.metrics[name] = registered{help, typ, c}
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec[float64](labels)}
+	r.register(name, help, typeCounter, c)
+	return c
+}
+
+// Histogram registers a histogram with the given upper bounds, which must be
+// sorted, and label names.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets, vec: newVec[*histogramSeries](labels)}
+	r.register(name, help, typeHistogram, h)
+	return h
+}
+
+// CounterFunc registers a counter whose value is read from f when scraped.
+func (r *Registry) CounterFunc(name string, help string, f func() float64) {
+	r.register(name, help, typeCounter, valueFunc(f))
+}
+
+// GaugeFunc registers a gauge whose value is read from f when scraped.
+func (r *Registry) GaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, typeGauge, valueFunc(f))
+}
+
+// WriteTo writes all metrics sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]registered, len(names))
+	slices.Sort(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name].(registered)
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for i, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", names[i], escapeHelp(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", names[i], m.typ)
+		m.write(bw, names[i])
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// MetricsHandler serves the metrics of the registry to Prometheus.
+func MetricsHandler(reg *Registry) Handler {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		_ = SetStatusCode(ctx, http.StatusOK)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, err := reg.WriteTo(w)
+		return err
+	}
+}
+
+// Counter is a counter with labels. Its methods take the label values in
+// the order the label names were registered.
+type Counter struct {
+	vec *vec[float64]
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increases the counter. Negative values are ignored, counters only go
+// up.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		return
+	}
+	c.vec.update(labels, func(v *float64) {
+		*v += delta
+	})
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	c.vec.each(func(labels string, v float64) {
+		fmt.Fprintf(w, "%s%s %s\n", name, braced(labels), formatFloat(v))
+	})
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	vec     *vec[*histogramSeries]
+}
+
+type histogramSeries struct {
+	// counts[i] is the number of observations in (buckets[i-1], buckets[i]],
+	// the last one those above all buckets.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.vec.update(labels, func(s **histogramSeries) {
+		if *s == nil {
+			*s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		}
+		i, _ := slices.BinarySearch(h.buckets, value)
+		(*s).counts[i]++
+		(*s).sum += value
+		(*s).count++
+	})
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.vec.each(func(labels string, s *histogramSeries) {
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatFloat(upper), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braced(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braced(labels), s.count)
+	})
+}
+
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+// vec holds the series of a metric by their formatted labels.
+type vec[T any] struct {
+	names  []string
+	mu     sync.Mutex
+	series map[string]*T
+}
+
+func newVec[T any](names []string) *vec[T] {
+	return &vec[T]{
+		names:  names,
+		series: map[string]*T{},
+	}
+}
+
+func (v *vec[T]) update(values []string, f func(*T)) {
+	if len(values) != len(v.names) {
+		panic(fmt.Sprintf("web: got %d label values for labels %v", len(values), v.names))
+	}
+	labels := formatLabels(v.names, values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[labels]
+	if !ok {
+		s = new(T)
+		v.series[labels] = s
+	}
+	f(s)
+}
+
+// each calls f for every series, sorted by labels, with the lock held.
+func (v *vec[T]) each(f func(labels string, value T)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		f(k, *v.series[k])
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// RegisterRuntimeMetrics registers gauges and counters of the Go runtime.
+func RegisterRuntimeMetrics(reg *Registry) {
+	for _, m := range []struct {
+		name    string
+		help    string
+		sample  string
+		counter bool
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", "/sched/goroutines:goroutines", false},
+		{"go_gomaxprocs", "Value of GOMAXPROCS.", "/sched/gomaxprocs:threads", false},
+		{"go_memory_total_bytes", "All memory mapped by the Go runtime.", "/memory/classes/total:bytes", false},
+		{"go_memory_heap_objects_bytes", "Memory occupied by live and not yet swept heap objects.", "/memory/classes/heap/objects:bytes", false},
+		{"go_gc_heap_goal_bytes", "Heap size target for the end of the GC cycle.", "/gc/heap/goal:bytes", false},
+		{"go_gc_cycles_total", "Completed GC cycles.", "/gc/cycles/total:gc-cycles", true},
+		{"go_gc_heap_allocs_bytes_total", "Cumulative bytes allocated on the heap.", "/gc/heap/allocs:bytes", true},
+	} {
+		read := func() float64 {
+			return readRuntimeMetric(m.sample)
+		}
+		if m.counter {
+			reg.CounterFunc(m.name, m.help, read)
+		} else {
+			reg.GaugeFunc(m.name, m.help, read)
+		}
+	}
+}
+
+func readRuntimeMetric(name string) float64 {
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+	switch sample[0].Value.Kind() {
+	case metrics.KindUint64:
+		return float64(sample[0].Value.Uint64())
+	case metrics.KindFloat64:
+		return sample[0].Value.Float64()
+	}
+	return math.NaN()
+}
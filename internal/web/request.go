@@ -2,6 +2,7 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -17,9 +18,23 @@ func GetIntParam(query url.Values, key string, defaultValue int) int {
 	return defaultValue
 }
 
+// MaxBodySize is the largest request body Decode reads.
+const MaxBodySize = 1 << 20
+
+// Decode reads the JSON body of r into v. It returns an *Error with status
+// 413 if the body exceeds MaxBodySize and 400 if it is not valid JSON.
 func Decode[T any](r *http.Request, v *T) error {
-	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
-		return fmt.Errorf("failed to decode request body: %w", err)
+	_, span := StartSpan(r.Context(), "web.Decode")
+	defer span.End()
+
+	body := http.MaxBytesReader(nil, r.Body, MaxBodySize)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		span.RecordError(err)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large, the limit is %d bytes", maxErr.Limit))
+		}
+		return NewError(http.StatusBadRequest, fmt.Sprintf("failed to decode request body: %v", err))
 	}
 	err := r.Body.Close()
 	if err != nil {
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+)
+
+// SpanData is a finished span as passed to exporters.
+type SpanData struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   []slog.Attr
+	// Error is the message of the error recorded on the span, if any.
+	Error string
+}
+
+// SpanExporter receives every finished span. ExportSpan must not block for
+// long, it runs on the request path.
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+// Tracer starts the root span of every sampled request and passes finished
+// spans to its exporter.
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter}
+}
+
+type spanKey struct{}
+
+// Span is an operation within a trace. A nil *Span is valid and records
+// nothing, so code can be instrumented whether or not it is traced.
+type Span struct {
+	tracer *Tracer
+
+	mu    sync.Mutex
+	data  SpanData
+	ended bool
+}
+
+// StartSpan starts a child of the span in ctx and returns a context carrying
+// the new span. Without a span in ctx, e.g. when tracing is disabled or the
+// request is not sampled, it returns ctx and a nil span.
+func StartSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := parent.tracer.start(parent.data.TraceID, newSpanID(), parent.data.SpanID, name, SpanKindInternal, attrs)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the current span of ctx or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// startRequest starts the server span of a request. It uses the IDs of the
+// request's trace context, so the span ID is the one sent in traceparent.
+func (t *Tracer) startRequest(ctx context.Context, v *Values, r *http.Request) (context.Context, *Span) {
+	span := t.start(v.TraceID, v.SpanID, v.ParentSpanID, r.Pattern, SpanKindServer, []slog.Attr{
+		slog.String("http.request.method", r.Method),
+		slog.String("http.route", Route(r)),
+		slog.String("url.path", r.URL.Path),
+	})
+	span.data.Start = v.Now
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *Tracer) start(traceID, spanID, parentID, name string, kind SpanKind, attrs []slog.Attr) *Span {
+	return &Span{
+		tracer: t,
+		data: SpanData{
+			TraceID:      traceID,
+			SpanID:       spanID,
+			ParentSpanID: parentID,
+			Name:         name,
+			Kind:         kind,
+			Start:        time.Now(),
+			Attributes:   attrs,
+		},
+	}
+}
+
+func (s *Span) SetAttributes(attrs ...slog.Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// RecordError marks the span as failed. A nil error is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	s.tracer.exporter.ExportSpan(data)
+}
@@ -0,0 +1,21 @@
+package web
+
+import (
+	"net/http"
+	"time"
+)
+
+// TimeoutHandler is http.TimeoutHandler for all routes of the app except
+// stream routes. The timeout handler buffers responses, so streams could
+// neither flush nor run longer than the timeout.
+func TimeoutHandler(app *App, dt time.Duration, msg string) http.Handler {
+	timeout := http.TimeoutHandler(app, dt, msg)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Streaming(r) {
+			app.ServeHTTP(w, r)
+			return
+		}
+		timeout.ServeHTTP(w, r)
+	})
+}
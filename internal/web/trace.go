@@ -0,0 +1,103 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// TraceparentHeader and TracestateHeader are the W3C Trace Context
+	// headers, see https://www.w3.org/TR/trace-context/.
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+	RequestIDHeader   = "X-Request-ID"
+
+	// FlagSampled is the trace flag of traces that are recorded.
+	FlagSampled byte = 0x01
+
+	maxTracestateLength = 512
+)
+
+// traceContext continues the trace of the traceparent header of r or starts
+// a new one. Every request gets a new span ID.
+func traceContext(r *http.Request) Values {
+	v := Values{
+		SpanID: newSpanID(),
+	}
+
+	if traceID, parentID, flags, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		v.TraceID = traceID
+		v.ParentSpanID = parentID
+		v.TraceFlags = flags
+		// tracestate is only meaningful together with its traceparent
+		if state := strings.Join(r.Header.Values(TracestateHeader), ","); len(state) <= maxTracestateLength {
+			v.TraceState = state
+		}
+		return v
+	}
+
+	v.TraceID = newTraceID()
+	v.TraceFlags = FlagSampled
+	return v
+}
+
+// ParseTraceparent parses a traceparent header. Versions after 00 are read
+// as far as version 00 defines them, as the specification requires.
+func ParseTraceparent(header string) (traceID string, parentID string, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return "", "", 0, false
+	}
+	version, traceID, parentID, flagsHex := parts[0], parts[1], parts[2], parts[3]
+
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", 0, false
+	}
+	if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return "", "", 0, false
+	}
+	if !isHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return "", "", 0, false
+	}
+	if !isHex(flagsHex, 2) {
+		return "", "", 0, false
+	}
+	b, _ := hex.DecodeString(flagsHex)
+	return traceID, parentID, b[0], true
+}
+
+// isHex reports whether s consists of n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent returns the traceparent header of the request's span.
+func (v *Values) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", v.TraceID, v.SpanID, v.TraceFlags)
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand.Read never fails
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
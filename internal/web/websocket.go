@@ -0,0 +1,392 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the opcode of a WebSocket frame.
+type MessageType byte
+
+const (
+	continuationFrame MessageType = 0x0
+
+	TextMessage   MessageType = 0x1
+	BinaryMessage MessageType = 0x2
+	CloseMessage  MessageType = 0x8
+	PingMessage   MessageType = 0x9
+	PongMessage   MessageType = 0xa
+)
+
+// Close codes, see RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooLarge        = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// DefaultReadLimit is the largest message a connection accepts unless
+	// SetReadLimit changes it.
+	DefaultReadLimit = 64 << 10
+	// writeWait is how long a write may block before the peer is considered
+	// gone.
+	writeWait = 10 * time.Second
+	// maxControlPayload is the payload limit of close, ping and pong frames.
+	maxControlPayload = 125
+)
+
+var (
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrClosed          = errors.New("websocket: connection closed")
+)
+
+// CloseError is returned by ReadMessage when the peer closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Reason)
+}
+
+// Conn is the server side of a WebSocket connection (RFC 6455) without
+// extensions. ReadMessage must be called from one goroutine; writes are safe
+// for concurrent use.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	readLimit   int64
+	pongHandler func()
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// Upgrade performs the opening handshake and takes over the connection. It
+// returns an *Error if the request is not a valid WebSocket handshake or
+// comes from a page of another origin than the server or allowedOrigins, in
+// which case nothing was written yet.
+func Upgrade(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, NewError(http.StatusMethodNotAllowed, "websocket handshake requires GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, NewError(http.StatusUpgradeRequired, "websocket handshake required")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, NewError(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, NewError(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	if !originAllowed(r, allowedOrigins) {
+		return nil, NewError(http.StatusForbidden, "origin not allowed")
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, WrapError(http.StatusInternalServerError, "websocket upgrade failed", err)
+	}
+	// the server may have set deadlines for the HTTP request
+	_ = netConn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	_ = netConn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := brw.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn:      netConn,
+		br:        brw.Reader,
+		readLimit: DefaultReadLimit,
+	}, nil
+}
+
+// originAllowed reports whether the page in the Origin header may open a
+// connection. Browsers always send it, so requests without one come from
+// other clients, which cannot be used for cross-site requests.
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range allowed {
+		if strings.EqualFold(origin, o) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContains(h http.Header, name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for v := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadLimit sets the largest message ReadMessage accepts. Larger messages
+// close the connection with CloseTooLarge.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetPongHandler sets a function that ReadMessage calls for every pong.
+func (c *Conn) SetPongHandler(f func()) {
+	c.pongHandler = f
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs passed to the pong handler while reading. A close frame from the
+// peer is answered and returned as *CloseError; protocol violations close
+// the connection with the matching close code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		typ     MessageType
+		message []byte
+	)
+
+	for {
+		fin, opcode, payload, err := c.readFrame(int64(len(message)))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler()
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.closed(payload)
+		case TextMessage, BinaryMessage:
+			if typ != 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: new message inside a fragmented one", ErrProtocol))
+			}
+			typ = opcode
+		case continuationFrame:
+			if typ == 0 {
+				return 0, nil, c.fail(fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+		default:
+			return 0, nil, c.fail(fmt.Errorf("%w: unknown opcode %d", ErrProtocol, opcode))
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if typ == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.failWith(CloseInvalidPayload, errors.New("websocket: text message is not valid UTF-8"))
+		}
+		return typ, message, nil
+	}
+}
+
+// readFrame reads a single frame of a message of which read bytes were
+// already read.
+func (c *Conn) readFrame(read int64) (bool, MessageType, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := MessageType(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("%w: client frames must be masked", ErrProtocol)
+	}
+
+	size := int64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n := binary.BigEndian.Uint64(ext[:])
+		if n > 1<<62 {
+			return false, 0, nil, fmt.Errorf("%w: invalid length", ErrProtocol)
+		}
+		size = int64(n)
+	}
+
+	if opcode >= CloseMessage {
+		if !fin || size > maxControlPayload {
+			return false, 0, nil, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+		}
+	} else if read+size > c.readLimit {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// fail closes the connection with the close code for a read error.
+func (c *Conn) fail(err error) error {
+	switch {
+	case errors.Is(err, ErrMessageTooLarge):
+		return c.failWith(CloseTooLarge, err)
+	case errors.Is(err, ErrProtocol):
+		return c.failWith(CloseProtocolError, err)
+	}
+	// the connection itself failed, there is nobody to tell
+	c.conn.Close()
+	return err
+}
+
+func (c *Conn) failWith(code int, err error) error {
+	_ = c.Close(code, "")
+	return err
+}
+
+// closed answers the close frame of the peer and closes the connection.
+func (c *Conn) closed(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		_ = c.Close(CloseProtocolError, "")
+		return fmt.Errorf("%w: invalid close frame", ErrProtocol)
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+
+	code := closeErr.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	_ = c.Close(code, "")
+	return closeErr
+}
+
+// WriteMessage sends a text or binary message in a single frame.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	return c.writeFrame(typ, data)
+}
+
+func (c *Conn) Ping() error {
+	return c.writeFrame(PingMessage, nil)
+}
+
+// Close sends a close frame, unless one was sent already, and closes the
+// connection.
+func (c *Conn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason[:min(len(reason), maxControlPayload-2)]...)
+
+	err := c.writeFrame(CloseMessage, payload)
+	if errors.Is(err, ErrClosed) {
+		err = nil
+	}
+	return errors.Join(err, c.conn.Close())
+}
+
+// writeFrame writes an unmasked frame. Nothing is written after a close
+// frame or a failed write.
+func (c *Conn) writeFrame(typ MessageType, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if typ == CloseMessage {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|byte(typ))
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		// a partly written frame leaves nothing to build on
+		c.closeSent = true
+		c.conn.Close()
+		return err
+	}
+	return nil
+}